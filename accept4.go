@@ -0,0 +1,21 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux freebsd netbsd openbsd dragonfly
+
+package evio
+
+import "syscall"
+
+// acceptNonblock accepts a connection that is nonblocking and close-on-exec
+// with a single accept4 call.
+func acceptNonblock(fd int) (int, syscall.Sockaddr, error) {
+	nfd, sa, err := syscall.Accept4(fd,
+		syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+	if err == syscall.ENOSYS {
+		// kernels that are too old for accept4
+		return acceptCloexec(fd)
+	}
+	return nfd, sa, err
+}
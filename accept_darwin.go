@@ -0,0 +1,13 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import "syscall"
+
+// acceptNonblock accepts a connection that is nonblocking and close-on-exec.
+// Darwin doesn't have accept4.
+func acceptNonblock(fd int) (int, syscall.Sockaddr, error) {
+	return acceptCloexec(fd)
+}
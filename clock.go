@@ -0,0 +1,97 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time of the timers of a server, which are Tick, the
+// AfterFunc and Ticker timers, and the idle timeouts. See Events.Clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// ManualClock is a Clock that only moves when Advance is called, so that
+// tests can check the timers of a server without sleeping:
+//
+//	clock := evio.NewManualClock(time.Now())
+//	events.Clock = clock
+//	...
+//	clock.Advance(time.Minute) // the idle connections are closed
+//
+// The loop of a server with a ManualClock only wakes for its timers when
+// the clock is advanced.
+type ManualClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	loops []*loop
+}
+
+// NewManualClock returns a ManualClock that is stopped at now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, and returns once the servers that
+// use it have fired the timers that are due. It must not be called from an
+// event of one of those servers.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	loops := append([]*loop(nil), c.loops...)
+	c.mu.Unlock()
+	for _, l := range loops {
+		done := make(chan struct{})
+		if !l.execute(func() {
+			defer close(done)
+			l.fire(l.clockNow())
+		}) {
+			c.remove(l)
+			continue
+		}
+		select {
+		case <-done:
+		case <-l.done:
+			c.remove(l)
+		}
+	}
+}
+
+// add wakes the loop on each Advance.
+func (c *ManualClock) add(l *loop) {
+	c.mu.Lock()
+	c.loops = append(c.loops, l)
+	c.mu.Unlock()
+}
+
+// remove stops waking a loop that has stopped.
+func (c *ManualClock) remove(l *loop) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, cl := range c.loops {
+		if cl == l {
+			c.loops = append(c.loops[:i], c.loops[i+1:]...)
+			return
+		}
+	}
+}
+
+// clockNow returns the time of the timers of the loop.
+func (l *loop) clockNow() time.Time {
+	if l.events.Clock != nil {
+		return l.events.Clock.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package codec provides framing codecs for splitting the data passed to
+// the evio Data event into messages.
+package codec
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrTooLong is returned when a frame is longer than the codec allows. The
+// connection should be closed.
+var ErrTooLong = errors.New("frame too long")
+
+// Delimiter splits a stream into frames that end with a delimiter, such as
+// "\n" or "\r\n". Use one Delimiter for each connection, such as in the
+// connection context, and close the connection when Decode fails:
+//
+//	frames, err := d.Decode(in)
+//	if err != nil {
+//		return nil, evio.Close
+//	}
+//
+// A Delimiter is also an evio.Codec, which lets the loop do the framing:
+//
+//	c.SetCodec(&codec.Delimiter{Delim: []byte("\r\n")})
+type Delimiter struct {
+	// Delim is the frame delimiter. The default is "\n".
+	Delim []byte
+	// MaxLength, when positive, is the most bytes allowed in a frame, not
+	// including the delimiter.
+	MaxLength int
+
+	buf []byte // buffered data
+	off int    // start of the unread data in buf
+}
+
+var lf = []byte{'\n'}
+
+// Decode adds the in data to the stream and returns the complete frames,
+// without their delimiters. Incomplete data is buffered until the next call.
+// The frames are only valid until the next call to Decode. Returns
+// ErrTooLong if a frame is longer than MaxLength.
+func (d *Delimiter) Decode(in []byte) (frames [][]byte, err error) {
+	delim := d.Delim
+	if len(delim) == 0 {
+		delim = lf
+	}
+	data := in
+	buffered := len(d.buf) > d.off
+	if buffered {
+		// move the unread data to the front
+		n := copy(d.buf, d.buf[d.off:])
+		d.buf = append(d.buf[:n], in...)
+		d.off = 0
+		data = d.buf
+	}
+	for {
+		i := bytes.Index(data, delim)
+		if i < 0 {
+			break
+		}
+		if d.MaxLength > 0 && i > d.MaxLength {
+			d.Reset()
+			return frames, ErrTooLong
+		}
+		frames = append(frames, data[:i:i])
+		data = data[i+len(delim):]
+	}
+	// allow for a partial delimiter at the end
+	if d.MaxLength > 0 && len(data) > d.MaxLength+len(delim)-1 {
+		d.Reset()
+		return frames, ErrTooLong
+	}
+	if buffered {
+		d.off = len(d.buf) - len(data)
+	} else {
+		d.buf = append(d.buf[:0], data...)
+		d.off = 0
+	}
+	return frames, nil
+}
+
+// Buffered returns the number of bytes of incomplete data that are waiting
+// for a delimiter.
+func (d *Delimiter) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Reset discards the buffered data.
+func (d *Delimiter) Reset() {
+	d.buf = d.buf[:0]
+	d.off = 0
+}
+
+// Encode appends the frame and the delimiter to dst.
+func (d *Delimiter) Encode(dst, frame []byte) []byte {
+	delim := d.Delim
+	if len(delim) == 0 {
+		delim = lf
+	}
+	return append(append(dst, frame...), delim...)
+}
@@ -0,0 +1,38 @@
+package codec
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDelimiter(t *testing.T) {
+	d := Delimiter{Delim: []byte("\r\n"), MaxLength: 8}
+	var all []string
+	for _, in := range []string{"HELLO\r", "\nWOR", "LD\r\n\r\nA\r\nB", "C\r\n"} {
+		frames, err := d.Decode([]byte(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range frames {
+			all = append(all, string(frame))
+		}
+	}
+	if fmt.Sprintf("%q", all) != `["HELLO" "WORLD" "" "A" "BC"]` {
+		t.Fatalf("expected '%s', got '%q'", `["HELLO" "WORLD" "" "A" "BC"]`,
+			all)
+	}
+	if d.Buffered() != 0 {
+		t.Fatalf("expected '%d', got '%d'", 0, d.Buffered())
+	}
+	if _, err := d.Decode([]byte("TOOLONGLINE")); err != ErrTooLong {
+		t.Fatalf("expected '%v', got '%v'", ErrTooLong, err)
+	}
+	frames, err := d.Decode([]byte("OK\r\n"))
+	if err != nil || len(frames) != 1 || string(frames[0]) != "OK" {
+		t.Fatalf("expected '%s', got '%q' %v", "OK", frames, err)
+	}
+	out := d.Encode([]byte("A\r\n"), []byte("B"))
+	if string(out) != "A\r\nB\r\n" {
+		t.Fatalf("expected '%q', got '%q'", "A\r\nB\r\n", out)
+	}
+}
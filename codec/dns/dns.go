@@ -0,0 +1,447 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package dns implements the DNS wire format, RFC 1035, for DNS servers
+// built on evio. Parse decodes a message and Message.Append encodes one.
+// Over UDP each datagram is a message. Over TCP each message has a two byte
+// length prefix, which the Decoder and AppendTCP handle, or the Codec.
+//
+// Names are dotted strings such as "www.example.com.", and labels that
+// contain dots aren't supported.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrMalformed is returned for a message that can't be parsed.
+var ErrMalformed = errors.New("malformed message")
+
+// ErrBadName is returned when encoding an invalid name.
+var ErrBadName = errors.New("bad name")
+
+// Resource record types.
+const (
+	TypeA     uint16 = 1
+	TypeNS    uint16 = 2
+	TypeCNAME uint16 = 5
+	TypeSOA   uint16 = 6
+	TypePTR   uint16 = 12
+	TypeMX    uint16 = 15
+	TypeTXT   uint16 = 16
+	TypeAAAA  uint16 = 28
+	TypeSRV   uint16 = 33
+	TypeOPT   uint16 = 41
+	TypeANY   uint16 = 255
+)
+
+// ClassINET is the Internet class.
+const ClassINET uint16 = 1
+
+// Response codes.
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+// Header is the header of a message.
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             byte
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	Rcode              byte
+}
+
+// Question is an entry in the question section.
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Resource is a resource record. Data is the record data in wire format.
+// Names in the data of NS, CNAME, SOA, PTR, MX, and SRV records are
+// uncompressed by Parse.
+type Resource struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Message is a DNS message.
+type Message struct {
+	Header
+	Questions   []Question
+	Answers     []Resource
+	Authorities []Resource
+	Additionals []Resource
+}
+
+// Parse parses a message.
+func Parse(msg []byte) (*Message, error) {
+	if len(msg) < 12 {
+		return nil, ErrMalformed
+	}
+	m := new(Message)
+	m.ID = binary.BigEndian.Uint16(msg)
+	flags := binary.BigEndian.Uint16(msg[2:])
+	m.Response = flags&0x8000 != 0
+	m.Opcode = byte(flags>>11) & 0x0F
+	m.Authoritative = flags&0x0400 != 0
+	m.Truncated = flags&0x0200 != 0
+	m.RecursionDesired = flags&0x0100 != 0
+	m.RecursionAvailable = flags&0x0080 != 0
+	m.Rcode = byte(flags) & 0x0F
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+i*2:]))
+	}
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		var q Question
+		var err error
+		q.Name, off, err = readName(msg, off)
+		if err != nil || len(msg)-off < 4 {
+			return nil, ErrMalformed
+		}
+		q.Type = binary.BigEndian.Uint16(msg[off:])
+		q.Class = binary.BigEndian.Uint16(msg[off+2:])
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+	sections := []*[]Resource{&m.Answers, &m.Authorities, &m.Additionals}
+	for i, section := range sections {
+		for j := 0; j < counts[i+1]; j++ {
+			var r Resource
+			var err error
+			r, off, err = readResource(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			*section = append(*section, r)
+		}
+	}
+	return m, nil
+}
+
+func readResource(msg []byte, off int) (r Resource, next int, err error) {
+	r.Name, off, err = readName(msg, off)
+	if err != nil || len(msg)-off < 10 {
+		return r, 0, ErrMalformed
+	}
+	r.Type = binary.BigEndian.Uint16(msg[off:])
+	r.Class = binary.BigEndian.Uint16(msg[off+2:])
+	r.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	size := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if len(msg)-off < size {
+		return r, 0, ErrMalformed
+	}
+	end := off + size
+	// the fixed size prefix of the data, before a name
+	prefix := -1
+	switch r.Type {
+	case TypeNS, TypeCNAME, TypePTR, TypeSOA:
+		prefix = 0
+	case TypeMX:
+		prefix = 2
+	case TypeSRV:
+		prefix = 6
+	}
+	if prefix < 0 || size < prefix {
+		r.Data = msg[off:end:end]
+		return r, end, nil
+	}
+	// uncompress the names so the data doesn't refer to the message
+	data := append([]byte(nil), msg[off:off+prefix]...)
+	name, n, err := readName(msg[:end], off+prefix)
+	if err != nil {
+		return r, 0, err
+	}
+	data = appendName(data, name, nil)
+	if r.Type == TypeSOA {
+		name, n, err = readName(msg[:end], n)
+		if err != nil {
+			return r, 0, err
+		}
+		data = appendName(data, name, nil)
+	}
+	data = append(data, msg[n:end]...)
+	r.Data = data
+	return r, end, nil
+}
+
+// readName reads a possibly compressed name. Returns the offset after the
+// name.
+func readName(msg []byte, off int) (string, int, error) {
+	var name []byte
+	next := -1
+	for hops := 0; ; {
+		if off >= len(msg) {
+			return "", 0, ErrMalformed
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			off++
+			if c == 0 {
+				if next < 0 {
+					next = off
+				}
+				if len(name) == 0 {
+					return ".", next, nil
+				}
+				return string(name), next, nil
+			}
+			if len(msg)-off < c || len(name)+c+1 > 255 {
+				return "", 0, ErrMalformed
+			}
+			name = append(name, msg[off:off+c]...)
+			name = append(name, '.')
+			off += c
+		case 0xC0:
+			if len(msg)-off < 2 {
+				return "", 0, ErrMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			hops++
+			if hops > 127 {
+				return "", 0, ErrMalformed
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			return "", 0, ErrMalformed
+		}
+	}
+}
+
+// appendName appends a name. When comp is not nil, the name is compressed
+// using the offsets of the names already in the message, and its suffixes
+// are added to comp.
+func appendName(dst []byte, name string, comp *compressor) []byte {
+	if name == "." || name == "" {
+		return append(dst, 0)
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	for i := 0; i < len(name); {
+		if comp != nil {
+			if off, ok := comp.offs[name[i:]]; ok {
+				return append(dst, byte(0xC0|off>>8), byte(off))
+			}
+			if off := len(dst) - comp.base; off <= 0x3FFF {
+				comp.offs[name[i:]] = off
+			}
+		}
+		j := strings.IndexByte(name[i:], '.')
+		dst = append(dst, byte(j))
+		dst = append(dst, name[i:i+j]...)
+		i += j + 1
+	}
+	return append(dst, 0)
+}
+
+type compressor struct {
+	base int            // start of the message in dst
+	offs map[string]int // offsets of the name suffixes
+}
+
+func checkName(name string) error {
+	if name == "." || name == "" {
+		return nil
+	}
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return ErrBadName
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return ErrBadName
+		}
+	}
+	return nil
+}
+
+// Append appends the message in wire format to dst, with the names
+// compressed.
+func (m *Message) Append(dst []byte) ([]byte, error) {
+	comp := &compressor{base: len(dst), offs: make(map[string]int)}
+	var flags uint16
+	if m.Response {
+		flags |= 0x8000
+	}
+	flags |= uint16(m.Opcode&0x0F) << 11
+	if m.Authoritative {
+		flags |= 0x0400
+	}
+	if m.Truncated {
+		flags |= 0x0200
+	}
+	if m.RecursionDesired {
+		flags |= 0x0100
+	}
+	if m.RecursionAvailable {
+		flags |= 0x0080
+	}
+	flags |= uint16(m.Rcode & 0x0F)
+	dst = appendUint16(dst, m.ID)
+	dst = appendUint16(dst, flags)
+	dst = appendUint16(dst, uint16(len(m.Questions)))
+	dst = appendUint16(dst, uint16(len(m.Answers)))
+	dst = appendUint16(dst, uint16(len(m.Authorities)))
+	dst = appendUint16(dst, uint16(len(m.Additionals)))
+	for _, q := range m.Questions {
+		if err := checkName(q.Name); err != nil {
+			return dst, err
+		}
+		dst = appendName(dst, q.Name, comp)
+		dst = appendUint16(dst, q.Type)
+		dst = appendUint16(dst, q.Class)
+	}
+	for _, section := range [][]Resource{m.Answers, m.Authorities,
+		m.Additionals} {
+		for _, r := range section {
+			if err := checkName(r.Name); err != nil {
+				return dst, err
+			}
+			if len(r.Data) > 0xFFFF {
+				return dst, ErrMalformed
+			}
+			dst = appendName(dst, r.Name, comp)
+			dst = appendUint16(dst, r.Type)
+			dst = appendUint16(dst, r.Class)
+			dst = append(dst, byte(r.TTL>>24), byte(r.TTL>>16),
+				byte(r.TTL>>8), byte(r.TTL))
+			dst = appendUint16(dst, uint16(len(r.Data)))
+			dst = append(dst, r.Data...)
+		}
+	}
+	return dst, nil
+}
+
+func appendUint16(dst []byte, x uint16) []byte {
+	return append(dst, byte(x>>8), byte(x))
+}
+
+// AData returns the data of an A or AAAA record for the IP.
+func AData(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return append([]byte(nil), ip4...)
+	}
+	return append([]byte(nil), ip.To16()...)
+}
+
+// NameData returns the data of an NS, CNAME, or PTR record.
+func NameData(name string) []byte {
+	return appendName(nil, name, nil)
+}
+
+// MXData returns the data of an MX record.
+func MXData(pref uint16, name string) []byte {
+	return appendName(appendUint16(nil, pref), name, nil)
+}
+
+// TXTData returns the data of a TXT record. Strings longer than 255 bytes are
+// split.
+func TXTData(txts ...string) []byte {
+	var data []byte
+	for _, s := range txts {
+		for {
+			n := len(s)
+			if n > 255 {
+				n = 255
+			}
+			data = append(data, byte(n))
+			data = append(data, s[:n]...)
+			s = s[n:]
+			if len(s) == 0 {
+				break
+			}
+		}
+	}
+	return data
+}
+
+// Decoder splits a TCP connection's stream into messages, which have a two
+// byte length prefix. Use one Decoder for each connection.
+type Decoder struct {
+	buf []byte // buffered data
+	off int    // start of the unread data in buf
+}
+
+// Decode adds the in data to the stream and returns the complete messages,
+// without their prefixes. Incomplete data is buffered until the next call.
+// The messages are only valid until the next call to Decode.
+func (d *Decoder) Decode(in []byte) (msgs [][]byte) {
+	data := in
+	buffered := len(d.buf) > d.off
+	if buffered {
+		// move the unread data to the front
+		n := copy(d.buf, d.buf[d.off:])
+		d.buf = append(d.buf[:n], in...)
+		d.off = 0
+		data = d.buf
+	}
+	for len(data) >= 2 {
+		n := 2 + int(binary.BigEndian.Uint16(data))
+		if len(data) < n {
+			break
+		}
+		msgs = append(msgs, data[2:n:n])
+		data = data[n:]
+	}
+	if buffered {
+		d.off = len(d.buf) - len(data)
+	} else {
+		d.buf = append(d.buf[:0], data...)
+		d.off = 0
+	}
+	return msgs
+}
+
+// Buffered returns the number of bytes of incomplete data.
+func (d *Decoder) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Codec frames the messages of a TCP connection, for the Conn.SetCodec of
+// evio. Use one Codec for each connection.
+type Codec struct {
+	d Decoder
+}
+
+// Decode adds the in data to the stream and returns the complete messages,
+// the same as Decoder.Decode. It never fails.
+func (c *Codec) Decode(in []byte) (msgs [][]byte, err error) {
+	return c.d.Decode(in), nil
+}
+
+// Encode appends the message with its TCP length prefix to dst, the same as
+// AppendTCP.
+func (c *Codec) Encode(dst, msg []byte) []byte {
+	return AppendTCP(dst, msg)
+}
+
+// AppendTCP appends the message with its TCP length prefix to dst. Messages
+// over 65535 bytes can't be sent over TCP.
+func AppendTCP(dst, msg []byte) []byte {
+	dst = appendUint16(dst, uint16(len(msg)))
+	return append(dst, msg...)
+}
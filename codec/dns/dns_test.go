@@ -0,0 +1,77 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	m := &Message{
+		Header: Header{ID: 7, Response: true, Authoritative: true,
+			RecursionDesired: true},
+		Questions: []Question{{"www.example.com.", TypeA, ClassINET}},
+		Answers: []Resource{
+			{"www.example.com.", TypeCNAME, ClassINET, 60,
+				NameData("web.example.com.")},
+			{"web.example.com", TypeA, ClassINET, 60,
+				AData(net.IPv4(10, 0, 0, 1))},
+		},
+		Additionals: []Resource{
+			{"example.com.", TypeMX, ClassINET, 300,
+				MXData(10, "mail.example.com.")},
+		},
+	}
+	prefix := []byte("xx")
+	b, err := m.Append(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the example.com. suffix of the owner names is only written once
+	if len(b)-len(prefix) != 114 {
+		t.Fatalf("expected '%d', got '%d'", 114, len(b)-len(prefix))
+	}
+	m2, err := Parse(b[len(prefix):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Answers[1].Name = "web.example.com."
+	if fmt.Sprint(m) != fmt.Sprint(m2) {
+		t.Fatalf("expected '%v', got '%v'", m, m2)
+	}
+	if _, err := Parse(b[len(prefix) : len(b)-4]); err != ErrMalformed {
+		t.Fatalf("expected '%v', got '%v'", ErrMalformed, err)
+	}
+	if _, err := (&Message{Questions: []Question{{Name: "a..b"}}}).
+		Append(nil); err != ErrBadName {
+		t.Fatalf("expected '%v', got '%v'", ErrBadName, err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	stream := AppendTCP(AppendTCP(nil, []byte("ONE")), []byte("TWO"))
+	var d Decoder
+	var all []string
+	for i := range stream {
+		for _, msg := range d.Decode(stream[i : i+1]) {
+			all = append(all, string(msg))
+		}
+	}
+	if fmt.Sprint(all) != "[ONE TWO]" {
+		t.Fatalf("expected '%s', got '%s'", "[ONE TWO]", all)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	var c Codec
+	stream := c.Encode(c.Encode(nil, []byte("ONE")), []byte("TWO"))
+	msgs, err := c.Decode(stream[:7])
+	if err != nil || fmt.Sprint(len(msgs), c.d.Buffered()) != "1 2" {
+		t.Fatalf("expected '%s', got '%v'", "1 2",
+			fmt.Sprint(len(msgs), c.d.Buffered()))
+	}
+	msgs, _ = c.Decode(stream[7:])
+	if len(msgs) != 1 || string(msgs[0]) != "TWO" {
+		t.Fatalf("expected '%s', got '%s'", "TWO", msgs)
+	}
+}
@@ -0,0 +1,403 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package http2 implements HTTP/2 framing, RFC 7540, for servers built on
+// evio, including h2c with prior knowledge. The Decoder splits a stream into
+// frames and joins header blocks that span CONTINUATION frames, and the
+// Append functions write frames.
+//
+// Header compression isn't included. The complete header block of each
+// HEADERS frame is passed as is, ready for an HPACK decoder such as
+// golang.org/x/net/http2/hpack, which keeps the loop free of goroutines.
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Preface is the client connection preface.
+const Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// FrameType is the type of a frame.
+type FrameType byte
+
+// Frame types.
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+// Frame flags.
+const (
+	FlagEndStream  = 0x1
+	FlagAck        = 0x1
+	FlagEndHeaders = 0x4
+	FlagPadded     = 0x8
+	FlagPriority   = 0x20
+)
+
+// Error codes.
+const (
+	ErrCodeNo              = 0x0
+	ErrCodeProtocol        = 0x1
+	ErrCodeInternal        = 0x2
+	ErrCodeFlowControl     = 0x3
+	ErrCodeStreamClosed    = 0x5
+	ErrCodeFrameSize       = 0x6
+	ErrCodeRefusedStream   = 0x7
+	ErrCodeCancel          = 0x8
+	ErrCodeCompression     = 0x9
+	ErrCodeEnhanceYourCalm = 0xb
+	ErrCodeHTTP11Required  = 0xd
+)
+
+const (
+	defaultMaxFrameSize       = 16384
+	defaultMaxHeaderBlockSize = 1024 * 1024
+)
+
+var (
+	// ErrPreface is returned when the client preface is wrong.
+	ErrPreface = errors.New("bad connection preface")
+	// ErrProtocol is returned for a frame that breaks the protocol. The
+	// connection should be sent a GOAWAY with ErrCodeProtocol and closed.
+	ErrProtocol = errors.New("protocol error")
+	// ErrFrameSize is returned for a frame over Decoder.MaxFrameSize.
+	ErrFrameSize = errors.New("frame size error")
+)
+
+// Frame is an HTTP/2 frame.
+type Frame struct {
+	Type     FrameType
+	Flags    byte
+	StreamID uint32
+	// Payload is the frame payload. For a HEADERS or PUSH_PROMISE frame
+	// that was followed by CONTINUATION frames, it includes their header
+	// block fragments and the FlagEndHeaders flag is set.
+	Payload []byte
+}
+
+// Data returns the data of a DATA frame, or the header block of a HEADERS or
+// PUSH_PROMISE frame, without the padding and priority fields.
+func (f Frame) Data() ([]byte, error) {
+	p := f.Payload
+	if f.Flags&FlagPadded != 0 && (f.Type == FrameData ||
+		f.Type == FrameHeaders || f.Type == FramePushPromise) {
+		if len(p) < 1 || int(p[0]) > len(p)-1 {
+			return nil, ErrProtocol
+		}
+		p = p[1 : len(p)-int(p[0])]
+	}
+	if f.Type == FrameHeaders && f.Flags&FlagPriority != 0 {
+		if len(p) < 5 {
+			return nil, ErrProtocol
+		}
+		p = p[5:]
+	}
+	if f.Type == FramePushPromise {
+		if len(p) < 4 {
+			return nil, ErrProtocol
+		}
+		p = p[4:]
+	}
+	return p, nil
+}
+
+// Setting is a SETTINGS parameter.
+type Setting struct {
+	ID    uint16
+	Value uint32
+}
+
+// Settings parameters.
+const (
+	SettingHeaderTableSize      = 0x1
+	SettingEnablePush           = 0x2
+	SettingMaxConcurrentStreams = 0x3
+	SettingInitialWindowSize    = 0x4
+	SettingMaxFrameSize         = 0x5
+	SettingMaxHeaderListSize    = 0x6
+)
+
+// Settings returns the parameters of a SETTINGS frame.
+func (f Frame) Settings() ([]Setting, error) {
+	if f.Type != FrameSettings || len(f.Payload)%6 != 0 {
+		return nil, ErrProtocol
+	}
+	settings := make([]Setting, 0, len(f.Payload)/6)
+	for p := f.Payload; len(p) > 0; p = p[6:] {
+		settings = append(settings, Setting{
+			ID:    binary.BigEndian.Uint16(p),
+			Value: binary.BigEndian.Uint32(p[2:]),
+		})
+	}
+	return settings, nil
+}
+
+// Decoder splits a connection's stream into frames. Use one Decoder for each
+// connection.
+type Decoder struct {
+	// Server is true when decoding the frames that a client sends, which
+	// begin with the client preface.
+	Server bool
+	// MaxFrameSize is the largest frame payload accepted, which should
+	// match the SETTINGS_MAX_FRAME_SIZE sent to the peer. The default is
+	// 16384.
+	MaxFrameSize int
+	// MaxHeaderBlockSize is the largest header block accepted after joining
+	// CONTINUATION frames. The default is 1 MiB.
+	MaxHeaderBlockSize int
+
+	preface bool   // the client preface was read
+	headers *Frame // HEADERS frame waiting for CONTINUATION frames
+	block   []byte // header block of headers
+	buf     []byte // buffered data
+	off     int    // start of the unread data in buf
+}
+
+// Decode adds the in data to the stream and returns the complete frames.
+// Incomplete data is buffered until the next call. The frames are only valid
+// until the next call to Decode.
+func (d *Decoder) Decode(in []byte) (frames []Frame, err error) {
+	data := in
+	buffered := len(d.buf) > d.off
+	if buffered {
+		// move the unread data to the front
+		n := copy(d.buf, d.buf[d.off:])
+		d.buf = append(d.buf[:n], in...)
+		d.off = 0
+		data = d.buf
+	}
+	if d.Server && !d.preface {
+		n := len(Preface)
+		if len(data) < n {
+			n = len(data)
+		}
+		if string(data[:n]) != Preface[:n] {
+			d.Reset()
+			return nil, ErrPreface
+		}
+		if n == len(Preface) {
+			d.preface = true
+			data = data[n:]
+		}
+	}
+	for !d.Server || d.preface {
+		f, n, err := d.frame(data)
+		if err == nil && n > 0 {
+			var ok bool
+			f, ok, err = d.join(f)
+			if ok {
+				frames = append(frames, f)
+			}
+		}
+		if err != nil {
+			d.Reset()
+			return frames, err
+		}
+		if n == 0 {
+			break
+		}
+		data = data[n:]
+	}
+	if buffered {
+		d.off = len(d.buf) - len(data)
+	} else {
+		d.buf = append(d.buf[:0], data...)
+		d.off = 0
+	}
+	return frames, nil
+}
+
+// Buffered returns the number of bytes of incomplete data.
+func (d *Decoder) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Reset discards the buffered data and any partial header block.
+func (d *Decoder) Reset() {
+	d.buf = d.buf[:0]
+	d.off = 0
+	d.headers = nil
+	d.block = nil
+}
+
+// frame reads the frame at the start of data. Returns the number of bytes
+// read, which is zero when the frame is incomplete.
+func (d *Decoder) frame(data []byte) (f Frame, n int, err error) {
+	if len(data) < 9 {
+		return f, 0, nil
+	}
+	size := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	max := d.MaxFrameSize
+	if max <= 0 {
+		max = defaultMaxFrameSize
+	}
+	if size > max {
+		return f, 0, ErrFrameSize
+	}
+	if len(data) < 9+size {
+		return f, 0, nil
+	}
+	f.Type = FrameType(data[3])
+	f.Flags = data[4]
+	f.StreamID = binary.BigEndian.Uint32(data[5:]) & 0x7FFFFFFF
+	f.Payload = data[9 : 9+size : 9+size]
+	return f, 9 + size, nil
+}
+
+// join joins the header block fragments of HEADERS, PUSH_PROMISE, and
+// CONTINUATION frames. Returns false while the block is incomplete.
+func (d *Decoder) join(f Frame) (Frame, bool, error) {
+	if d.headers != nil {
+		// only the block's CONTINUATION frames may come next
+		if f.Type != FrameContinuation || f.StreamID != d.headers.StreamID {
+			return f, false, ErrProtocol
+		}
+		if err := d.appendBlock(f.Payload); err != nil {
+			return f, false, err
+		}
+		if f.Flags&FlagEndHeaders == 0 {
+			return f, false, nil
+		}
+		h := *d.headers
+		h.Flags |= FlagEndHeaders
+		h.Payload = d.block
+		d.headers = nil
+		d.block = nil
+		return h, true, nil
+	}
+	switch f.Type {
+	case FrameContinuation:
+		return f, false, ErrProtocol
+	case FrameHeaders, FramePushPromise:
+		if f.Flags&FlagEndHeaders != 0 {
+			return f, true, nil
+		}
+		// keep the priority or promised stream fields, but drop the
+		// padding, which comes before the continued fragments
+		payload := f.Payload
+		if f.Flags&FlagPadded != 0 {
+			if len(payload) < 1 || int(payload[0]) > len(payload)-1 {
+				return f, false, ErrProtocol
+			}
+			payload = payload[1 : len(payload)-int(payload[0])]
+			f.Flags &^= FlagPadded
+		}
+		d.block = nil
+		if err := d.appendBlock(payload); err != nil {
+			return f, false, err
+		}
+		f.Payload = nil
+		d.headers = &f
+		return f, false, nil
+	}
+	return f, true, nil
+}
+
+func (d *Decoder) appendBlock(fragment []byte) error {
+	max := d.MaxHeaderBlockSize
+	if max <= 0 {
+		max = defaultMaxHeaderBlockSize
+	}
+	if len(d.block)+len(fragment) > max {
+		return ErrProtocol
+	}
+	d.block = append(d.block, fragment...)
+	return nil
+}
+
+// AppendFrame appends a frame with the payload to dst.
+func AppendFrame(dst []byte, typ FrameType, flags byte, streamID uint32,
+	payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(typ), flags)
+	dst = appendUint32(dst, streamID&0x7FFFFFFF)
+	return append(dst, payload...)
+}
+
+func appendUint32(dst []byte, x uint32) []byte {
+	return append(dst, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+}
+
+// AppendSettings appends a SETTINGS frame with the parameters.
+func AppendSettings(dst []byte, settings ...Setting) []byte {
+	payload := make([]byte, 0, len(settings)*6)
+	for _, s := range settings {
+		payload = append(payload, byte(s.ID>>8), byte(s.ID))
+		payload = appendUint32(payload, s.Value)
+	}
+	return AppendFrame(dst, FrameSettings, 0, 0, payload)
+}
+
+// AppendSettingsAck appends a SETTINGS frame that acknowledges the peer's
+// settings.
+func AppendSettingsAck(dst []byte) []byte {
+	return AppendFrame(dst, FrameSettings, FlagAck, 0, nil)
+}
+
+// AppendPingAck appends the PING frame that answers a PING with the data.
+func AppendPingAck(dst []byte, data []byte) []byte {
+	return AppendFrame(dst, FramePing, FlagAck, 0, data)
+}
+
+// AppendWindowUpdate appends a WINDOW_UPDATE frame. A stream ID of zero
+// updates the connection window.
+func AppendWindowUpdate(dst []byte, streamID, increment uint32) []byte {
+	return AppendFrame(dst, FrameWindowUpdate, 0, streamID,
+		appendUint32(nil, increment&0x7FFFFFFF))
+}
+
+// AppendRSTStream appends a RST_STREAM frame with the error code.
+func AppendRSTStream(dst []byte, streamID, code uint32) []byte {
+	return AppendFrame(dst, FrameRSTStream, 0, streamID,
+		appendUint32(nil, code))
+}
+
+// AppendGoAway appends a GOAWAY frame with the last processed stream ID and
+// the error code.
+func AppendGoAway(dst []byte, lastStreamID, code uint32,
+	debug []byte) []byte {
+	payload := appendUint32(nil, lastStreamID&0x7FFFFFFF)
+	payload = append(appendUint32(payload, code), debug...)
+	return AppendFrame(dst, FrameGoAway, 0, 0, payload)
+}
+
+// AppendHeaders appends a HEADERS frame with the HPACK encoded header block,
+// followed by CONTINUATION frames when the block is larger than
+// maxFrameSize.
+func AppendHeaders(dst []byte, streamID uint32, block []byte, endStream bool,
+	maxFrameSize int) []byte {
+	if maxFrameSize <= 0 {
+		maxFrameSize = defaultMaxFrameSize
+	}
+	typ := FrameHeaders
+	var flags byte
+	if endStream {
+		flags = FlagEndStream
+	}
+	for {
+		n := len(block)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		} else {
+			flags |= FlagEndHeaders
+		}
+		dst = AppendFrame(dst, typ, flags, streamID, block[:n])
+		block = block[n:]
+		if len(block) == 0 {
+			return dst
+		}
+		typ, flags = FrameContinuation, 0
+	}
+}
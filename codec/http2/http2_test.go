@@ -0,0 +1,66 @@
+package http2
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	stream := []byte(Preface)
+	stream = AppendSettings(stream, Setting{SettingMaxFrameSize, 16384})
+	// padded HEADERS, continued by a CONTINUATION frame
+	stream = AppendFrame(stream, FrameHeaders, FlagPadded, 1,
+		[]byte("\x02ABxx"))
+	stream = AppendFrame(stream, FrameContinuation, FlagEndHeaders, 1,
+		[]byte("CD"))
+	stream = AppendFrame(stream, FrameData, FlagPadded|FlagEndStream, 1,
+		[]byte("\x01HELLO\x00"))
+	stream = AppendFrame(stream, FramePing, 0, 0, []byte("12345678"))
+	d := Decoder{Server: true}
+	var all []string
+	for i := 0; i < len(stream); i += 3 {
+		end := i + 3
+		if end > len(stream) {
+			end = len(stream)
+		}
+		frames, err := d.Decode(stream[i:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range frames {
+			data, err := f.Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			all = append(all, fmt.Sprintf("%d:%d:%d:%s", f.Type, f.Flags,
+				f.StreamID, data))
+		}
+	}
+	expect := "[4:0:0:\x00\x05\x00\x00@\x00 1:4:1:ABCD 0:9:1:HELLO " +
+		"6:0:0:12345678]"
+	if fmt.Sprint(all) != expect {
+		t.Fatalf("expected '%q', got '%q'", expect, fmt.Sprint(all))
+	}
+	bad := AppendFrame(nil, FrameHeaders, 0, 3, nil)
+	bad = AppendFrame(bad, FrameData, 0, 3, nil)
+	if _, err := d.Decode(bad); err != ErrProtocol {
+		t.Fatalf("expected '%v', got '%v'", ErrProtocol, err)
+	}
+	if _, err := (&Decoder{Server: true}).Decode([]byte("GET /")); err !=
+		ErrPreface {
+		t.Fatalf("expected '%v', got '%v'", ErrPreface, err)
+	}
+}
+
+func TestAppendHeaders(t *testing.T) {
+	var d Decoder
+	frames, err := d.Decode(AppendHeaders(nil, 5, []byte("ABCDEFGHIJ"), true,
+		4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || string(frames[0].Payload) != "ABCDEFGHIJ" ||
+		frames[0].Flags != FlagEndStream|FlagEndHeaders {
+		t.Fatalf("unexpected frames '%v'", frames)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package memcache implements the memcached ASCII protocol for cache servers
+// built on evio. The Decoder parses the commands that clients send, including
+// the data blocks of storage commands, and the Append functions write
+// replies.
+package memcache
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrBadCommand is returned for a malformed command line.
+	ErrBadCommand = errors.New("bad command line format")
+	// ErrBadDataChunk is returned when a data block isn't followed by CRLF.
+	ErrBadDataChunk = errors.New("bad data chunk")
+	// ErrTooLarge is returned for a line over 2048 bytes or a data block
+	// over Decoder.MaxValueSize.
+	ErrTooLarge = errors.New("object too large for cache")
+)
+
+const (
+	maxLine             = 2048
+	defaultMaxValueSize = 1024 * 1024
+)
+
+// Command is a parsed client command.
+type Command struct {
+	// Name is the command name, such as "get", "set", or "delete".
+	Name string
+	// Args are the arguments that follow the name.
+	Args [][]byte
+	// Noreply is true when the last argument is "noreply". It's not
+	// included in Args.
+	Noreply bool
+	// The following are only set for the storage commands, which are set,
+	// add, replace, append, prepend, and cas.
+	Key     []byte
+	Flags   uint32
+	Exptime int64
+	Cas     uint64 // only for cas
+	Data    []byte
+}
+
+// IsStorage returns true if the command is followed by a data block.
+func IsStorage(name string) bool {
+	switch name {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return true
+	}
+	return false
+}
+
+// Decoder parses commands from a connection's stream. Use one Decoder for
+// each connection.
+type Decoder struct {
+	// MaxValueSize is the largest data block accepted. The default is
+	// 1 MiB.
+	MaxValueSize int
+
+	buf []byte // buffered data
+	off int    // start of the unread data in buf
+}
+
+// Decode adds the in data to the stream and returns the complete commands.
+// Incomplete data, such as a storage command waiting for its data block, is
+// buffered until the next call. The commands are only valid until the next
+// call to Decode.
+//
+// A bad command line returns ErrBadCommand along with the commands before
+// it, and the client should be sent a CLIENT_ERROR. The data after the bad
+// line is kept, so call Decode again with nil to carry on. Other errors mean that the
+// stream can't be recovered and the connection should be closed.
+func (d *Decoder) Decode(in []byte) (cmds []Command, err error) {
+	data := in
+	buffered := len(d.buf) > d.off
+	if buffered {
+		// move the unread data to the front
+		n := copy(d.buf, d.buf[d.off:])
+		d.buf = append(d.buf[:n], in...)
+		d.off = 0
+		data = d.buf
+	}
+	for len(data) > 0 {
+		var cmd Command
+		var n int
+		cmd, n, err = d.parse(data)
+		if err == ErrBadCommand {
+			// skip the line so the client can carry on
+			data = data[n:]
+			break
+		}
+		if err != nil {
+			d.Reset()
+			return cmds, err
+		}
+		if n == 0 {
+			break
+		}
+		if cmd.Name != "" {
+			cmds = append(cmds, cmd)
+		}
+		data = data[n:]
+	}
+	if buffered {
+		d.off = len(d.buf) - len(data)
+	} else {
+		d.buf = append(d.buf[:0], data...)
+		d.off = 0
+	}
+	return cmds, err
+}
+
+// Buffered returns the number of bytes of incomplete data.
+func (d *Decoder) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Reset discards the buffered data.
+func (d *Decoder) Reset() {
+	d.buf = d.buf[:0]
+	d.off = 0
+}
+
+// parse parses the command at the start of data. Returns the number of bytes
+// read, which is zero when the command is incomplete.
+func (d *Decoder) parse(data []byte) (cmd Command, n int, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > maxLine {
+			return cmd, 0, ErrTooLarge
+		}
+		return cmd, 0, nil
+	}
+	n = i + 1
+	line := data[:i]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return cmd, n, nil
+	}
+	cmd.Name = string(fields[0])
+	cmd.Args = fields[1:]
+	if len(cmd.Args) > 0 && string(cmd.Args[len(cmd.Args)-1]) == "noreply" {
+		cmd.Noreply = true
+		cmd.Args = cmd.Args[:len(cmd.Args)-1]
+	}
+	if !IsStorage(cmd.Name) {
+		return cmd, n, nil
+	}
+	// <key> <flags> <exptime> <bytes> [<cas unique>]
+	nargs := 4
+	if cmd.Name == "cas" {
+		nargs = 5
+	}
+	if len(cmd.Args) != nargs {
+		return cmd, n, ErrBadCommand
+	}
+	cmd.Key = cmd.Args[0]
+	flags, err1 := strconv.ParseUint(string(cmd.Args[1]), 10, 32)
+	exptime, err2 := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	size, err3 := strconv.ParseUint(string(cmd.Args[3]), 10, 31)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return cmd, n, ErrBadCommand
+	}
+	if nargs == 5 {
+		cas, err := strconv.ParseUint(string(cmd.Args[4]), 10, 64)
+		if err != nil {
+			return cmd, n, ErrBadCommand
+		}
+		cmd.Cas = cas
+	}
+	max := d.MaxValueSize
+	if max <= 0 {
+		max = defaultMaxValueSize
+	}
+	if int(size) > max {
+		return cmd, n, ErrTooLarge
+	}
+	cmd.Flags = uint32(flags)
+	cmd.Exptime = exptime
+	if len(data) < n+int(size)+2 {
+		return cmd, 0, nil
+	}
+	if data[n+int(size)] != '\r' || data[n+int(size)+1] != '\n' {
+		return cmd, n, ErrBadDataChunk
+	}
+	cmd.Data = data[n : n+int(size) : n+int(size)]
+	return cmd, n + int(size) + 2, nil
+}
+
+// AppendValue appends a VALUE line and data block for a get reply. A cas of
+// zero is left out, use it for get and a non-zero cas for gets.
+func AppendValue(dst, key []byte, flags uint32, data []byte,
+	cas uint64) []byte {
+	dst = append(dst, "VALUE "...)
+	dst = append(dst, key...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, uint64(flags), 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(len(data)), 10)
+	if cas != 0 {
+		dst = append(dst, ' ')
+		dst = strconv.AppendUint(dst, cas, 10)
+	}
+	dst = append(dst, '\r', '\n')
+	dst = append(dst, data...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendLine appends a reply line, such as "STORED", "END", "DELETED", or
+// "NOT_FOUND".
+func AppendLine(dst []byte, line string) []byte {
+	dst = append(dst, line...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendUint appends the reply to incr and decr.
+func AppendUint(dst []byte, n uint64) []byte {
+	dst = strconv.AppendUint(dst, n, 10)
+	return append(dst, '\r', '\n')
+}
+
+// AppendClientError appends a CLIENT_ERROR reply.
+func AppendClientError(dst []byte, msg string) []byte {
+	return AppendLine(append(dst, "CLIENT_ERROR "...), msg)
+}
+
+// AppendServerError appends a SERVER_ERROR reply.
+func AppendServerError(dst []byte, msg string) []byte {
+	return AppendLine(append(dst, "SERVER_ERROR "...), msg)
+}
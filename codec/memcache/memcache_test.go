@@ -0,0 +1,51 @@
+package memcache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	var d Decoder
+	var all []string
+	for _, in := range []string{
+		"get a b\r\nset k 5 0 12 nor",
+		"eply\r\nHELLO\r\n",
+		"WORLD\r\ncas k 0 0 2 99\r\nOK\r\ndelete k\r\n",
+	} {
+		cmds, err := d.Decode([]byte(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cmd := range cmds {
+			all = append(all, fmt.Sprintf("%s %q %v %s %d %d %q",
+				cmd.Name, cmd.Args, cmd.Noreply, cmd.Key, cmd.Flags, cmd.Cas,
+				cmd.Data))
+		}
+	}
+	expect := `[get ["a" "b"] false  0 0 "" ` +
+		`set ["k" "5" "0" "12"] true k 5 0 "HELLO\r\nWORLD" ` +
+		`cas ["k" "0" "0" "2" "99"] false k 0 99 "OK" ` +
+		`delete ["k"] false  0 0 ""]`
+	if fmt.Sprint(all) != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, all)
+	}
+	cmds, err := d.Decode([]byte("set k x 0 1\r\nget a\r\n"))
+	if err != ErrBadCommand || len(cmds) != 0 {
+		t.Fatalf("expected '%v', got '%v'", ErrBadCommand, err)
+	}
+	cmds, err = d.Decode(nil)
+	if err != nil || len(cmds) != 1 || cmds[0].Name != "get" {
+		t.Fatalf("expected '%s', got '%v' %v", "get", cmds, err)
+	}
+	if _, err := d.Decode([]byte("set k 0 0 1\r\nAB\r\n")); err !=
+		ErrBadDataChunk {
+		t.Fatalf("expected '%v', got '%v'", ErrBadDataChunk, err)
+	}
+	out := AppendValue(nil, []byte("k"), 5, []byte("HI"), 0)
+	out = AppendLine(out, "END")
+	if string(out) != "VALUE k 5 2\r\nHI\r\nEND\r\n" {
+		t.Fatalf("expected '%q', got '%q'", "VALUE k 5 2\r\nHI\r\nEND\r\n",
+			out)
+	}
+}
@@ -0,0 +1,460 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package mqtt implements MQTT 3.1.1 and 5.0 control packet framing for
+// brokers built on evio. The Decoder splits the Data event stream into
+// packets, the Parse functions decode the packets that clients send, and
+// the Append functions encode the packets that brokers send.
+//
+// MQTT 5 properties are passed through as raw bytes.
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrMalformed is returned for a malformed packet. The connection should be
+// closed.
+var ErrMalformed = errors.New("malformed packet")
+
+// ErrTooLarge is returned for a packet over Decoder.MaxPacketSize.
+var ErrTooLarge = errors.New("packet too large")
+
+// Protocol versions.
+const (
+	Version311 = 4
+	Version5   = 5
+)
+
+// PacketType is the type of a control packet.
+type PacketType byte
+
+// Control packet types.
+const (
+	CONNECT     PacketType = 1
+	CONNACK     PacketType = 2
+	PUBLISH     PacketType = 3
+	PUBACK      PacketType = 4
+	PUBREC      PacketType = 5
+	PUBREL      PacketType = 6
+	PUBCOMP     PacketType = 7
+	SUBSCRIBE   PacketType = 8
+	SUBACK      PacketType = 9
+	UNSUBSCRIBE PacketType = 10
+	UNSUBACK    PacketType = 11
+	PINGREQ     PacketType = 12
+	PINGRESP    PacketType = 13
+	DISCONNECT  PacketType = 14
+	AUTH        PacketType = 15
+)
+
+// Packet is a control packet.
+type Packet struct {
+	Type  PacketType
+	Flags byte   // low four bits of the fixed header
+	Body  []byte // variable header and payload
+}
+
+// Decoder splits a connection's stream into control packets. Use one Decoder
+// for each connection.
+type Decoder struct {
+	// MaxPacketSize, when positive, is the largest packet accepted,
+	// including the fixed header.
+	MaxPacketSize int
+
+	buf []byte // buffered data
+	off int    // start of the unread data in buf
+}
+
+// Decode adds the in data to the stream and returns the complete packets.
+// Incomplete data is buffered until the next call. The packets are only valid
+// until the next call to Decode.
+func (d *Decoder) Decode(in []byte) (packets []Packet, err error) {
+	data := in
+	buffered := len(d.buf) > d.off
+	if buffered {
+		// move the unread data to the front
+		n := copy(d.buf, d.buf[d.off:])
+		d.buf = append(d.buf[:n], in...)
+		d.off = 0
+		data = d.buf
+	}
+	for len(data) >= 2 {
+		size, n := uvarint(data[1:])
+		if n < 0 {
+			d.Reset()
+			return packets, ErrMalformed
+		}
+		if n == 0 {
+			break
+		}
+		total := 1 + n + size
+		if d.MaxPacketSize > 0 && total > d.MaxPacketSize {
+			d.Reset()
+			return packets, ErrTooLarge
+		}
+		if len(data) < total {
+			break
+		}
+		packets = append(packets, Packet{
+			Type:  PacketType(data[0] >> 4),
+			Flags: data[0] & 0x0F,
+			Body:  data[1+n : total : total],
+		})
+		data = data[total:]
+	}
+	if buffered {
+		d.off = len(d.buf) - len(data)
+	} else {
+		d.buf = append(d.buf[:0], data...)
+		d.off = 0
+	}
+	return packets, nil
+}
+
+// Buffered returns the number of bytes of incomplete data.
+func (d *Decoder) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Reset discards the buffered data.
+func (d *Decoder) Reset() {
+	d.buf = d.buf[:0]
+	d.off = 0
+}
+
+// uvarint reads a variable byte integer. Returns the number of bytes read,
+// which is zero if the data is incomplete or negative if it's malformed.
+func uvarint(data []byte) (int, int) {
+	var x, shift int
+	for i := 0; i < 4; i++ {
+		if i == len(data) {
+			return 0, 0
+		}
+		x |= int(data[i]&0x7F) << shift
+		if data[i]&0x80 == 0 {
+			return x, i + 1
+		}
+		shift += 7
+	}
+	return 0, -1
+}
+
+func appendUvarint(dst []byte, x int) []byte {
+	for x >= 0x80 {
+		dst = append(dst, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(dst, byte(x))
+}
+
+// reader reads the fields of a packet body.
+type reader struct {
+	b   []byte
+	err bool
+}
+
+func (r *reader) byte() byte {
+	if len(r.b) < 1 {
+		r.err = true
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *reader) uint16() uint16 {
+	if len(r.b) < 2 {
+		r.err = true
+		return 0
+	}
+	x := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return x
+}
+
+func (r *reader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err || len(r.b) < n {
+		r.err = true
+		return nil
+	}
+	b := r.b[:n:n]
+	r.b = r.b[n:]
+	return b
+}
+
+// props reads MQTT 5 properties.
+func (r *reader) props() []byte {
+	n, m := uvarint(r.b)
+	if m <= 0 || len(r.b) < m+n {
+		r.err = true
+		return nil
+	}
+	b := r.b[m : m+n : m+n]
+	r.b = r.b[m+n:]
+	return b
+}
+
+// Connect is a CONNECT packet.
+type Connect struct {
+	ProtocolName   string
+	Version        byte
+	CleanStart     bool
+	KeepAlive      uint16
+	Properties     []byte
+	ClientID       string
+	Will           bool
+	WillQoS        byte
+	WillRetain     bool
+	WillProperties []byte
+	WillTopic      string
+	WillMessage    []byte
+	HasUsername    bool
+	Username       string
+	HasPassword    bool
+	Password       []byte
+}
+
+// ParseConnect parses the body of a CONNECT packet.
+func ParseConnect(body []byte) (*Connect, error) {
+	r := reader{b: body}
+	c := new(Connect)
+	c.ProtocolName = string(r.bytes())
+	c.Version = r.byte()
+	flags := r.byte()
+	c.KeepAlive = r.uint16()
+	if r.err || flags&0x01 != 0 ||
+		(c.Version != Version311 && c.Version != Version5) {
+		return nil, ErrMalformed
+	}
+	if c.Version == Version5 {
+		c.Properties = r.props()
+	}
+	c.CleanStart = flags&0x02 != 0
+	c.Will = flags&0x04 != 0
+	c.WillQoS = flags >> 3 & 0x03
+	c.WillRetain = flags&0x20 != 0
+	c.ClientID = string(r.bytes())
+	if c.Will {
+		if c.Version == Version5 {
+			c.WillProperties = r.props()
+		}
+		c.WillTopic = string(r.bytes())
+		c.WillMessage = r.bytes()
+	}
+	c.HasUsername = flags&0x80 != 0
+	if c.HasUsername {
+		c.Username = string(r.bytes())
+	}
+	c.HasPassword = flags&0x40 != 0
+	if c.HasPassword {
+		c.Password = r.bytes()
+	}
+	if r.err || c.WillQoS > 2 {
+		return nil, ErrMalformed
+	}
+	return c, nil
+}
+
+// Publish is a PUBLISH packet.
+type Publish struct {
+	Dup        bool
+	QoS        byte
+	Retain     bool
+	Topic      string
+	PacketID   uint16 // only for QoS 1 and 2
+	Properties []byte
+	Payload    []byte
+}
+
+// ParsePublish parses a PUBLISH packet for the protocol version of the
+// connection.
+func ParsePublish(p Packet, version byte) (*Publish, error) {
+	r := reader{b: p.Body}
+	pub := &Publish{
+		Dup:    p.Flags&0x08 != 0,
+		QoS:    p.Flags >> 1 & 0x03,
+		Retain: p.Flags&0x01 != 0,
+	}
+	pub.Topic = string(r.bytes())
+	if pub.QoS > 0 {
+		pub.PacketID = r.uint16()
+	}
+	if version == Version5 {
+		pub.Properties = r.props()
+	}
+	if r.err || pub.QoS > 2 {
+		return nil, ErrMalformed
+	}
+	pub.Payload = r.b
+	return pub, nil
+}
+
+// Subscription is a topic filter of a SUBSCRIBE packet. For MQTT 5 the
+// Options also hold the No Local, Retain As Published, and Retain Handling
+// bits.
+type Subscription struct {
+	Filter  string
+	Options byte
+}
+
+// QoS returns the maximum QoS of the subscription.
+func (s Subscription) QoS() byte {
+	return s.Options & 0x03
+}
+
+// Subscribe is a SUBSCRIBE or UNSUBSCRIBE packet. Unsubscribe filters have no
+// options.
+type Subscribe struct {
+	PacketID      uint16
+	Properties    []byte
+	Subscriptions []Subscription
+}
+
+// ParseSubscribe parses a SUBSCRIBE or UNSUBSCRIBE packet for the protocol
+// version of the connection.
+func ParseSubscribe(p Packet, version byte) (*Subscribe, error) {
+	if (p.Type != SUBSCRIBE && p.Type != UNSUBSCRIBE) || p.Flags != 0x02 {
+		return nil, ErrMalformed
+	}
+	r := reader{b: p.Body}
+	sub := new(Subscribe)
+	sub.PacketID = r.uint16()
+	if version == Version5 {
+		sub.Properties = r.props()
+	}
+	for !r.err && len(r.b) > 0 {
+		var s Subscription
+		s.Filter = string(r.bytes())
+		if p.Type == SUBSCRIBE {
+			s.Options = r.byte()
+		}
+		sub.Subscriptions = append(sub.Subscriptions, s)
+	}
+	if r.err || len(sub.Subscriptions) == 0 {
+		return nil, ErrMalformed
+	}
+	return sub, nil
+}
+
+// ParsePacketID parses the packet identifier of a PUBACK, PUBREC, PUBREL, or
+// PUBCOMP packet.
+func ParsePacketID(p Packet) (uint16, error) {
+	if len(p.Body) < 2 {
+		return 0, ErrMalformed
+	}
+	return binary.BigEndian.Uint16(p.Body), nil
+}
+
+// AppendPacket appends a packet with the body to dst.
+func AppendPacket(dst []byte, typ PacketType, flags byte, body []byte) []byte {
+	return append(appendHeader(dst, typ, flags, len(body)), body...)
+}
+
+// appendHeader appends the fixed header of a packet with a body of size
+// bytes.
+func appendHeader(dst []byte, typ PacketType, flags byte, size int) []byte {
+	dst = append(dst, byte(typ)<<4|flags&0x0F)
+	return appendUvarint(dst, size)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = append(dst, byte(len(s)>>8), byte(len(s)))
+	return append(dst, s...)
+}
+
+func propsSize(props []byte) int {
+	return len(appendUvarint(nil, len(props))) + len(props)
+}
+
+// AppendConnack appends a CONNACK packet. For MQTT 3.1.1 the code is the
+// return code, and for MQTT 5 it's the reason code.
+func AppendConnack(dst []byte, version byte, sessionPresent bool,
+	code byte) []byte {
+	var flags byte
+	if sessionPresent {
+		flags = 1
+	}
+	if version == Version5 {
+		return append(appendHeader(dst, CONNACK, 0, 3), flags, code, 0)
+	}
+	return append(appendHeader(dst, CONNACK, 0, 2), flags, code)
+}
+
+// AppendPublish appends a PUBLISH packet for the protocol version of the
+// connection. The packet must fit in the 256 MiB limit of the protocol.
+func AppendPublish(dst []byte, version byte, p *Publish) []byte {
+	var flags byte
+	if p.Dup {
+		flags |= 0x08
+	}
+	flags |= p.QoS & 0x03 << 1
+	if p.Retain {
+		flags |= 0x01
+	}
+	size := 2 + len(p.Topic) + len(p.Payload)
+	if p.QoS > 0 {
+		size += 2
+	}
+	if version == Version5 {
+		size += propsSize(p.Properties)
+	}
+	dst = appendHeader(dst, PUBLISH, flags, size)
+	dst = appendString(dst, p.Topic)
+	if p.QoS > 0 {
+		dst = append(dst, byte(p.PacketID>>8), byte(p.PacketID))
+	}
+	if version == Version5 {
+		dst = appendUvarint(dst, len(p.Properties))
+		dst = append(dst, p.Properties...)
+	}
+	return append(dst, p.Payload...)
+}
+
+// AppendAck appends a PUBACK, PUBREC, PUBREL, or PUBCOMP packet with a
+// success reason code.
+func AppendAck(dst []byte, typ PacketType, packetID uint16) []byte {
+	var flags byte
+	if typ == PUBREL {
+		flags = 0x02
+	}
+	dst = appendHeader(dst, typ, flags, 2)
+	return append(dst, byte(packetID>>8), byte(packetID))
+}
+
+// AppendSuback appends a SUBACK or UNSUBACK packet with a code for each
+// subscription. For MQTT 3.1.1 an UNSUBACK has no codes.
+func AppendSuback(dst []byte, version byte, typ PacketType, packetID uint16,
+	codes []byte) []byte {
+	if typ == UNSUBACK && version != Version5 {
+		codes = nil
+	}
+	size := 2 + len(codes)
+	if version == Version5 {
+		size++
+	}
+	dst = appendHeader(dst, typ, 0, size)
+	dst = append(dst, byte(packetID>>8), byte(packetID))
+	if version == Version5 {
+		dst = append(dst, 0)
+	}
+	return append(dst, codes...)
+}
+
+// AppendPingresp appends a PINGRESP packet.
+func AppendPingresp(dst []byte) []byte {
+	return appendHeader(dst, PINGRESP, 0, 0)
+}
+
+// AppendDisconnect appends a DISCONNECT packet. The reason code is only sent
+// for MQTT 5.
+func AppendDisconnect(dst []byte, version byte, code byte) []byte {
+	if version == Version5 {
+		return append(appendHeader(dst, DISCONNECT, 0, 1), code)
+	}
+	return appendHeader(dst, DISCONNECT, 0, 0)
+}
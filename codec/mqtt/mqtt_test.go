@@ -0,0 +1,69 @@
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	var stream []byte
+	stream = AppendPacket(stream, CONNECT, 0, []byte{
+		0, 4, 'M', 'Q', 'T', 'T', Version5, 0xC2, 0, 60, 0,
+		0, 3, 'c', 'i', 'd',
+		0, 1, 'u',
+		0, 2, 'p', 'w',
+	})
+	stream = AppendPublish(stream, Version5, &Publish{QoS: 1, PacketID: 7,
+		Topic: "a/b", Payload: make([]byte, 200)})
+	stream = AppendPacket(stream, SUBSCRIBE, 2, []byte{0, 9, 0, 0, 3, 'a',
+		'/', '#', 1})
+	d := Decoder{MaxPacketSize: 1024}
+	var packets []Packet
+	for i := 0; i < len(stream); i += 5 {
+		end := i + 5
+		if end > len(stream) {
+			end = len(stream)
+		}
+		ps, err := d.Decode(stream[i:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range ps {
+			p.Body = append([]byte(nil), p.Body...)
+			packets = append(packets, p)
+		}
+	}
+	if len(packets) != 3 {
+		t.Fatalf("expected '%d', got '%d'", 3, len(packets))
+	}
+	c, err := ParseConnect(packets[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ClientID != "cid" || c.Username != "u" || string(c.Password) != "pw" ||
+		!c.CleanStart || c.KeepAlive != 60 {
+		t.Fatalf("unexpected connect '%+v'", c)
+	}
+	pub, err := ParsePublish(packets[1], c.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.Topic != "a/b" || pub.PacketID != 7 || len(pub.Payload) != 200 {
+		t.Fatalf("unexpected publish '%+v'", pub)
+	}
+	sub, err := ParseSubscribe(packets[2], c.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.PacketID != 9 || len(sub.Subscriptions) != 1 ||
+		sub.Subscriptions[0].Filter != "a/#" ||
+		sub.Subscriptions[0].QoS() != 1 {
+		t.Fatalf("unexpected subscribe '%+v'", sub)
+	}
+	if _, err := d.Decode([]byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF}); err !=
+		ErrMalformed {
+		t.Fatalf("expected '%v', got '%v'", ErrMalformed, err)
+	}
+	if _, err := d.Decode([]byte{0x30, 0xFF, 0x7F}); err != ErrTooLarge {
+		t.Fatalf("expected '%v', got '%v'", ErrTooLarge, err)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package nats implements the NATS text protocol for message brokers built
+// on evio. The Decoder parses protocol operations, including the payloads of
+// PUB, HPUB, MSG, and HMSG, and the Append functions write the operations
+// that servers send.
+package nats
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrUnknownOp is returned for an unknown protocol operation.
+	ErrUnknownOp = errors.New("unknown protocol operation")
+	// ErrBadArgs is returned for an operation with invalid arguments.
+	ErrBadArgs = errors.New("invalid arguments")
+	// ErrBadPayload is returned when a payload isn't followed by CRLF.
+	ErrBadPayload = errors.New("invalid payload")
+	// ErrControlLine is returned for a line over 4096 bytes.
+	ErrControlLine = errors.New("maximum control line exceeded")
+	// ErrMaxPayload is returned for a payload over Decoder.MaxPayload.
+	ErrMaxPayload = errors.New("maximum payload exceeded")
+)
+
+const (
+	maxControlLine    = 4096
+	defaultMaxPayload = 1024 * 1024
+)
+
+// Op is a protocol operation.
+type Op struct {
+	// Name is the operation name in upper case, such as "PUB" or "SUB".
+	Name string
+	// Args are the arguments that follow the name. For CONNECT and INFO
+	// there's one argument, which is the JSON object.
+	Args [][]byte
+	// Header is the header block of HPUB and HMSG.
+	Header []byte
+	// Payload is the message payload of PUB, HPUB, MSG, and HMSG.
+	Payload []byte
+}
+
+// Decoder parses operations from a connection's stream. Use one Decoder for
+// each connection. The Decoder never returns an error from a partial read.
+type Decoder struct {
+	// MaxPayload is the largest payload accepted, including the header.
+	// The default is 1 MiB.
+	MaxPayload int
+
+	buf []byte // buffered data
+	off int    // start of the unread data in buf
+}
+
+// Decode adds the in data to the stream and returns the complete operations.
+// Incomplete data is buffered until the next call. The operations are only
+// valid until the next call to Decode. After an error the client should be
+// sent -ERR and the connection closed.
+func (d *Decoder) Decode(in []byte) (ops []Op, err error) {
+	data := in
+	buffered := len(d.buf) > d.off
+	if buffered {
+		// move the unread data to the front
+		n := copy(d.buf, d.buf[d.off:])
+		d.buf = append(d.buf[:n], in...)
+		d.off = 0
+		data = d.buf
+	}
+	for len(data) > 0 {
+		var op Op
+		var n int
+		op, n, err = d.parse(data)
+		if err != nil {
+			d.Reset()
+			return ops, err
+		}
+		if n == 0 {
+			break
+		}
+		if op.Name != "" {
+			ops = append(ops, op)
+		}
+		data = data[n:]
+	}
+	if buffered {
+		d.off = len(d.buf) - len(data)
+	} else {
+		d.buf = append(d.buf[:0], data...)
+		d.off = 0
+	}
+	return ops, nil
+}
+
+// Buffered returns the number of bytes of incomplete data.
+func (d *Decoder) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Reset discards the buffered data.
+func (d *Decoder) Reset() {
+	d.buf = d.buf[:0]
+	d.off = 0
+}
+
+// parse parses the operation at the start of data. Returns the number of
+// bytes read, which is zero when the operation is incomplete.
+func (d *Decoder) parse(data []byte) (op Op, n int, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > maxControlLine {
+			return op, 0, ErrControlLine
+		}
+		return op, 0, nil
+	}
+	if i > maxControlLine {
+		return op, 0, ErrControlLine
+	}
+	n = i + 1
+	line := data[:i]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return op, n, nil
+	}
+	op.Name = string(bytes.ToUpper(fields[0]))
+	switch op.Name {
+	case "CONNECT", "INFO":
+		// the rest of the line is JSON
+		arg := bytes.TrimSpace(line[len(fields[0]):])
+		if len(arg) == 0 {
+			return op, 0, ErrBadArgs
+		}
+		op.Args = [][]byte{arg}
+		return op, n, nil
+	case "PING", "PONG", "+OK", "-ERR":
+		op.Args = fields[1:]
+		return op, n, nil
+	case "SUB", "UNSUB":
+		op.Args = fields[1:]
+		if len(op.Args) < 1 || len(op.Args) > 3 {
+			return op, 0, ErrBadArgs
+		}
+		return op, n, nil
+	case "PUB", "MSG", "HPUB", "HMSG":
+	default:
+		return op, 0, ErrUnknownOp
+	}
+	op.Args = fields[1:]
+	// PUB <subject> [reply-to] <#bytes>
+	// HPUB <subject> [reply-to] <#header bytes> <#total bytes>
+	// MSG <subject> <sid> [reply-to] <#bytes>
+	// HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>
+	min := 2
+	if op.Name[0] == 'H' {
+		min++
+	}
+	if op.Name == "MSG" || op.Name == "HMSG" {
+		min++
+	}
+	if len(op.Args) < min || len(op.Args) > min+1 {
+		return op, 0, ErrBadArgs
+	}
+	size, ok := parseSize(op.Args[len(op.Args)-1])
+	hsize := 0
+	if ok && op.Name[0] == 'H' {
+		hsize, ok = parseSize(op.Args[len(op.Args)-2])
+		ok = ok && hsize <= size
+	}
+	if !ok {
+		return op, 0, ErrBadArgs
+	}
+	max := d.MaxPayload
+	if max <= 0 {
+		max = defaultMaxPayload
+	}
+	if size > max {
+		return op, 0, ErrMaxPayload
+	}
+	if len(data)-n < size+2 {
+		return op, 0, nil
+	}
+	if data[n+size] != '\r' || data[n+size+1] != '\n' {
+		return op, 0, ErrBadPayload
+	}
+	op.Header = data[n : n+hsize : n+hsize]
+	op.Payload = data[n+hsize : n+size : n+size]
+	return op, n + size + 2, nil
+}
+
+func parseSize(b []byte) (int, bool) {
+	if len(b) == 0 || len(b) > 9 {
+		return 0, false
+	}
+	var n int
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// AppendInfo appends an INFO operation with the JSON object.
+func AppendInfo(dst []byte, json []byte) []byte {
+	dst = append(dst, "INFO "...)
+	dst = append(dst, json...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendMsg appends a MSG operation. The reply is left out when empty.
+func AppendMsg(dst []byte, subject, sid, reply string, payload []byte) []byte {
+	dst = append(dst, "MSG "...)
+	dst = append(dst, subject...)
+	dst = append(dst, ' ')
+	dst = append(dst, sid...)
+	if reply != "" {
+		dst = append(dst, ' ')
+		dst = append(dst, reply...)
+	}
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(len(payload)), 10)
+	dst = append(dst, '\r', '\n')
+	dst = append(dst, payload...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendHMsg appends an HMSG operation with the header block, which must end
+// with an empty line. The reply is left out when empty.
+func AppendHMsg(dst []byte, subject, sid, reply string, header,
+	payload []byte) []byte {
+	dst = append(dst, "HMSG "...)
+	dst = append(dst, subject...)
+	dst = append(dst, ' ')
+	dst = append(dst, sid...)
+	if reply != "" {
+		dst = append(dst, ' ')
+		dst = append(dst, reply...)
+	}
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(len(header)), 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(len(header)+len(payload)), 10)
+	dst = append(dst, '\r', '\n')
+	dst = append(dst, header...)
+	dst = append(dst, payload...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendOK appends a +OK operation.
+func AppendOK(dst []byte) []byte {
+	return append(dst, "+OK\r\n"...)
+}
+
+// AppendErr appends an -ERR operation with the message.
+func AppendErr(dst []byte, msg string) []byte {
+	dst = append(dst, "-ERR '"...)
+	dst = append(dst, msg...)
+	return append(dst, "'\r\n"...)
+}
+
+// AppendPing appends a PING operation.
+func AppendPing(dst []byte) []byte {
+	return append(dst, "PING\r\n"...)
+}
+
+// AppendPong appends a PONG operation.
+func AppendPong(dst []byte) []byte {
+	return append(dst, "PONG\r\n"...)
+}
@@ -0,0 +1,48 @@
+package nats
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	stream := "CONNECT {\"verbose\":false}\r\nsub foo.* q 1\r\n" +
+		"PUB foo.bar reply 5\r\nHELLO\r\n" +
+		"HPUB foo.bar 12 14\r\nNATS/1.0\r\n\r\nHI\r\nPING\r\n"
+	var d Decoder
+	var all []string
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		ops, err := d.Decode([]byte(stream[i:end]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range ops {
+			all = append(all, fmt.Sprintf("%s %q %q %q", op.Name, op.Args,
+				op.Header, op.Payload))
+		}
+	}
+	expect := `[CONNECT ["{\"verbose\":false}"] "" "" ` +
+		`SUB ["foo.*" "q" "1"] "" "" ` +
+		`PUB ["foo.bar" "reply" "5"] "" "HELLO" ` +
+		`HPUB ["foo.bar" "12" "14"] "NATS/1.0\r\n\r\n" "HI" ` +
+		`PING [] "" ""]`
+	if fmt.Sprint(all) != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, all)
+	}
+	if _, err := d.Decode([]byte("PUB foo 2\r\nABC\r\n")); err !=
+		ErrBadPayload {
+		t.Fatalf("expected '%v', got '%v'", ErrBadPayload, err)
+	}
+	if _, err := d.Decode([]byte("JUNK\r\n")); err != ErrUnknownOp {
+		t.Fatalf("expected '%v', got '%v'", ErrUnknownOp, err)
+	}
+	out := AppendMsg(nil, "foo.bar", "1", "", []byte("HELLO"))
+	if string(out) != "MSG foo.bar 1 5\r\nHELLO\r\n" {
+		t.Fatalf("expected '%q', got '%q'", "MSG foo.bar 1 5\r\nHELLO\r\n",
+			out)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package pgwire implements the framing of the PostgreSQL frontend/backend
+// protocol, version 3, for database proxies and servers built on evio. The
+// Decoder splits a stream into messages, including the untyped messages of
+// the startup phase, and the Append functions write messages.
+package pgwire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrMalformed is returned for a message with an invalid length.
+	ErrMalformed = errors.New("malformed message")
+	// ErrTooLarge is returned for a message over Decoder.MaxMessageSize.
+	ErrTooLarge = errors.New("message too large")
+)
+
+// Startup phase request codes.
+const (
+	ProtocolVersion3 = 196608
+	CancelRequest    = 80877102
+	SSLRequest       = 80877103
+	GSSENCRequest    = 80877104
+)
+
+const defaultMaxMessageSize = 64 * 1024 * 1024
+
+// Message is a protocol message.
+type Message struct {
+	// Type is the message type, such as 'Q' for Query. It's zero for the
+	// untyped messages of the startup phase.
+	Type byte
+	// Code is the protocol version or request code of a startup phase
+	// message, such as ProtocolVersion3 or SSLRequest.
+	Code uint32
+	// Body is the message after the length, or after the code for startup
+	// phase messages.
+	Body []byte
+	// Raw is the whole message, which proxies can forward as is.
+	Raw []byte
+}
+
+// Decoder splits a connection's stream into messages. Use one Decoder for
+// each direction of each connection.
+type Decoder struct {
+	// Frontend is true when decoding the messages that a client sends,
+	// which begin with untyped startup phase messages. The decoder switches
+	// to typed messages after a StartupMessage.
+	Frontend bool
+	// MaxMessageSize is the largest message accepted. The default is
+	// 64 MiB.
+	MaxMessageSize int
+
+	started bool   // the StartupMessage was read
+	buf     []byte // buffered data
+	off     int    // start of the unread data in buf
+}
+
+// Decode adds the in data to the stream and returns the complete messages.
+// Incomplete data is buffered until the next call. The messages are only
+// valid until the next call to Decode.
+func (d *Decoder) Decode(in []byte) (msgs []Message, err error) {
+	data := in
+	buffered := len(d.buf) > d.off
+	if buffered {
+		// move the unread data to the front
+		n := copy(d.buf, d.buf[d.off:])
+		d.buf = append(d.buf[:n], in...)
+		d.off = 0
+		data = d.buf
+	}
+	max := d.MaxMessageSize
+	if max <= 0 {
+		max = defaultMaxMessageSize
+	}
+	for {
+		startup := d.Frontend && !d.started
+		hdr := 5
+		if startup {
+			hdr = 8
+		}
+		if len(data) < hdr {
+			break
+		}
+		var size int
+		if startup {
+			size = int(binary.BigEndian.Uint32(data))
+		} else {
+			size = 1 + int(binary.BigEndian.Uint32(data[1:]))
+		}
+		if size < hdr || size-hdr > max {
+			d.Reset()
+			if size < hdr {
+				return msgs, ErrMalformed
+			}
+			return msgs, ErrTooLarge
+		}
+		if len(data) < size {
+			break
+		}
+		msg := Message{Raw: data[:size:size], Body: data[hdr:size:size]}
+		if startup {
+			msg.Code = binary.BigEndian.Uint32(data[4:])
+			if msg.Code>>16 == 3 {
+				// a StartupMessage for any 3.x minor version
+				d.started = true
+			}
+		} else {
+			msg.Type = data[0]
+		}
+		msgs = append(msgs, msg)
+		data = data[size:]
+	}
+	if buffered {
+		d.off = len(d.buf) - len(data)
+	} else {
+		d.buf = append(d.buf[:0], data...)
+		d.off = 0
+	}
+	return msgs, nil
+}
+
+// Buffered returns the number of bytes of incomplete data.
+func (d *Decoder) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Reset discards the buffered data.
+func (d *Decoder) Reset() {
+	d.buf = d.buf[:0]
+	d.off = 0
+}
+
+// ParseStartup returns the parameters of a StartupMessage body, such as
+// "user" and "database".
+func ParseStartup(body []byte) (map[string]string, error) {
+	params := make(map[string]string)
+	for len(body) > 0 && body[0] != 0 {
+		i := bytes.IndexByte(body, 0)
+		if i < 0 {
+			return nil, ErrMalformed
+		}
+		j := bytes.IndexByte(body[i+1:], 0)
+		if j < 0 {
+			return nil, ErrMalformed
+		}
+		params[string(body[:i])] = string(body[i+1 : i+1+j])
+		body = body[i+1+j+1:]
+	}
+	return params, nil
+}
+
+// AppendMessage appends a typed message with the body to dst.
+func AppendMessage(dst []byte, typ byte, body []byte) []byte {
+	dst = append(dst, typ)
+	dst = appendUint32(dst, uint32(4+len(body)))
+	return append(dst, body...)
+}
+
+// AppendStartup appends an untyped startup phase message with the code and
+// body to dst.
+func AppendStartup(dst []byte, code uint32, body []byte) []byte {
+	dst = appendUint32(dst, uint32(8+len(body)))
+	dst = appendUint32(dst, code)
+	return append(dst, body...)
+}
+
+func appendUint32(dst []byte, x uint32) []byte {
+	return append(dst, byte(x>>24), byte(x>>16), byte(x>>8), byte(x))
+}
+
+// AppendAuthenticationOk appends an AuthenticationOk message.
+func AppendAuthenticationOk(dst []byte) []byte {
+	return AppendMessage(dst, 'R', []byte{0, 0, 0, 0})
+}
+
+// AppendParameterStatus appends a ParameterStatus message.
+func AppendParameterStatus(dst []byte, name, value string) []byte {
+	body := make([]byte, 0, len(name)+len(value)+2)
+	body = append(append(body, name...), 0)
+	body = append(append(body, value...), 0)
+	return AppendMessage(dst, 'S', body)
+}
+
+// AppendReadyForQuery appends a ReadyForQuery message with the transaction
+// status, which is 'I' for idle, 'T' in a transaction, or 'E' in a failed
+// transaction.
+func AppendReadyForQuery(dst []byte, status byte) []byte {
+	return AppendMessage(dst, 'Z', []byte{status})
+}
+
+// AppendErrorResponse appends an ErrorResponse message, where severity is
+// such as "ERROR" or "FATAL" and code is the SQLSTATE code.
+func AppendErrorResponse(dst []byte, severity, code, msg string) []byte {
+	var body []byte
+	body = append(append(append(body, 'S'), severity...), 0)
+	body = append(append(append(body, 'V'), severity...), 0)
+	body = append(append(append(body, 'C'), code...), 0)
+	body = append(append(append(body, 'M'), msg...), 0)
+	return AppendMessage(dst, 'E', append(body, 0))
+}
@@ -0,0 +1,44 @@
+package pgwire
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	var stream []byte
+	stream = AppendStartup(stream, SSLRequest, nil)
+	stream = AppendStartup(stream, ProtocolVersion3,
+		[]byte("user\x00bob\x00database\x00db\x00\x00"))
+	stream = AppendMessage(stream, 'Q', []byte("SELECT 1\x00"))
+	stream = AppendMessage(stream, 'X', nil)
+	d := Decoder{Frontend: true}
+	var msgs []Message
+	for i := range stream {
+		ms, err := d.Decode(stream[i : i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range ms {
+			m.Body = append([]byte(nil), m.Body...)
+			msgs = append(msgs, m)
+		}
+	}
+	var all []string
+	for _, m := range msgs {
+		all = append(all, fmt.Sprintf("%q %d %q", m.Type, m.Code, m.Body))
+	}
+	expect := `['\x00' 80877103 "" ` +
+		`'\x00' 196608 "user\x00bob\x00database\x00db\x00\x00" ` +
+		`'Q' 0 "SELECT 1\x00" 'X' 0 ""]`
+	if fmt.Sprint(all) != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, all)
+	}
+	params, err := ParseStartup(msgs[1].Body)
+	if err != nil || params["user"] != "bob" || params["database"] != "db" {
+		t.Fatalf("unexpected params '%v' %v", params, err)
+	}
+	if _, err := d.Decode([]byte{'Q', 0, 0, 0, 1}); err != ErrMalformed {
+		t.Fatalf("expected '%v', got '%v'", ErrMalformed, err)
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package resp implements the Redis serialization protocol, RESP2 and RESP3,
+// for servers built on evio. The Decoder parses the commands that clients
+// send, and the Append functions serialize replies.
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// ErrProtocol is returned when a client sends malformed data. The
+// connection should be closed.
+var ErrProtocol = errors.New("protocol error")
+
+const (
+	maxArgs     = 1024 * 1024       // most arguments in a command
+	maxBulkSize = 512 * 1024 * 1024 // largest bulk string
+	maxLine     = 64 * 1024         // longest inline command or header
+)
+
+// Command is a parsed client command.
+type Command struct {
+	// Raw is the command as it was sent.
+	Raw []byte
+	// Args are the command arguments, with the command name first.
+	Args [][]byte
+}
+
+// Decoder parses commands from a connection's stream. Multibulk commands and
+// inline commands are supported, pipelined or split across reads. Use one
+// Decoder for each connection.
+type Decoder struct {
+	buf []byte // buffered data
+	off int    // start of the unread data in buf
+}
+
+// Decode adds the in data to the stream and returns the complete commands.
+// Incomplete data is buffered until the next call. The commands are only
+// valid until the next call to Decode. Returns ErrProtocol if the data is
+// malformed.
+func (d *Decoder) Decode(in []byte) (cmds []Command, err error) {
+	data := in
+	buffered := len(d.buf) > d.off
+	if buffered {
+		// move the unread data to the front
+		n := copy(d.buf, d.buf[d.off:])
+		d.buf = append(d.buf[:n], in...)
+		d.off = 0
+		data = d.buf
+	}
+	for len(data) > 0 {
+		var args [][]byte
+		var n int
+		if data[0] == '*' {
+			args, n, err = parseMultibulk(data)
+		} else {
+			args, n, err = parseInline(data)
+		}
+		if err != nil {
+			d.Reset()
+			return cmds, err
+		}
+		if n == 0 {
+			break
+		}
+		if len(args) > 0 {
+			cmds = append(cmds, Command{Raw: data[:n:n], Args: args})
+		}
+		data = data[n:]
+	}
+	if buffered {
+		d.off = len(d.buf) - len(data)
+	} else {
+		d.buf = append(d.buf[:0], data...)
+		d.off = 0
+	}
+	return cmds, nil
+}
+
+// Buffered returns the number of bytes of incomplete data.
+func (d *Decoder) Buffered() int {
+	return len(d.buf) - d.off
+}
+
+// Reset discards the buffered data.
+func (d *Decoder) Reset() {
+	d.buf = d.buf[:0]
+	d.off = 0
+}
+
+// readLine returns the line at the start of data without the CRLF, and the
+// number of bytes it used. Returns zero bytes if the line is incomplete.
+func readLine(data []byte) (line []byte, n int, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > maxLine {
+			return nil, 0, ErrProtocol
+		}
+		return nil, 0, nil
+	}
+	if i == 0 || data[i-1] != '\r' {
+		return nil, 0, ErrProtocol
+	}
+	return data[: i-1 : i-1], i + 1, nil
+}
+
+func parseInline(data []byte) (args [][]byte, n int, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > maxLine {
+			return nil, 0, ErrProtocol
+		}
+		return nil, 0, nil
+	}
+	line := data[:i]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	for _, arg := range bytes.Fields(line) {
+		args = append(args, arg[:len(arg):len(arg)])
+	}
+	return args, i + 1, nil
+}
+
+func parseMultibulk(data []byte) (args [][]byte, n int, err error) {
+	line, n, err := readLine(data)
+	if n == 0 {
+		return nil, 0, err
+	}
+	count, ok := parseInt(line[1:])
+	if !ok || count > maxArgs {
+		return nil, 0, ErrProtocol
+	}
+	if count > 0 {
+		args = make([][]byte, 0, count)
+	}
+	for i := 0; i < count; i++ {
+		line, m, err := readLine(data[n:])
+		if m == 0 {
+			return nil, 0, err
+		}
+		if line[0] != '$' {
+			return nil, 0, ErrProtocol
+		}
+		size, ok := parseInt(line[1:])
+		if !ok || size < 0 || size > maxBulkSize {
+			return nil, 0, ErrProtocol
+		}
+		n += m
+		if len(data)-n < size+2 {
+			return nil, 0, nil
+		}
+		if data[n+size] != '\r' || data[n+size+1] != '\n' {
+			return nil, 0, ErrProtocol
+		}
+		args = append(args, data[n:n+size:n+size])
+		n += size + 2
+	}
+	return args, n, nil
+}
+
+func parseInt(b []byte) (int, bool) {
+	if len(b) == 0 || len(b) > 10 {
+		return 0, false
+	}
+	var neg bool
+	if b[0] == '-' {
+		neg = true
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, false
+		}
+	}
+	var n int
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	if neg {
+		return -n, true
+	}
+	return n, true
+}
+
+func appendPrefix(dst []byte, c byte, n int64) []byte {
+	dst = append(dst, c)
+	dst = strconv.AppendInt(dst, n, 10)
+	return append(dst, '\r', '\n')
+}
+
+// AppendString appends a simple string, such as "OK". The string must not
+// contain CR or LF.
+func AppendString(dst []byte, s string) []byte {
+	dst = append(dst, '+')
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendError appends an error, such as "ERR unknown command". The message
+// must not contain CR or LF.
+func AppendError(dst []byte, msg string) []byte {
+	dst = append(dst, '-')
+	dst = append(dst, msg...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendInt appends an integer.
+func AppendInt(dst []byte, n int64) []byte {
+	return appendPrefix(dst, ':', n)
+}
+
+// AppendBulk appends a bulk string.
+func AppendBulk(dst []byte, b []byte) []byte {
+	dst = appendPrefix(dst, '$', int64(len(b)))
+	dst = append(dst, b...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendBulkString appends a bulk string.
+func AppendBulkString(dst []byte, s string) []byte {
+	dst = appendPrefix(dst, '$', int64(len(s)))
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendArray appends the header of an array with n elements, which must
+// be followed by the elements.
+func AppendArray(dst []byte, n int) []byte {
+	return appendPrefix(dst, '*', int64(n))
+}
+
+// AppendNull appends a RESP2 null bulk string.
+func AppendNull(dst []byte) []byte {
+	return append(dst, '$', '-', '1', '\r', '\n')
+}
+
+// The following types are RESP3 only. They should be used after the client
+// has switched protocols with the HELLO command.
+
+// AppendNull3 appends a RESP3 null.
+func AppendNull3(dst []byte) []byte {
+	return append(dst, '_', '\r', '\n')
+}
+
+// AppendBool appends a RESP3 boolean.
+func AppendBool(dst []byte, t bool) []byte {
+	if t {
+		return append(dst, '#', 't', '\r', '\n')
+	}
+	return append(dst, '#', 'f', '\r', '\n')
+}
+
+// AppendDouble appends a RESP3 double.
+func AppendDouble(dst []byte, f float64) []byte {
+	dst = append(dst, ',')
+	switch {
+	case math.IsInf(f, 1):
+		dst = append(dst, "inf"...)
+	case math.IsInf(f, -1):
+		dst = append(dst, "-inf"...)
+	case math.IsNaN(f):
+		dst = append(dst, "nan"...)
+	default:
+		dst = strconv.AppendFloat(dst, f, 'g', -1, 64)
+	}
+	return append(dst, '\r', '\n')
+}
+
+// AppendBigNumber appends a RESP3 big number. The number must be a string of
+// decimal digits with an optional minus sign.
+func AppendBigNumber(dst []byte, n string) []byte {
+	dst = append(dst, '(')
+	dst = append(dst, n...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendVerbatim appends a RESP3 verbatim string, where format is a three
+// letter type such as "txt" or "mkd".
+func AppendVerbatim(dst []byte, format string, s string) []byte {
+	dst = appendPrefix(dst, '=', int64(len(format)+1+len(s)))
+	dst = append(dst, format...)
+	dst = append(dst, ':')
+	dst = append(dst, s...)
+	return append(dst, '\r', '\n')
+}
+
+// AppendMap appends the header of a RESP3 map with n key-value pairs, which
+// must be followed by the keys and values.
+func AppendMap(dst []byte, n int) []byte {
+	return appendPrefix(dst, '%', int64(n))
+}
+
+// AppendSet appends the header of a RESP3 set with n elements.
+func AppendSet(dst []byte, n int) []byte {
+	return appendPrefix(dst, '~', int64(n))
+}
+
+// AppendPush appends the header of a RESP3 push message with n elements.
+func AppendPush(dst []byte, n int) []byte {
+	return appendPrefix(dst, '>', int64(n))
+}
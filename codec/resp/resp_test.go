@@ -0,0 +1,55 @@
+package resp
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	var d Decoder
+	var all []string
+	for _, in := range []string{
+		"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*1\r\n$4\r\nPI",
+		"NG\r\n",
+		"SET  key value\r\nQUIT\r\n\r\n*0\r\n",
+	} {
+		cmds, err := d.Decode([]byte(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cmd := range cmds {
+			all = append(all, fmt.Sprintf("%q", cmd.Args))
+		}
+	}
+	expect := `[["GET" "k"] ["PING"] ["SET" "key" "value"] ["QUIT"]]`
+	if fmt.Sprint(all) != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, all)
+	}
+	if d.Buffered() != 0 {
+		t.Fatalf("expected '%d', got '%d'", 0, d.Buffered())
+	}
+	if _, err := d.Decode([]byte("*1\r\n+OK\r\n")); err != ErrProtocol {
+		t.Fatalf("expected '%v', got '%v'", ErrProtocol, err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	var b []byte
+	b = AppendArray(b, 3)
+	b = AppendString(b, "OK")
+	b = AppendBulkString(b, "hello")
+	b = AppendInt(b, -5)
+	b = AppendError(b, "ERR bad")
+	b = AppendNull(b)
+	b = AppendMap(b, 1)
+	b = AppendBulk(b, []byte("k"))
+	b = AppendBool(b, true)
+	b = AppendDouble(b, 1.5)
+	b = AppendNull3(b)
+	b = AppendVerbatim(b, "txt", "hi")
+	expect := "*3\r\n+OK\r\n$5\r\nhello\r\n:-5\r\n-ERR bad\r\n$-1\r\n" +
+		"%1\r\n$1\r\nk\r\n#t\r\n,1.5\r\n_\r\n=6\r\ntxt:hi\r\n"
+	if string(b) != expect {
+		t.Fatalf("expected '%q', got '%q'", expect, b)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package websocket implements the server side of the WebSocket protocol,
+// RFC 6455, on top of evio connections. It handles the HTTP Upgrade
+// handshake, frame decoding and masking, fragmented messages, ping/pong,
+// and the close handshake.
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tidwall/evio-lite"
+)
+
+// Opcode is the type of a frame.
+type Opcode byte
+
+// Frame opcodes.
+const (
+	Continuation Opcode = 0x0
+	Text         Opcode = 0x1
+	Binary       Opcode = 0x2
+	Close        Opcode = 0x8
+	Ping         Opcode = 0x9
+	Pong         Opcode = 0xA
+)
+
+// Close status codes.
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseInvalidData   = 1007
+	ClosePolicy        = 1008
+	CloseTooLarge      = 1009
+)
+
+var (
+	errHandshake   = errors.New("bad handshake")
+	errProtocol    = errors.New("protocol error")
+	errTooLarge    = errors.New("message too large")
+	errInvalidUTF8 = errors.New("invalid utf-8")
+)
+
+const (
+	defaultMaxMessageSize = 16 * 1024 * 1024
+	maxHeaderSize         = 8 * 1024
+)
+
+var acceptGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+
+// Conn is the WebSocket state of an evio connection. Create one for each
+// connection, such as in the Opened event, and pass the Data event input
+// to its Data method:
+//
+//	events.Data = func(c evio.Conn, in []byte) ([]byte, evio.Action) {
+//		return c.Context().(*websocket.Conn).Data(in)
+//	}
+type Conn struct {
+	// OnUpgrade, when set, fires with the upgrade request before the
+	// handshake completes. Return false to reject the request.
+	OnUpgrade func(ws *Conn, r *http.Request) bool
+	// OnMessage fires for each complete text or binary message. The msg is
+	// only valid until the callback returns. Use WriteMessage to reply.
+	OnMessage func(ws *Conn, op Opcode, msg []byte)
+	// OnClose, when set, fires when the client sends a close frame, with
+	// the status code and reason. The code is zero when there's none.
+	OnClose func(ws *Conn, code int, reason string)
+	// MaxMessageSize is the largest message accepted, after joining the
+	// fragments. The default is 16 MiB.
+	MaxMessageSize int
+	// Request is the upgrade request, set once the handshake completes.
+	Request *http.Request
+
+	buf     []byte // unread input
+	msg     []byte // fragments of the current message
+	msgOp   Opcode // opcode of the current message, zero for none
+	out     []byte // output for the current Data call
+	closing bool   // a close frame was sent
+}
+
+// Data handles the input from the evio Data event and returns the output and
+// action for the event. The connection is closed after a close frame is
+// sent, or when the client breaks the protocol.
+func (ws *Conn) Data(in []byte) (out []byte, action evio.Action) {
+	if ws.closing {
+		return nil, evio.Close
+	}
+	ws.buf = append(ws.buf, in...)
+	ws.out = ws.out[:0]
+	n := 0
+	if ws.Request == nil {
+		var err error
+		n, err = ws.handshake()
+		if err != nil {
+			return ws.out, evio.Close
+		}
+		if n == 0 {
+			return nil, evio.None
+		}
+	}
+	for !ws.closing {
+		m, err := ws.frame(ws.buf[n:])
+		if err != nil {
+			code := CloseProtocolError
+			if err == errTooLarge {
+				code = CloseTooLarge
+			} else if err == errInvalidUTF8 {
+				code = CloseInvalidData
+			}
+			ws.WriteClose(code, "")
+			break
+		}
+		if m == 0 {
+			break
+		}
+		n += m
+	}
+	// keep the unread input for the next call
+	ws.buf = append(ws.buf[:0], ws.buf[n:]...)
+	if ws.closing {
+		return ws.out, evio.Close
+	}
+	return ws.out, evio.None
+}
+
+// WriteMessage writes a message in a single frame. It must only be called
+// from the OnMessage and OnClose callbacks. Use AppendFrame to write to the
+// connection at other times.
+func (ws *Conn) WriteMessage(op Opcode, msg []byte) {
+	if !ws.closing {
+		ws.out = AppendFrame(ws.out, op, msg)
+	}
+}
+
+// WriteClose writes a close frame with the status code and reason, and the
+// connection is closed after the frame is written. It must only be called
+// from the OnMessage and OnClose callbacks.
+func (ws *Conn) WriteClose(code int, reason string) {
+	if ws.closing {
+		return
+	}
+	ws.out = AppendClose(ws.out, code, reason)
+	ws.closing = true
+}
+
+// AppendFrame appends a final, unmasked frame with the payload to dst.
+func AppendFrame(dst []byte, op Opcode, payload []byte) []byte {
+	dst = append(dst, 0x80|byte(op))
+	switch n := len(payload); {
+	case n < 126:
+		dst = append(dst, byte(n))
+	case n <= 0xFFFF:
+		dst = append(dst, 126, byte(n>>8), byte(n))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		dst = append(append(dst, 127), b[:]...)
+	}
+	return append(dst, payload...)
+}
+
+// AppendClose appends a close frame with the status code and reason to dst.
+// A code of zero sends no status.
+func AppendClose(dst []byte, code int, reason string) []byte {
+	if code == 0 {
+		return AppendFrame(dst, Close, nil)
+	}
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return AppendFrame(dst, Close, append(payload, reason...))
+}
+
+// handshake reads the upgrade request and writes the response. Returns the
+// number of bytes read, which is zero when the request is incomplete.
+func (ws *Conn) handshake() (int, error) {
+	i := bytes.Index(ws.buf, []byte("\r\n\r\n"))
+	if i < 0 {
+		if len(ws.buf) > maxHeaderSize {
+			ws.out = append(ws.out, "HTTP/1.1 431 Request Header Fields "+
+				"Too Large\r\nConnection: close\r\n\r\n"...)
+			return 0, errHandshake
+		}
+		return 0, nil
+	}
+	n := i + 4
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(ws.buf[:n])))
+	if err != nil || r.Method != "GET" ||
+		!headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Key") == "" {
+		ws.out = append(ws.out, "HTTP/1.1 400 Bad Request\r\n"+
+			"Connection: close\r\n\r\n"...)
+		return 0, errHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		ws.out = append(ws.out, "HTTP/1.1 426 Upgrade Required\r\n"+
+			"Sec-WebSocket-Version: 13\r\nConnection: close\r\n\r\n"...)
+		return 0, errHandshake
+	}
+	if ws.OnUpgrade != nil && !ws.OnUpgrade(ws, r) {
+		ws.out = append(ws.out, "HTTP/1.1 403 Forbidden\r\n"+
+			"Connection: close\r\n\r\n"...)
+		return 0, errHandshake
+	}
+	h := sha1.New()
+	h.Write([]byte(r.Header.Get("Sec-WebSocket-Key")))
+	h.Write(acceptGUID)
+	ws.out = append(ws.out, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "...)
+	ws.out = append(ws.out,
+		base64.StdEncoding.EncodeToString(h.Sum(nil))...)
+	ws.out = append(ws.out, "\r\n\r\n"...)
+	ws.Request = r
+	return n, nil
+}
+
+// headerHas returns true if the comma-separated header contains the token.
+func headerHas(h http.Header, key, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// frame handles the frame at the start of data. Returns the number of bytes
+// read, which is zero when the frame is incomplete.
+func (ws *Conn) frame(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+	fin := data[0]&0x80 != 0
+	op := Opcode(data[0] & 0x0F)
+	if data[0]&0x70 != 0 || data[1]&0x80 == 0 {
+		// extensions aren't supported, and clients must mask
+		return 0, errProtocol
+	}
+	size := uint64(data[1] & 0x7F)
+	n := 2
+	switch size {
+	case 126:
+		if len(data) < 4 {
+			return 0, nil
+		}
+		size = uint64(binary.BigEndian.Uint16(data[2:]))
+		n = 4
+	case 127:
+		if len(data) < 10 {
+			return 0, nil
+		}
+		size = binary.BigEndian.Uint64(data[2:])
+		n = 10
+	}
+	max := ws.MaxMessageSize
+	if max <= 0 {
+		max = defaultMaxMessageSize
+	}
+	if size > uint64(max) || uint64(len(ws.msg))+size > uint64(max) {
+		return 0, errTooLarge
+	}
+	if len(data) < n+4+int(size) {
+		return 0, nil
+	}
+	mask := data[n : n+4]
+	payload := data[n+4 : n+4+int(size)]
+	for i := range payload {
+		payload[i] ^= mask[i&3]
+	}
+	n += 4 + int(size)
+	switch op {
+	case Ping, Pong, Close:
+		if !fin || size > 125 {
+			return 0, errProtocol
+		}
+		return n, ws.control(op, payload)
+	case Text, Binary:
+		if ws.msgOp != 0 {
+			return 0, errProtocol
+		}
+		if fin {
+			return n, ws.message(op, payload)
+		}
+		ws.msgOp = op
+		ws.msg = append(ws.msg[:0], payload...)
+	case Continuation:
+		if ws.msgOp == 0 {
+			return 0, errProtocol
+		}
+		ws.msg = append(ws.msg, payload...)
+		if fin {
+			op := ws.msgOp
+			ws.msgOp = 0
+			return n, ws.message(op, ws.msg)
+		}
+	default:
+		return 0, errProtocol
+	}
+	return n, nil
+}
+
+func (ws *Conn) message(op Opcode, msg []byte) error {
+	if op == Text && !utf8.Valid(msg) {
+		return errInvalidUTF8
+	}
+	if ws.OnMessage != nil {
+		ws.OnMessage(ws, op, msg)
+	}
+	return nil
+}
+
+func (ws *Conn) control(op Opcode, payload []byte) error {
+	switch op {
+	case Ping:
+		ws.WriteMessage(Pong, payload)
+	case Close:
+		var code int
+		var reason string
+		if len(payload) == 1 {
+			return errProtocol
+		}
+		if len(payload) >= 2 {
+			code = int(binary.BigEndian.Uint16(payload))
+			reason = string(payload[2:])
+			if !utf8.ValidString(reason) {
+				return errInvalidUTF8
+			}
+		}
+		if ws.OnClose != nil {
+			ws.OnClose(ws, code, reason)
+		}
+		// echo the status code to complete the close handshake
+		ws.WriteClose(code, "")
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package websocket
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/tidwall/evio-lite"
+)
+
+func maskedFrame(b0 byte, payload string) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{b0, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i&3])
+	}
+	return frame
+}
+
+func TestWebSocket(t *testing.T) {
+	addr := ":10012"
+	var events evio.Events
+	res := make(chan []byte, 1)
+	events.Serving = func(s evio.Server) (action evio.Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			c.Write([]byte("GET /chat HTTP/1.1\r\nHost: localhost\r\n" +
+				"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+				"Sec-WebSocket-Version: 13\r\n\r\n"))
+			var req []byte
+			req = append(req, maskedFrame(0x01, "HEL")...)
+			req = append(req, maskedFrame(0x89, "P")...)
+			req = append(req, maskedFrame(0x80, "LO")...)
+			req = append(req, maskedFrame(0x88, "\x03\xe8")...)
+			c.Write(req)
+			data, _ := ioutil.ReadAll(c)
+			res <- data
+		}()
+		return
+	}
+	events.Opened = func(c evio.Conn) (out []byte, action evio.Action) {
+		c.SetContext(&Conn{
+			OnMessage: func(ws *Conn, op Opcode, msg []byte) {
+				ws.WriteMessage(op, msg)
+			},
+		})
+		return
+	}
+	events.Data = func(c evio.Conn, in []byte) (out []byte,
+		action evio.Action) {
+		return c.Context().(*Conn).Data(in)
+	}
+	events.Closed = func(c evio.Conn, err error) (action evio.Action) {
+		return evio.Shutdown
+	}
+	if err := evio.Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	data := <-res
+	i := bytes.Index(data, []byte("\r\n\r\n"))
+	if i < 0 {
+		t.Fatalf("expected a handshake response, got '%q'", data)
+	}
+	head, frames := string(data[:i+4]), data[i+4:]
+	if !bytes.Contains([]byte(head),
+		[]byte("Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")) {
+		t.Fatalf("expected accept header, got '%s'", head)
+	}
+	expect := "\x8a\x01P\x81\x05HELLO\x88\x02\x03\xe8"
+	if string(frames) != expect {
+		t.Fatalf("expected '%q', got '%q'", expect, frames)
+	}
+}
@@ -5,11 +5,26 @@
 package evio
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 // Action that occurs after the completion of an event.
@@ -18,17 +33,388 @@ type Action int
 const (
 	// None indicates that no action should occur following an event.
 	None Action = iota
-	// Close the connection.
+	// Detach the connection from the event loop once its pending output
+	// has been written, and pass it to the Detached event.
+	Detach
+	// Close the connection once its pending output has been written.
 	Close
 	// Shutdown the server.
 	Shutdown
 )
 
+var (
+	// ErrHighWater is the error of a connection that was closed because its
+	// buffered output grew past Events.WriteHighWater.
+	ErrHighWater = errors.New("write high-water mark exceeded")
+	// ErrWriteBufferFull is the error of a connection that was closed
+	// because a write would have grown its buffered output past
+	// Events.MaxWriteBuffer, and of a WriteNoCopy that was dropped.
+	ErrWriteBufferFull = errors.New("write buffer is full")
+	// ErrReadLimitExceeded is the error of a connection that was closed
+	// because it sent more than the limit of Conn.LimitReadBytes.
+	ErrReadLimitExceeded = errors.New("read limit exceeded")
+	// ErrShutdown is returned by the Server methods that can't be used once
+	// the server is shutting down.
+	ErrShutdown = errors.New("server is shutting down")
+	// ErrListenerClosed is returned for the index of a listener that was
+	// removed or never existed.
+	ErrListenerClosed = errors.New("listener is closed")
+	// ErrUnsupportedAddress is returned for an address with an unknown
+	// network scheme or option, or a socket that can't be served.
+	ErrUnsupportedAddress = errors.New("unsupported address")
+	// ErrConnClosed is returned for a connection that has closed.
+	ErrConnClosed = errors.New("connection is closed")
+	// ErrPanic is the error of a connection that was closed because one of
+	// its events panicked, see Events.Panic.
+	ErrPanic = errors.New("panic")
+)
+
+// ListenError is the error of an address that the server failed to listen
+// on. The address is formatted as it was passed to Serve.
+type ListenError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ListenError) Error() string {
+	return e.Addr + ": " + e.Err.Error()
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
 // Server ...
 type Server struct {
 	// The addrs parameter is an array of listening addresses that align
 	// with the addr strings passed to the Serve function.
 	Addrs []net.Addr
+
+	loop *loop
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections, closes each open connection once its pending output has
+// been written, and returns when the server has stopped. If ctx is done
+// before then, the remaining connections are closed immediately and the
+// ctx error is returned.
+//
+// Shutdown is safe to call from any goroutine, but it must not be called
+// from an event because it waits on the event loop.
+func (s Server) Shutdown(ctx context.Context) error {
+	if !s.loop.execute(s.loop.drain) {
+		return nil
+	}
+	select {
+	case <-s.loop.done:
+		return nil
+	case <-ctx.Done():
+		s.loop.execute(func() { s.loop.shutdown = true })
+		<-s.loop.done
+		return ctx.Err()
+	}
+}
+
+// Stop shuts down the server immediately, closing the open connections
+// without writing their pending output, and returns when the server has
+// stopped. It's safe to call from any goroutine, but it must not be called
+// from an event.
+func (s Server) Stop() {
+	if s.loop.execute(func() { s.loop.shutdown = true }) {
+		<-s.loop.done
+	}
+}
+
+// Wait waits for the server to stop and returns the error that stopped it,
+// which is what Serve would have returned. It's for a server that was
+// started with Start.
+func (s Server) Wait() error {
+	<-s.loop.done
+	return s.loop.err
+}
+
+// NumConns returns the number of open connections. It's safe to call from
+// any goroutine.
+func (s Server) NumConns() int {
+	return int(atomic.LoadInt32(&s.loop.nconns))
+}
+
+// Metrics returns the counters of the server. It's safe to call from any
+// goroutine.
+func (s Server) Metrics() Metrics {
+	m := &s.loop.metrics
+	return Metrics{
+		Accepted:     atomic.LoadInt64(&m.accepted),
+		Closed:       atomic.LoadInt64(&m.closed),
+		Open:         int64(atomic.LoadInt32(&s.loop.nconns)),
+		BytesRead:    atomic.LoadInt64(&m.bytesRead),
+		BytesWritten: atomic.LoadInt64(&m.bytesWritten),
+		Iterations:   atomic.LoadInt64(&m.iterations),
+		WaitTime:     time.Duration(atomic.LoadInt64(&m.waitTime)),
+		BusyTime:     time.Duration(atomic.LoadInt64(&m.busyTime)),
+		Writing:      atomic.LoadInt64(&m.writing),
+		Queued:       atomic.LoadInt64(&m.queued),
+	}
+}
+
+// LoopID returns the id of the event loop of the server, which is unique in
+// the process. The goroutines of the loop have it as their "evio_loop" pprof
+// label, along with the listener addresses as their "evio_addrs" label, so
+// that the CPU profile of each loop can be told apart. The DataAsync
+// workers also have their number as their "evio_worker" label. It's safe
+// to call from any goroutine.
+func (s Server) LoopID() uint64 {
+	return s.loop.id
+}
+
+// GoroutineID returns the id of the goroutine that runs the event loop, as
+// it appears in stack dumps and execution traces.
+func (s Server) GoroutineID() int64 {
+	return s.loop.goid
+}
+
+// ForEachConn calls fn for each open connection, until fn returns false.
+// The connections are those that were open when ForEachConn was called, and
+// fn may close them or open new ones. It must be called from an event.
+func (s Server) ForEachConn(fn func(c Conn) bool) {
+	l := s.loop
+	conns := make([]*conn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		if c.poll != nil && !fn(c) {
+			return
+		}
+	}
+}
+
+// Broadcast writes data to each open connection. The connections share a
+// single copy of data, which they queue the same as Conn.Writev. It must be
+// called from an event.
+func (s Server) Broadcast(data []byte) {
+	s.BroadcastFunc(data, nil)
+}
+
+// BroadcastFunc is the same as Broadcast, but only writes data to the
+// connections for which fn returns true.
+func (s Server) BroadcastFunc(data []byte, fn func(c Conn) bool) {
+	if len(data) == 0 {
+		return
+	}
+	l := s.loop
+	bufs := [][]byte{append([]byte(nil), data...)}
+	for _, c := range l.conns {
+		if fn == nil || fn(c) {
+			c.Writev(bufs)
+			l.highWater(c)
+		}
+	}
+}
+
+// Publish writes data to each connection in the named group, sharing a
+// single copy of data the same as Broadcast. It must be called from an
+// event.
+func (s Server) Publish(group string, data []byte) {
+	l := s.loop
+	if len(data) == 0 || len(l.groups[group]) == 0 {
+		return
+	}
+	bufs := [][]byte{append([]byte(nil), data...)}
+	for c := range l.groups[group] {
+		c.Writev(bufs)
+		l.highWater(c)
+	}
+}
+
+// AddListener starts listening on addr, which is formatted the same as the
+// addresses passed to Serve. Returns the index of the listener, which is the
+// AddrIndex of its connections. It must be called from an event.
+func (s Server) AddListener(addr string) (int, error) {
+	l := s.loop
+	if l.draining {
+		return 0, ErrShutdown
+	}
+	ln, err := listen(addr, l.events.Control)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.register(ln); err != nil {
+		ln.close()
+		return 0, err
+	}
+	l.lns = append(l.lns, ln)
+	return len(l.lns) - 1, nil
+}
+
+// RemoveListener stops listening on the listener at index. The indexes of
+// the other listeners don't change, and the connections that it accepted
+// stay open. It must be called from an event.
+func (s Server) RemoveListener(index int) error {
+	l := s.loop
+	if index < 0 || index >= len(l.lns) || l.lns[index] == nil {
+		return fmt.Errorf("%w: index %d", ErrListenerClosed, index)
+	}
+	// closing the socket also removes it from the poll
+	l.lns[index].close()
+	l.lns[index] = nil
+	return nil
+}
+
+// SetEvents sets the connection events of the listener at index, in place
+// of the events passed to Serve, so that each address may have its own
+// logic. Only the Opened, Closed, Detached, Data, DataAsync, Input,
+// NewCodec, Written, Writable, HighWater, IdleTimeout, WriteHighWater,
+// MaxWriteBuffer and WriteBufferFull fields are used, the others stay those
+// of the server. The connections that the listener already accepted keep
+// their events. It must be called from an event.
+func (s Server) SetEvents(index int, events Events) error {
+	l := s.loop
+	if index < 0 || index >= len(l.lns) || l.lns[index] == nil {
+		return fmt.Errorf("%w: index %d", ErrListenerClosed, index)
+	}
+	if events.DataAsync != nil && l.work == nil {
+		l.startWorkers()
+	}
+	l.lns[index].events = &events
+	return nil
+}
+
+// Attach adds an already connected stream socket to the server, such as
+// fd 0 from inetd or one end of a socketpair, and fires the Opened event
+// for it. The server takes ownership of the fd. The AddrIndex of the
+// connection is -1. It must be called from an event.
+func (s Server) Attach(fd int) (Conn, error) {
+	l := s.loop
+	sa, err := syscall.Getpeername(fd)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		return nil, err
+	}
+	if err := l.poll.addRead(fd); err != nil {
+		return nil, err
+	}
+	c := &conn{fd: fd, sa: sa, poll: l.poll, saddr: -1, loop: l,
+		events: &l.events}
+	if lsa, err := syscall.Getsockname(fd); err == nil {
+		c.laddr = sockaddrAddr(false, lsa)
+	}
+	l.open(c)
+	return c, nil
+}
+
+// Upgrade starts cmd, usually a new build of the program, with the
+// listeners of the server, and then shuts down the server gracefully. The
+// listeners are passed after cmd.ExtraFiles, starting at fd 3 when there
+// are no other files, in the order of Server.Addrs and skipping removed
+// listeners. The new process serves them with fd:// addresses. Connections
+// that are waiting to be accepted are not dropped, because both processes
+// share the sockets.
+//
+// Upgrade must be called from an event.
+func (s Server) Upgrade(cmd *exec.Cmd) error {
+	l := s.loop
+	if l.draining {
+		return ErrShutdown
+	}
+	n := len(cmd.ExtraFiles)
+	for _, ln := range l.lns {
+		if ln == nil {
+			continue
+		}
+		if ul, ok := ln.ln.(*net.UnixListener); ok {
+			// the socket file stays for the new process
+			ul.SetUnlinkOnClose(false)
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, ln.f)
+	}
+	err := cmd.Start()
+	cmd.ExtraFiles = cmd.ExtraFiles[:n]
+	if err != nil {
+		return err
+	}
+	// drain as a job, so that the loop wakes even if it has no events
+	l.execute(l.drain)
+	return nil
+}
+
+// Pipe wires two connections of the same server together. From then on the
+// data read from either connection is written to the other, and no Data
+// events fire for them. On Linux the data is moved with splice(2) without
+// being copied to user space. When either connection closes, the other is
+// closed once its pending output has been written.
+//
+// Pipe must be called from an event.
+func Pipe(c1, c2 Conn) error {
+	a, ok1 := c1.(*conn)
+	b, ok2 := c2.(*conn)
+	if !ok1 || !ok2 || a == b || a.loop != b.loop || a.udp || b.udp {
+		return errors.New("pipe requires two stream connections of the " +
+			"same server")
+	}
+	if a.poll == nil || b.poll == nil {
+		return ErrConnClosed
+	}
+	if a.peer != nil || b.peer != nil {
+		return errors.New("pipe connection is already piped")
+	}
+	a.peer, b.peer = b, a
+	for _, c := range []*conn{a, b} {
+		if p, err := newPipe(); err == nil {
+			c.pipe, c.splice = p, true
+		}
+	}
+	return nil
+}
+
+// Execute queues fn to run on the loop goroutine, where it may use the
+// connections of the server the same as in an event. It's safe to call from
+// any goroutine. Returns false if the server has stopped.
+func (s Server) Execute(fn func()) bool {
+	return s.loop.execute(fn)
+}
+
+// AfterFunc calls fn on the loop goroutine after the duration. It must be
+// called from an event.
+func (s Server) AfterFunc(d time.Duration, fn func()) *Timer {
+	return newTimer(s.loop, nil, d, fn)
+}
+
+// Ticker calls fn on the loop goroutine every interval, in addition to the
+// Tick event. A ticker with the same name is replaced, and an interval of
+// zero or less removes it. Return Shutdown from fn to shut down the server.
+// It must be called from an event.
+func (s Server) Ticker(name string, interval time.Duration,
+	fn func(now time.Time) (action Action)) {
+	l := s.loop
+	if t := l.tickers[name]; t != nil {
+		l.timers.stop(t)
+		delete(l.tickers, name)
+	}
+	if interval <= 0 {
+		return
+	}
+	t := &timer{index: -1}
+	t.fn = func(now time.Time) {
+		// scheduled before calling fn, which may remove or replace the
+		// ticker, or panic
+		next := t.when.Add(interval)
+		if next.Before(now) {
+			// fell behind, skip the missed ticks
+			next = now.Add(interval)
+		}
+		l.timers.schedule(t, next)
+		if fn(now) == Shutdown {
+			l.shutdown = true
+		}
+	}
+	if l.tickers == nil {
+		l.tickers = make(map[string]*timer)
+	}
+	l.tickers[name] = t
+	l.timers.schedule(t, l.clockNow().Add(interval))
 }
 
 // Conn ...
@@ -37,7 +423,15 @@ type Conn interface {
 	Context() interface{}
 	// SetContext sets a user-defined context.
 	SetContext(interface{})
-	// AddrIndex is the index of server addr that was passed to the Serve call.
+	// ID is a number that identifies the connection for the life of the
+	// server, unlike its fd, which the system reuses. The IDs start at 1
+	// and increase with each opened connection. The ID of a datagram conn
+	// is 0.
+	ID() uint64
+	// Stats returns the traffic counters of the connection.
+	Stats() ConnStats
+	// AddrIndex is the index of server addr that was passed to the Serve call,
+	// or -1 for a connection added by Server.Attach.
 	AddrIndex() int
 	// LocalAddr is the connection's local socket address.
 	LocalAddr() net.Addr
@@ -45,8 +439,215 @@ type Conn interface {
 	RemoteAddr() net.Addr
 	// Write data to connection.
 	Write(data []byte)
-	// Close the connection.
+	// Writev queues the buffers to be written to the connection, in order,
+	// without copying them. The buffers are flushed with a single writev
+	// call and must not be modified until they have been written.
+	Writev(bufs [][]byte)
+	// WriteNoCopy queues data to be written without copying it, the same
+	// as Writev, and calls done on the loop goroutine once all of it has
+	// been written. The data must not be modified until then. When the
+	// connection closes first, done is called with ErrConnClosed, or with
+	// the write error. A nil done is allowed. With a codec, the data is
+	// encoded, which copies it.
+	WriteNoCopy(data []byte, done func(err error))
+	// WriteVarInt writes v to the connection as a LEB128 varint.
+	WriteVarInt(v uint64)
+	// WriteVarInt32 writes v to the connection as a LEB128 varint.
+	WriteVarInt32(v uint32)
+	// Close closes the connection once its pending output has been
+	// written.
 	Close()
+	// CloseImmediately closes the connection without writing its pending
+	// output, once the current batch of events has been handled, such as
+	// for an abusive client. When reset is true the connection is reset,
+	// the same as SetLinger(0), instead of sending a FIN.
+	CloseImmediately(reset bool)
+	// Stream starts firing the Writable event for the connection, which
+	// pulls its output part by part, as the socket takes it. It stops once
+	// Writable returns more as false.
+	Stream()
+	// CloseWrite shuts down the writing side of a stream connection, which
+	// sends a FIN to the client, once the pending output has been written,
+	// including the out of the current event. Data keeps firing until the
+	// client closes its side. Writes after CloseWrite are dropped.
+	CloseWrite()
+	// Hijack takes a stream connection off the event loop and returns it
+	// as a net.Conn, for a goroutine that uses blocking reads and writes,
+	// such as for a CONNECT tunnel. The buffered bytes are the input that
+	// was read but not consumed, see Buffered, which comes before the data
+	// read from nc. No more events fire for the connection, not even
+	// Closed, and the out of the current event is dropped. The nc must be
+	// closed by the caller. Hijack fails if the connection has output
+	// waiting to be written, which the Detach action waits for instead.
+	Hijack() (nc net.Conn, buffered []byte, err error)
+	// AsyncWrite writes data to the connection from outside of an event.
+	// The data is copied and written by the event loop. It's safe to call
+	// from any goroutine.
+	AsyncWrite(data []byte)
+	// AsyncClose closes the connection from outside of an event. It's
+	// safe to call from any goroutine.
+	AsyncClose()
+	// AfterFunc calls fn on the loop goroutine after the duration, unless
+	// the connection has closed by then.
+	AfterFunc(d time.Duration, fn func()) *Timer
+	// BufferedWrite returns the number of bytes of output that are waiting
+	// to be written to the connection.
+	BufferedWrite() int
+	// PauseRead stops reading from the connection until ResumeRead is
+	// called. Unread data stays in the socket buffer, so the sender is
+	// slowed down by TCP flow control. Pending output is still written.
+	PauseRead()
+	// ResumeRead restarts reading from a paused connection.
+	ResumeRead()
+	// SetIdleTimeout closes the connection when it has not read or
+	// written any data for the duration. Zero or less means no timeout.
+	SetIdleTimeout(d time.Duration)
+	// LimitReadBytes closes the connection with ErrReadLimitExceeded once
+	// more than n bytes in total have been read from it. Data that exceeds
+	// the limit is not passed to the Data event. Zero or less means no
+	// limit.
+	LimitReadBytes(n int64)
+	// SetSOBindToDevice binds the connection to the network interface
+	// ifname using SO_BINDTODEVICE. This is only supported on Linux and
+	// requires the CAP_NET_RAW capability.
+	SetSOBindToDevice(ifname string) error
+	// SetNoDelay controls whether the operating system delays small writes
+	// to coalesce them into fewer packets (Nagle's algorithm). When true,
+	// the data is sent as soon as possible. For TCP connections only.
+	SetNoDelay(noDelay bool) error
+	// SetQuickAck controls whether the connection acknowledges received
+	// data right away instead of delaying the ACK, using TCP_QUICKACK. The
+	// kernel may turn it off again, so set it in each Data event where it
+	// matters. This is only supported on Linux.
+	SetQuickAck(quickAck bool) error
+	// SetBuffers sets the sizes of the socket's receive and send buffers,
+	// using SO_RCVBUF and SO_SNDBUF. A size of zero or less is left
+	// unchanged. The system may adjust the sizes, such as Linux doubling
+	// them.
+	SetBuffers(rcv, snd int) error
+	// SetLinger sets how closing the connection behaves, using SO_LINGER.
+	// When sec is negative, the default, the close returns right away and
+	// the system sends the unsent data in the background. When sec is
+	// zero, the unsent data is discarded and the connection is reset,
+	// such as for an abusive client. Otherwise the close blocks the loop
+	// for up to sec seconds while the data is sent.
+	SetLinger(sec int) error
+	// OriginalDst returns the address that the client connected to before
+	// the connection was redirected to the server. On Linux it's taken
+	// from SO_ORIGINAL_DST for connections redirected by NAT, such as a
+	// REDIRECT rule. Otherwise it's the local address of the socket, which
+	// is the original destination for a transparent listener.
+	OriginalDst() (net.Addr, error)
+	// SetTOS sets the DSCP and ECN bits of the IP header of the packets
+	// that the connection sends, using IP_TOS or IPV6_TCLASS.
+	SetTOS(tos int) error
+	// SetPriority sets the SO_PRIORITY of the connection, which orders its
+	// packets in the queues of the host. This is only supported on Linux.
+	SetPriority(prio int) error
+	// TCPInfo returns the transport state of a TCP connection, such as its
+	// round-trip time and congestion window. It uses TCP_INFO on Linux and
+	// FreeBSD, and TCP_CONNECTION_INFO on macOS. It's not supported on
+	// linux/386.
+	TCPInfo() (TCPInfo, error)
+	// EnableTrace sends every read, write, poll change, and callback that
+	// occurs on the connection to sink. The event is one of "read",
+	// "write", "poll", "idle", "highwater", "opened", "data", or "closed".
+	// For "read" and "write" the data is the number of bytes, for "poll"
+	// it's the new poll mode, for "idle" it's the idle timeout that
+	// expired, and for callbacks it's the returned Action.
+	EnableTrace(sink func(event string, data interface{}))
+	// DisableTrace stops tracing the connection.
+	DisableTrace()
+	// Join adds the connection to the named group, such as a chat room, for
+	// Server.Publish. It leaves its groups when it closes.
+	Join(group string)
+	// Leave removes the connection from the named group.
+	Leave(group string)
+	// Peek returns the next n bytes of the buffered input without consuming
+	// them, or all of it when less is buffered or n is negative. The
+	// buffered input is the in of the current Input event, less what was
+	// discarded, or the input that the last Input kept. The bytes are not
+	// copied, so they're only valid until the event returns.
+	Peek(n int) []byte
+	// Discard consumes the next n bytes of the buffered input, and returns
+	// the number of bytes it consumed. In an Input event, the n return
+	// value counts the bytes consumed after the discarded ones.
+	Discard(n int) int
+	// Buffered returns the number of bytes of buffered input.
+	Buffered() int
+	// Retain returns a copy of in, the input of a Data or Input event, which
+	// may be kept after the event returns.
+	Retain(in []byte) []byte
+	// SetCodec sets the codec of a stream connection, or removes it when
+	// nil. With a codec, the input is decoded into frames, which are passed
+	// to the Data event one at a time instead of the input, and the data
+	// written by Write, Writev and the out of the events are encoded as
+	// frames. DataAsync and Input aren't used. A connection that sends data
+	// that fails to decode is closed with the error.
+	SetCodec(codec Codec)
+}
+
+// Codec frames the data of a connection, such as codec.Delimiter. A codec
+// keeps the state of a single connection, so each connection must have its
+// own.
+type Codec interface {
+	// Decode adds the in data to the stream and returns the complete
+	// frames. Incomplete data is buffered until the next call, and the
+	// frames are only valid until then.
+	Decode(in []byte) (frames [][]byte, err error)
+	// Encode appends the frame, framed, to dst.
+	Encode(dst, frame []byte) []byte
+}
+
+// ConnStats are the traffic counters of a connection. The time since
+// Opened is how long the connection has been open.
+type ConnStats struct {
+	BytesRead    int64     // bytes read from the connection
+	BytesWritten int64     // bytes written to the connection
+	Reads        int64     // reads that returned data
+	Writes       int64     // writes that wrote data
+	Opened       time.Time // when the connection was opened
+	LastActive   time.Time // last read or write, to the loop iteration
+}
+
+// TCPInfo is the transport state of a TCP connection, see Conn.TCPInfo.
+type TCPInfo struct {
+	RTT         time.Duration // smoothed round-trip time
+	RTTVar      time.Duration // round-trip time variance
+	RTO         time.Duration // retransmission timeout
+	MSS         uint32        // maximum segment size for sending
+	Cwnd        uint32        // congestion window in bytes
+	Retransmits uint32        // retransmitted segments in total
+	PacingRate  uint64        // bytes per second, zero when not paced
+}
+
+// Metrics are the counters of a server, see Server.Metrics. The metrics
+// package exports them to expvar and Prometheus.
+type Metrics struct {
+	Accepted     int64         // connections opened
+	Closed       int64         // connections closed
+	Open         int64         // connections open now
+	BytesRead    int64         // bytes read from connections and datagrams
+	BytesWritten int64         // bytes written to connections and datagrams
+	Iterations   int64         // wakeups of the loop
+	WaitTime     time.Duration // time the loop spent waiting for events
+	BusyTime     time.Duration // time the loop spent handling events
+	Writing      int64         // connections waiting to write their output
+	Queued       int64         // bytes of output waiting to be written
+}
+
+// metrics are the counters of Server.Metrics, which the loop updates
+// atomically.
+type metrics struct {
+	accepted     int64
+	closed       int64
+	bytesRead    int64
+	bytesWritten int64
+	iterations   int64
+	waitTime     int64
+	busyTime     int64
+	writing      int64
+	queued       int64
 }
 
 // Events ...
@@ -60,25 +661,292 @@ type Events struct {
 	// Use the out return value to write data to the connection.
 	Opened func(c Conn) (out []byte, action Action)
 	// Closed fires when a connection has closed.
-	// The err parameter is the last known connection error.
-	Closed func(c Conn) (action Action)
+	// The err parameter is the reason it closed: io.EOF when the client
+	// closed it, a *net.OpError when a read or write failed, ErrHighWater,
+	// ErrWriteBufferFull or ErrPanic, or nil when the server closed it, such
+	// as with a Close action or an idle timeout.
+	Closed func(c Conn, err error) (action Action)
 	// PreWrite fires just before any data is written to any client socket.
 	PreWrite func()
+	// Written fires after output was written to a connection, with the
+	// number of bytes that the socket took, which may be less than what
+	// is buffered. Use it to produce more output as the client reads it,
+	// such as when streaming a large file, instead of buffering all of it.
+	// BufferedWrite is what remains to be written.
+	Written func(c Conn, n int) (action Action)
+	// Writable fires for a connection that called Conn.Stream, each time
+	// its output has been written and the socket may take more, to get the
+	// next part of a response that is too big to buffer. Return more as
+	// false once the response is complete.
+	Writable func(c Conn) (out []byte, more bool)
+	// Detached fires when a connection has been detached using the Detach
+	// return action. The nc parameter is a net.Conn for the connection,
+	// which is no longer handled by the event loop. The nc must be closed
+	// by the caller.
+	Detached func(c Conn, nc net.Conn) (action Action)
 	// Data fires when a connection sends the server data.
-	// The in parameter is the incoming data.
+	// The in parameter is the incoming data. It's the read buffer of the
+	// loop, which is reused by the next event, so use Conn.Retain to keep
+	// it after Data returns, or set CopyInput.
 	// Use the out return value to write data to the connection.
 	Data func(c Conn, in []byte) (out []byte, action Action)
+	// DataAsync, when set, is used instead of Data and fires on a worker
+	// goroutine, for handlers that block or use a lot of CPU. The in data is
+	// a copy, and reading from the connection is paused until DataAsync
+	// returns, so the output of a connection stays in order. The out and
+	// action are applied on the loop goroutine. The Conn must only be used
+	// to read its context and addresses from the worker.
+	DataAsync func(c Conn, in []byte) (out []byte, action Action)
+	// Input, when set, is used instead of Data for stream connections, for
+	// protocols whose messages may be split across reads. The in parameter
+	// is the input that the last Input left unconsumed, followed by the new
+	// data. The n return value is the number of bytes of in that were
+	// consumed, and the rest is kept by the loop and passed to the next
+	// Input. The kept input has no limit, so close a connection that sends
+	// a message that is too big. It's dropped when the connection is
+	// detached.
+	Input func(c Conn, in []byte) (n int, out []byte, action Action)
+	// NewCodec, when set, returns the codec of each new stream connection,
+	// which is set before the Opened event, the same as Conn.SetCodec.
+	NewCodec func() Codec
+	// CopyInput passes a copy of the input to the Data and Input events,
+	// which they may keep, such as for handing it to another goroutine. It
+	// costs an allocation for each event.
+	CopyInput bool
+	// Workers is the number of goroutines for DataAsync. The default is the
+	// number of CPUs.
+	Workers int
 	// Tick fires immediately after the server starts and will fire again
 	// following the duration specified by the delay return value.
 	Tick func(now time.Time) (delay time.Duration, action Action)
+	// Clock is the time of Tick, the timers and the idle timeouts, which is
+	// the system time when nil. A ManualClock lets tests move the time of
+	// the server forward without sleeping.
+	Clock Clock
+	// Signals are the signals that the server handles, such as
+	// syscall.SIGINT and syscall.SIGTERM. By default the first signal shuts
+	// down the server gracefully, the same as Server.Shutdown, and another
+	// signal shuts it down immediately.
+	Signals []os.Signal
+	// Signal fires on the loop goroutine when the process receives one of
+	// the Signals. Return Shutdown to shut down the server as above, or
+	// None to ignore the signal.
+	Signal func(sig os.Signal) (action Action)
+	// EdgeTriggered uses edge-triggered polling. The loop reads from a
+	// connection until the socket is drained, which may fire Data multiple
+	// times for a single poll event, and saves poll calls under load.
+	EdgeTriggered bool
+	// NoDelay disables Nagle's algorithm for accepted TCP connections, so
+	// small writes are sent without waiting to be coalesced. It can be
+	// changed for a single connection with Conn.SetNoDelay.
+	NoDelay bool
+	// KeepAlive is how long an accepted TCP connection may be idle before
+	// keep-alive probes are sent. The default is 300 seconds, and a
+	// negative duration turns keep-alive off. OpenBSD only supports
+	// turning it on, with the timings of the system.
+	KeepAlive time.Duration
+	// KeepAliveInterval is the time between keep-alive probes. The default
+	// is KeepAlive.
+	KeepAliveInterval time.Duration
+	// KeepAliveCount is the number of unanswered probes after which the
+	// connection is dropped. The default is the system's.
+	KeepAliveCount int
+	// UserTimeout, when positive, is how long data sent on a TCP connection
+	// may remain unacknowledged before the kernel drops the connection,
+	// using TCP_USER_TIMEOUT. This is only supported on Linux, and Serve
+	// fails on other systems.
+	UserTimeout time.Duration
+	// BusyPoll, when positive, is how long a read on an empty socket
+	// busy-polls the network device for packets before waiting for an
+	// interrupt, using SO_BUSY_POLL. It trades CPU for lower latency. It's
+	// set on each accepted inet connection and on the datagram listeners.
+	// Values over the net.core.busy_read sysctl require CAP_NET_ADMIN. This
+	// is only supported on Linux, and Serve fails on other systems.
+	BusyPoll time.Duration
+	// Spin polls for events without ever sleeping, which keeps a CPU core
+	// busy and saves the wakeup latency of the loop.
+	Spin bool
+	// AcceptError fires when the server fails to accept a connection, or
+	// to set up an accepted one, such as applying its socket options. The
+	// error is a *net.OpError with the address of the listener, which wraps
+	// an *os.SyscallError. When the process or the system is out
+	// of file descriptors (EMFILE or ENFILE), the server closes one pending
+	// connection and stops accepting for a short while. Return Shutdown to
+	// shut down the server.
+	AcceptError func(err error) (action Action)
+	// Error fires when a system call made by the loop fails, such as
+	// updating the poll, writing to a connection or waiting for events. The
+	// c parameter is the connection that failed, which is closed, or nil for
+	// a failure of the loop itself. The error of a connection is a
+	// *net.OpError with its addresses, the same as the errors of a
+	// net.Conn, and it wraps an *os.SyscallError. The error of the loop is
+	// an *os.SyscallError.
+	// When Error is set, a failed wait for events is retried instead of
+	// returning the error from Serve. Return Shutdown to shut down the
+	// server. Accept failures fire AcceptError instead.
+	Error func(c Conn, err error) (action Action)
+	// Panic, when set, recovers the panics of the other events and fires
+	// with the recovered value and the stack of the goroutine that
+	// panicked. The c parameter is the connection of the event that
+	// panicked, which is closed, or nil when the event has no connection.
+	// A Tick that panics fires again after a second.
+	Panic func(c Conn, v interface{}, stack []byte)
+	// Span, when set, fires before the Opened, Data, DataAsync and Closed
+	// events with the name of the event, "opened", "data" or "closed", and
+	// the end func it returns, which may be nil, is called with the action
+	// of the event when it returns. It's for tracing the events, such as
+	// with OpenTelemetry spans keyed by Conn.ID, without evio depending on
+	// a tracing library. The end func isn't called when the event panics.
+	Span func(c Conn, event string) (end func(action Action))
+	// SlowEvent, when positive, is how long an Opened, Data, DataAsync or
+	// Closed event, or a whole iteration of the loop, may take before the
+	// Slow event fires. Use it to find handlers that block the loop.
+	SlowEvent time.Duration
+	// Slow fires after an event that took SlowEvent or longer, with the
+	// name of the event as for Span and the time it took. An iteration of
+	// the loop is named "loop" and has no connection, and includes the
+	// timers and Tick. Slow fires on the goroutine of the event, which is
+	// a worker for DataAsync.
+	Slow func(c Conn, event string, d time.Duration)
+	// Fault, when set, is called before each read and write system call of
+	// a stream connection, to inject failures for testing. The op is "read"
+	// or "write", and n is the most bytes the call may move. Return an err,
+	// such as syscall.EAGAIN or syscall.ECONNRESET, to fail the call with it
+	// without making it. Return a max between zero and n for a short read
+	// or a partial write of max bytes. Return zero and nil to make the call
+	// as is.
+	Fault func(c Conn, op string, n int) (max int, err error)
+	// IdleTimeout, when positive, closes connections that have not read or
+	// written any data for the duration. It can be changed for a single
+	// connection with Conn.SetIdleTimeout.
+	IdleTimeout time.Duration
+	// ReadBufferSize is the size of the buffer used for reading from
+	// connections, and the largest amount of data passed to a single Data
+	// event. The default is 4096.
+	ReadBufferSize int
+	// MaxReadBufferSize, when larger than ReadBufferSize, allows the read
+	// buffer to double in size each time a read fills it, up to this size.
+	MaxReadBufferSize int
+	// Control, when set, is called with the raw socket of each listener
+	// after it's created and before it's bound, after the address options
+	// are applied, the same as net.ListenConfig.Control. Use it to set
+	// socket options that evio does not have an option for.
+	Control func(network, address string, c syscall.RawConn) error
+	// MaxConns, when positive, is the most connections that may be open at
+	// once. When the limit is reached the server stops accepting until a
+	// connection closes, leaving new connections in the listen backlog.
+	MaxConns int
+	// MaxConnsPerIP, when positive, is the most connections that may be open
+	// at once from a single remote IP. Connections over the limit are closed
+	// as soon as they're accepted, before the Opened event.
+	MaxConnsPerIP int
+	// RejectConns makes the server accept connections over MaxConns and
+	// close them immediately, instead of leaving them in the backlog.
+	RejectConns bool
+	// WriteHighWater, when positive, is the most output in bytes that may
+	// be buffered for a connection before the HighWater event fires.
+	WriteHighWater int
+	// HighWater fires when the output buffered for a connection grows past
+	// WriteHighWater, such as when a slow client isn't reading. It fires
+	// again only after the output has been completely written. Return
+	// Close to close the connection without writing the output. When
+	// HighWater is nil the connection is closed.
+	HighWater func(c Conn) (action Action)
+	// MaxWriteBuffer, when positive, is a hard limit on the output in bytes
+	// that may be buffered for a connection. Unlike WriteHighWater, it's
+	// checked by each write, and a write that would go past it is dropped.
+	// The WriteBufferFull event then decides what happens to the
+	// connection.
+	MaxWriteBuffer int
+	// WriteBufferFull fires when a write of n bytes to a connection was
+	// dropped because of MaxWriteBuffer. Return None to keep the connection,
+	// such as to skip messages for a slow subscriber, or Close to close it
+	// without writing the buffered output, with ErrWriteBufferFull. When
+	// WriteBufferFull is nil the connection is closed.
+	WriteBufferFull func(c Conn, n int) (action Action)
+	// WriteBufferSize is the initial size of the output buffer of a
+	// connection, which is a ring buffer that doubles in size when it's
+	// full. It's allocated by the first write. The default is 4096.
+	WriteBufferSize int
+	// MaxIdleWriteBufferSize is the largest output buffer that a connection
+	// keeps once all of its output has been written. A larger one is freed
+	// and allocated again by the next write. The default is 4096, and a
+	// negative size frees them all.
+	MaxIdleWriteBufferSize int
+	// PoolBuffers reuses the read buffer and the input and output buffers
+	// of the connections, by pooling them in size classes that are powers
+	// of two. The pools are shared by all servers in the process, and
+	// lower the allocations of servers with many connections that come
+	// and go, or that grow and free their buffers. MemAlloc overrides it.
+	PoolBuffers bool
+	// MemAlloc, when set, is used to allocate the read buffer and the
+	// connection input and output buffers instead of make.
+	MemAlloc func(size int) []byte
+	// MemFree, when set, receives buffers that were allocated by MemAlloc
+	// and are no longer used.
+	MemFree func(buf []byte)
+}
+
+func (events *Events) alloc(size int) []byte {
+	if events.MemAlloc != nil {
+		return events.MemAlloc(size)
+	}
+	if events.PoolBuffers {
+		if i := poolClass(size); i < len(pools) {
+			if buf, _ := pools[i].Get().([]byte); buf != nil {
+				return buf[:size]
+			}
+			return make([]byte, size, minPoolSize<<i)
+		}
+	}
+	return make([]byte, size)
+}
+
+func (events *Events) free(buf []byte) {
+	if events.MemAlloc != nil {
+		if events.MemFree != nil && cap(buf) > 0 {
+			events.MemFree(buf[:cap(buf)])
+		}
+		return
+	}
+	if events.PoolBuffers && cap(buf) >= minPoolSize {
+		// only the buffers of a class, which came from alloc
+		if i := poolClass(cap(buf)); i < len(pools) &&
+			cap(buf) == minPoolSize<<i {
+			pools[i].Put(buf[:cap(buf)])
+		}
+	}
+}
+
+// minPoolSize is the size of the smallest class of PoolBuffers, and each
+// class is twice the size of the previous one, up to 16 MB.
+const minPoolSize = 512
+
+var pools [16]sync.Pool
+
+// poolClass returns the index of the smallest class that fits size, which
+// is len(pools) for a size that's too big.
+func poolClass(size int) int {
+	i := 0
+	for i < len(pools) && minPoolSize<<i < size {
+		i++
+	}
+	return i
 }
 
 // conn ...
 type conn struct {
 	write  bool             // connection requesting write events
 	fd     int              // file descriptor
-	oidx   int              // output write index
-	out    []byte           // output buffer
+	id     uint64           // see Conn.ID
+	vec    [][]byte         // buffers queued by Writev, written after out
+	files  []*queuedFile    // files sent after vec, see Writer.ReadFrom
+	out    ring             // output buffer
+	in     []byte           // buffered input, see Conn.Peek
+	ibuf   []byte           // storage of the input kept by Input
+	codec  Codec            // frames the data, see Conn.SetCodec
+	dones  []writeDone      // pending done funcs of WriteNoCopy
+	enc    []byte           // encoded frame scratch space
 	action Action           // last known action
 	ctx    interface{}      // user-defined context
 	poll   *poll            // connection poll
@@ -86,6 +954,97 @@ type conn struct {
 	laddr  net.Addr         // local address
 	saddr  int              // index of server address
 	sa     syscall.Sockaddr // socket address of fd
+	loop   *loop            // server loop
+	udp    bool             // datagram connection
+	err    error            // last known error
+	idle   time.Duration    // idle timeout, zero for none
+	active time.Time        // last read or write, when idle is set
+	itimer *timer           // idle timer
+	nread  int64            // total number of bytes read
+	nwrite int64            // total number of bytes written
+	nqueue int64            // output counted by the queued metric
+	reads  int64            // reads that returned data
+	writes int64            // writes that wrote data
+	opened time.Time        // when the conn was opened
+	last   time.Time        // last read or write
+	rlimit int64            // read limit, zero for none
+	peer   *conn            // piped connection
+	pipe   [2]int           // pipe for splicing to peer
+	splice bool             // pipe is open
+	high   bool             // HighWater fired since the output was flushed
+	wshut  bool             // CloseWrite was called
+	stream bool             // pulling the output, see Conn.Stream
+	wdone  bool             // the writing side is shut down
+	paused bool             // read events are off
+	hold   bool             // paused by PauseRead
+	busy   bool             // DataAsync is handling the input
+	ip     string           // remote IP, when counted for MaxConnsPerIP
+	events *Events          // connection events of the listener
+
+	trace  func(event string, data interface{}) // trace sink
+	timers map[*Timer]struct{}                  // timers from AfterFunc
+	groups map[string]struct{}                  // groups from Join
+}
+
+func (c *conn) CloseImmediately(reset bool) {
+	if c.poll == nil || c.udp {
+		return
+	}
+	if reset {
+		c.SetLinger(0)
+	}
+	if c.action == None || c.action == Detach {
+		c.action = Close
+	}
+	// so a write event in the same batch has nothing to write
+	c.out.discard(c.out.n)
+	c.vec = nil
+	c.closeFiles()
+	c.countQueued()
+	c.written(ErrConnClosed)
+	c.loop.failed = append(c.loop.failed, c)
+}
+
+func (c *conn) Stream() {
+	if c.poll == nil || c.udp || c.events.Writable == nil {
+		return
+	}
+	c.stream = true
+	c.modReadWrite()
+}
+
+func (c *conn) CloseWrite() {
+	if c.poll == nil || c.udp || c.wshut {
+		return
+	}
+	c.wshut = true
+	if !c.write {
+		// the shutdown is done by the next write event
+		c.modReadWrite()
+	}
+}
+
+func (c *conn) Hijack() (net.Conn, []byte, error) {
+	if c.poll == nil || c.action != None {
+		return nil, nil, ErrConnClosed
+	}
+	if c.udp || c.peer != nil || c.busy {
+		return nil, nil, errors.New("hijack requires a stream connection " +
+			"that isn't piped or handled by DataAsync")
+	}
+	if c.pending() || c.wshut {
+		return nil, nil, errors.New("hijack requires the pending output " +
+			"to be written")
+	}
+	buffered := append([]byte(nil), c.in...)
+	if err := c.loop.release(c); err != nil {
+		return nil, nil, err
+	}
+	nc, err := c.fileConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	return nc, buffered, nil
 }
 
 func (c *conn) Close() {
@@ -96,247 +1055,2521 @@ func (c *conn) Close() {
 		c.action = Close
 	}
 	if !c.write {
-		c.poll.modReadWrite(c.fd)
-		c.write = true
+		c.modReadWrite()
 	}
 }
 
 func (c *conn) Write(data []byte) {
-	if c.poll == nil {
+	if c.poll == nil || c.wshut {
 		return
 	}
 	if c.action == None {
-		c.out = append(c.out, data...)
+		c.appendFrame(data)
 		if !c.write {
-			c.poll.modReadWrite(c.fd)
-			c.write = true
+			c.modReadWrite()
 		}
 	}
 }
 
-func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
-func (c *conn) Context() interface{}       { return c.ctx }
-func (c *conn) AddrIndex() int             { return c.saddr }
-func (c *conn) LocalAddr() net.Addr        { return c.laddr }
-func (c *conn) RemoteAddr() net.Addr {
-	if c.raddr == nil {
-		switch sa := c.sa.(type) {
-		case *syscall.SockaddrInet4:
-			c.raddr = &net.TCPAddr{
-				IP:   append([]byte{}, sa.Addr[:]...),
-				Port: sa.Port,
-			}
-		case *syscall.SockaddrInet6:
-			var zone string
-			if sa.ZoneId != 0 {
-				ifi, err := net.InterfaceByIndex(int(sa.ZoneId))
-				if err == nil {
-					zone = ifi.Name
-				}
-			}
-			c.raddr = &net.TCPAddr{
-				IP:   append([]byte{}, sa.Addr[:]...),
-				Port: sa.Port,
-				Zone: zone,
-			}
-		case *syscall.SockaddrUnix:
-			c.raddr = &net.UnixAddr{Net: "unix", Name: sa.Name}
-		}
+func (c *conn) Writev(bufs [][]byte) {
+	if c.poll == nil || c.action != None || c.wshut {
+		return
 	}
-	return c.raddr
-}
-
-// Serve ...
-func Serve(events Events, addr ...string) error {
-	var lns []net.Listener
-	var lfs []*os.File
-	var lfds []int
-	defer func() {
-		for i := range lns {
-			syscall.Close(lfds[i])
-			lfs[i].Close()
-			lns[i].Close()
+	if c.codec != nil {
+		// each buffer is a frame, copied as it's encoded
+		for _, buf := range bufs {
+			c.Write(buf)
 		}
-	}()
-
-	p := newPoll()
-
-	for _, address := range addr {
-		network := "tcp"
-		if strings.Contains(address, "://") {
-			network = strings.Split(address, "://")[0]
-			address = strings.Split(address, "://")[1]
+		return
+	}
+	if !c.udp {
+		n := 0
+		for _, buf := range bufs {
+			n += len(buf)
 		}
-		if network == "unix" {
-			os.RemoveAll(address)
+		if c.full(n) {
+			return
 		}
-		ln, err := net.Listen(network, address)
-		if err != nil {
-			return err
+	}
+	for _, buf := range bufs {
+		if len(buf) == 0 {
+			continue
 		}
-		var lnf *os.File
-		switch netln := ln.(type) {
-		case *net.TCPListener:
-			lnf, err = netln.File()
-		case *net.UnixListener:
-			lnf, err = netln.File()
+		if c.udp {
+			// datagram replies are sent as one packet
+			c.appendOut(buf)
+		} else {
+			c.queue(buf)
 		}
-		if err != nil {
-			ln.Close()
-			return err
+	}
+	if !c.write && c.pending() {
+		c.modReadWrite()
+	}
+}
+
+func (c *conn) WriteNoCopy(data []byte, done func(err error)) {
+	if c.poll == nil || c.action != None || c.wshut {
+		if done != nil {
+			done(ErrConnClosed)
 		}
-		lfd := int(lnf.Fd())
-		lns = append(lns, ln)
-		lfs = append(lfs, lnf)
-		lfds = append(lfds, lfd)
-		if err := syscall.SetNonblock(lfd, true); err != nil {
-			return err
+		return
+	}
+	if c.full(len(data)) {
+		if done != nil {
+			done(ErrWriteBufferFull)
 		}
-		p.addRead(lfd)
+		return
 	}
+	c.Writev([][]byte{data})
+	if done != nil {
+		at := c.nwrite + c.queued()
+		c.dones = append(c.dones, writeDone{at, done})
+	}
+}
 
-	conns := make(map[int]*conn)
-	defer func() {
-		for cfd, c := range conns {
-			c.poll = nil
-			syscall.Close(cfd)
-			if events.Closed != nil {
-				events.Closed(c)
-			}
+// written calls the done funcs of WriteNoCopy for the data that has been
+// written, or all of them with err.
+func (c *conn) written(err error) {
+	for len(c.dones) > 0 && (err != nil || c.dones[0].at <= c.nwrite) {
+		done := c.dones[0].fn
+		c.dones[0] = writeDone{}
+		c.dones = c.dones[1:]
+		done(err)
+	}
+	if len(c.dones) == 0 {
+		c.dones = nil
+	}
+}
 
-		}
-	}()
-	if events.Serving != nil {
-		var s Server
-		for _, ln := range lns {
-			s.Addrs = append(s.Addrs, ln.Addr())
-		}
-		if events.Serving(s) == Shutdown {
-			return nil
-		}
+// writeDone is a done func of WriteNoCopy, which is called once the output
+// has been written up to the at byte.
+type writeDone struct {
+	at int64
+	fn func(err error)
+}
+
+func (c *conn) AsyncWrite(data []byte) {
+	data = append([]byte(nil), data...)
+	c.loop.execute(func() {
+		c.Write(data)
+		c.loop.highWater(c)
+	})
+}
+
+func (c *conn) AsyncClose() {
+	c.loop.execute(c.Close)
+}
+
+func (c *conn) WriteVarInt(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	c.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (c *conn) WriteVarInt32(v uint32) {
+	c.WriteVarInt(uint64(v))
+}
+
+// appendFrame appends data to the output buffer, encoded as a frame when
+// the connection has a codec.
+func (c *conn) appendFrame(data []byte) {
+	if c.codec == nil {
+		c.appendOut(data)
+		return
 	}
-	var lastTick time.Time
-	var delay time.Duration = -1
-	if events.Tick != nil {
-		delay = 0
+	c.enc = c.codec.Encode(c.enc[:0], data)
+	c.appendOut(c.enc)
+}
+
+func (c *conn) Retain(in []byte) []byte {
+	return append([]byte(nil), in...)
+}
+
+func (c *conn) SetCodec(codec Codec) {
+	if !c.udp {
+		c.codec = codec
 	}
+}
 
-	packet := make([]byte, 4096)
-	var shutdown bool
-	for !shutdown {
-		fds := p.wait(delay)
-	nextfd:
-		for _, fd := range fds {
-			for i, lfd := range lfds {
-				if lfd == fd {
-					fd, sa, err := syscall.Accept(lfd)
-					if err != nil {
-						if err == syscall.EAGAIN {
-							continue nextfd
-						}
-						panic(err)
-					}
-					if _, ok := lns[i].(*net.TCPListener); ok {
-						if err := setKeepAlive(fd, 300); err != nil {
-							syscall.Close(fd)
-							continue nextfd
-						}
-					}
-					if err := syscall.SetNonblock(fd, true); err != nil {
-						syscall.Close(fd)
-						continue nextfd
-					}
-					p.addRead(fd)
-					c := &conn{fd: fd, sa: sa, poll: p, saddr: i,
-						laddr: lns[i].Addr()}
-					conns[c.fd] = c
-					if events.Opened != nil {
-						out, action := events.Opened(c)
-						if len(out) > 0 || action != None {
-							c.out = append(c.out, out...)
-							c.action = action
-							c.write = true
-							p.modReadWrite(fd)
-						}
-					}
-					continue nextfd
-				}
-			}
-			c := conns[fd]
-			if len(c.out)-c.oidx > 0 {
-				if events.PreWrite != nil {
-					events.PreWrite()
-				}
-				for {
-					n, err := syscall.Write(c.fd, c.out[c.oidx:])
-					if err != nil {
-						if err != syscall.EAGAIN {
-							if c.action < Close {
-								c.action = Close
-							}
-							break
-						}
-					}
-					c.oidx += n
-					if c.oidx < len(c.out) {
-						continue
-					}
-					break
-				}
-				c.oidx = 0
-				if cap(c.out) > 4096 {
-					c.out = nil
-				} else {
-					c.out = c.out[:0]
-				}
-				if c.action == None {
-					c.write = false
-					p.modRead(c.fd)
-				}
-			} else if c.action >= Close {
-				c.poll = nil
-				syscall.Close(c.fd)
-				delete(conns, c.fd)
-				if events.Closed != nil {
-					action := events.Closed(c)
-					if c.action == Shutdown || action == Shutdown {
-						shutdown = true
-						break
-					}
-				}
-			} else {
-				n, err := syscall.Read(c.fd, packet[:])
-				if err != nil || n == 0 {
-					if err != syscall.EAGAIN {
-						c.action = Close
-					}
-					continue
-				}
-				if events.Data != nil {
-					out, action := events.Data(c, packet[:n])
-					if len(out) > 0 || action != None {
-						c.out = append(c.out, out...)
-						c.action = action
-						c.write = true
-						p.modReadWrite(fd)
-					}
-				}
-			}
+// full returns true if a write of n bytes would grow the output past
+// MaxWriteBuffer, in which case the write is dropped, and fires the
+// WriteBufferFull event.
+func (c *conn) full(n int) bool {
+	max := c.events.MaxWriteBuffer
+	if max <= 0 || c.udp || n == 0 || c.BufferedWrite()+n <= max {
+		return false
+	}
+	action := Close
+	if c.events.WriteBufferFull != nil {
+		action = c.events.WriteBufferFull(c, n)
+	}
+	if c.trace != nil {
+		c.trace("full", action)
+	}
+	if action >= Close {
+		// drop the writes that follow
+		c.action = Close
+		c.loop.fail(c, ErrWriteBufferFull)
+		if action == Shutdown {
+			c.loop.shutdown = true
 		}
-		if events.Tick != nil {
-			now := time.Now()
-			if now.Sub(lastTick) > delay {
-				var action Action
-				lastTick = now
-				delay, action = events.Tick(now)
-				if delay < 0 {
-					delay = 0
-				}
-				if action == Shutdown {
-					return nil
-				}
-			}
+	}
+	return true
+}
+
+// appendOut appends data to the output buffer. The buffer is grown using
+// the MemAlloc allocator, when provided.
+func (c *conn) appendOut(data []byte) {
+	if c.poll == nil {
+		// hijacked during the event
+		return
+	}
+	if c.full(len(data)) {
+		return
+	}
+	if len(c.vec) > 0 || len(c.files) > 0 {
+		// keep the order of the queued buffers
+		if len(data) > 0 {
+			c.queue(append([]byte(nil), data...))
 		}
+		return
+	}
+	size := c.loop.events.WriteBufferSize
+	if size <= 0 {
+		size = 4096
+	}
+	c.out.write(&c.loop.events, size, data)
+	c.countQueued()
+}
+
+func (c *conn) AfterFunc(d time.Duration, fn func()) *Timer {
+	return newTimer(c.loop, c, d, fn)
+}
+
+func (c *conn) BufferedWrite() int {
+	n := c.out.n
+	for _, buf := range c.vec {
+		n += len(buf)
+	}
+	for _, f := range c.files {
+		for _, buf := range f.after {
+			n += len(buf)
+		}
+	}
+	return n
+}
+
+// countQueued updates the queued metric with the output of the connection,
+// after it has been queued or written.
+func (c *conn) countQueued() {
+	if c.udp {
+		// datagram replies are sent once the Data event returns
+		return
+	}
+	n := c.queued()
+	atomic.AddInt64(&c.loop.metrics.queued, n-c.nqueue)
+	c.nqueue = n
+}
+
+// pending returns true if there's output waiting to be written.
+func (c *conn) pending() bool {
+	return c.out.n > 0 || len(c.vec) > 0 || len(c.files) > 0
+}
+
+// advance marks n bytes of the pending output as written.
+func (c *conn) advance(n int) {
+	if n < c.out.n {
+		c.out.discard(n)
+		return
+	}
+	n -= c.out.n
+	c.out.discard(c.out.n)
+	for n > 0 {
+		if n < len(c.vec[0]) {
+			c.vec[0] = c.vec[0][n:]
+			return
+		}
+		n -= len(c.vec[0])
+		c.vec[0] = nil
+		c.vec = c.vec[1:]
+	}
+}
+
+func (c *conn) modReadWrite() {
+	if c.udp || c.poll == nil {
+		// datagram replies are sent once the Data event returns, and a
+		// hijacked conn isn't polled
+		return
+	}
+	var err error
+	if c.paused {
+		err = c.poll.modPaused(c.fd, true)
+	} else {
+		err = c.poll.modReadWrite(c.fd)
+	}
+	if err != nil {
+		c.loop.fail(c, c.opError("poll", os.NewSyscallError("epoll_ctl", err)))
+		return
+	}
+	if !c.write {
+		c.write = true
+		atomic.AddInt64(&c.loop.metrics.writing, 1)
+	}
+	if c.trace != nil {
+		c.trace("poll", "readwrite")
+	}
+}
+
+func (c *conn) modRead() {
+	if c.poll == nil {
+		return
+	}
+	var err error
+	if c.paused {
+		err = c.poll.modPaused(c.fd, false)
+	} else {
+		err = c.poll.modRead(c.fd)
+	}
+	if err != nil {
+		c.loop.fail(c, c.opError("poll", os.NewSyscallError("epoll_ctl", err)))
+		return
+	}
+	if c.write {
+		c.write = false
+		atomic.AddInt64(&c.loop.metrics.writing, -1)
+	}
+	if c.trace != nil {
+		c.trace("poll", "read")
+	}
+}
+
+func (c *conn) PauseRead() {
+	c.hold = true
+	c.pause()
+}
+
+func (c *conn) ResumeRead() {
+	c.hold = false
+	if !c.busy {
+		c.resume()
+	}
+}
+
+// pause stops read events for the connection.
+func (c *conn) pause() {
+	if c.poll == nil || c.udp || c.paused {
+		return
+	}
+	if err := c.poll.modPaused(c.fd, c.write); err != nil {
+		c.loop.fail(c, c.opError("poll", os.NewSyscallError("epoll_ctl", err)))
+		return
+	}
+	c.paused = true
+	if c.trace != nil {
+		c.trace("poll", "paused")
+	}
+}
+
+// resume restarts read events for the connection.
+func (c *conn) resume() {
+	if c.poll == nil || !c.paused {
+		return
+	}
+	if err := c.poll.modResumed(c.fd, c.write); err != nil {
+		c.loop.fail(c, c.opError("poll", os.NewSyscallError("epoll_ctl", err)))
+		return
+	}
+	c.paused = false
+	if c.trace != nil {
+		c.trace("poll", "resumed")
+	}
+}
+
+func (c *conn) SetIdleTimeout(d time.Duration) {
+	if c.poll == nil || c.udp {
+		return
+	}
+	c.idle = d
+	if d <= 0 {
+		if c.itimer != nil {
+			c.loop.timers.stop(c.itimer)
+		}
+		return
+	}
+	c.active = c.loop.clockNow()
+	if c.itimer == nil {
+		c.itimer = &timer{fn: c.idleCheck, index: -1}
+	}
+	c.loop.timers.schedule(c.itimer, c.active.Add(d))
+}
+
+// idleCheck closes the connection if it has been idle for too long.
+// Activity doesn't touch the timer, so it's pushed back here instead.
+func (c *conn) idleCheck(now time.Time) {
+	if deadline := c.active.Add(c.idle); deadline.After(now) {
+		c.loop.timers.schedule(c.itimer, deadline)
+		return
+	}
+	if c.trace != nil {
+		c.trace("idle", c.idle)
+	}
+	c.loop.closeConn(c)
+}
+
+func (c *conn) LimitReadBytes(n int64) {
+	c.rlimit = n
+}
+
+func (c *conn) SetSOBindToDevice(ifname string) error {
+	if c.poll == nil {
+		return syscall.EBADF
+	}
+	return bindToDevice(c.fd, ifname)
+}
+
+func (c *conn) SetNoDelay(noDelay bool) error {
+	if c.poll == nil {
+		return syscall.EBADF
+	}
+	return setNoDelay(c.fd, noDelay)
+}
+
+func (c *conn) SetQuickAck(quickAck bool) error {
+	if c.poll == nil {
+		return syscall.EBADF
+	}
+	return setQuickAck(c.fd, quickAck)
+}
+
+func (c *conn) SetBuffers(rcv, snd int) error {
+	if c.poll == nil {
+		return syscall.EBADF
+	}
+	return setBuffers(c.fd, rcv, snd)
+}
+
+func setBuffers(fd, rcv, snd int) error {
+	if rcv > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET,
+			syscall.SO_RCVBUF, rcv); err != nil {
+			return err
+		}
+	}
+	if snd > 0 {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET,
+			syscall.SO_SNDBUF, snd)
+	}
+	return nil
+}
+
+func (c *conn) SetLinger(sec int) error {
+	if c.poll == nil {
+		return syscall.EBADF
+	}
+	var l syscall.Linger
+	if sec >= 0 {
+		l.Onoff = 1
+		l.Linger = int32(sec)
+	}
+	return syscall.SetsockoptLinger(c.fd, syscall.SOL_SOCKET,
+		syscall.SO_LINGER, &l)
+}
+
+func (c *conn) OriginalDst() (net.Addr, error) {
+	if c.poll == nil || c.udp {
+		return nil, syscall.EBADF
+	}
+	sa, err := originalDst(c.fd)
+	if err != nil {
+		if sa, err = syscall.Getsockname(c.fd); err != nil {
+			return nil, err
+		}
+	}
+	return sockaddrAddr(false, sa), nil
+}
+
+func (c *conn) SetTOS(tos int) error {
+	if c.poll == nil {
+		return syscall.EBADF
+	}
+	sa, err := syscall.Getsockname(c.fd)
+	if err != nil {
+		return err
+	}
+	_, v6 := sa.(*syscall.SockaddrInet6)
+	return setTOS(c.fd, v6, tos)
+}
+
+func (c *conn) SetPriority(prio int) error {
+	if c.poll == nil {
+		return syscall.EBADF
+	}
+	return setPriority(c.fd, prio)
+}
+
+func (c *conn) TCPInfo() (TCPInfo, error) {
+	if c.poll == nil || c.udp {
+		return TCPInfo{}, syscall.EBADF
+	}
+	return getTCPInfo(c.fd)
+}
+
+func setTOS(fd int, v6 bool, tos int) error {
+	if v6 {
+		// a dual stack socket also needs IP_TOS for IPv4 peers, which
+		// fails for IPv6 only sockets on some systems
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6,
+			syscall.IPV6_TCLASS, tos)
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
+
+func setNoDelay(fd int, noDelay bool) error {
+	var v int
+	if noDelay {
+		v = 1
+	}
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY,
+		v)
+}
+
+func (c *conn) EnableTrace(sink func(event string, data interface{})) {
+	c.trace = sink
+}
+
+func (c *conn) DisableTrace() {
+	c.trace = nil
+}
+
+func (c *conn) Join(group string) {
+	if c.poll == nil || c.udp {
+		return
+	}
+	l := c.loop
+	if c.groups == nil {
+		c.groups = make(map[string]struct{})
+	}
+	c.groups[group] = struct{}{}
+	if l.groups == nil {
+		l.groups = make(map[string]map[*conn]struct{})
+	}
+	if l.groups[group] == nil {
+		l.groups[group] = make(map[*conn]struct{})
+	}
+	l.groups[group][c] = struct{}{}
+}
+
+func (c *conn) Leave(group string) {
+	if _, ok := c.groups[group]; !ok {
+		return
+	}
+	delete(c.groups, group)
+	l := c.loop
+	if delete(l.groups[group], c); len(l.groups[group]) == 0 {
+		delete(l.groups, group)
+	}
+}
+
+func (c *conn) Peek(n int) []byte {
+	if n >= 0 && n < len(c.in) {
+		return c.in[:n]
+	}
+	return c.in
+}
+
+func (c *conn) Discard(n int) int {
+	if n < 0 {
+		n = 0
+	} else if n > len(c.in) {
+		n = len(c.in)
+	}
+	c.in = c.in[n:]
+	return n
+}
+
+func (c *conn) Stats() ConnStats {
+	return ConnStats{BytesRead: c.nread, BytesWritten: c.nwrite,
+		Reads: c.reads, Writes: c.writes, Opened: c.opened,
+		LastActive: c.last}
+}
+
+func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *conn) Context() interface{}       { return c.ctx }
+func (c *conn) ID() uint64                 { return c.id }
+func (c *conn) Buffered() int              { return len(c.in) }
+func (c *conn) AddrIndex() int             { return c.saddr }
+func (c *conn) LocalAddr() net.Addr        { return c.laddr }
+func (c *conn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		c.raddr = sockaddrAddr(c.udp, c.sa)
+	}
+	return c.raddr
+}
+
+func sockaddrAddr(udp bool, sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return inetAddr(udp, sa.Addr[:], sa.Port, "")
+	case *syscall.SockaddrInet6:
+		var zone string
+		if sa.ZoneId != 0 {
+			ifi, err := net.InterfaceByIndex(int(sa.ZoneId))
+			if err == nil {
+				zone = ifi.Name
+			}
+		}
+		return inetAddr(udp, sa.Addr[:], sa.Port, zone)
+	case *syscall.SockaddrUnix:
+		return &net.UnixAddr{Net: "unix", Name: sa.Name}
+	}
+	return nil
+}
+
+func inetAddr(udp bool, ip []byte, port int, zone string) net.Addr {
+	ip = append([]byte{}, ip...)
+	if udp {
+		return &net.UDPAddr{IP: ip, Port: port, Zone: zone}
+	}
+	return &net.TCPAddr{IP: ip, Port: port, Zone: zone}
+}
+
+// addrOpts are the listener options that may follow an address, such
+// as "tcp://:8080?reuseport=true".
+type addrOpts struct {
+	reusePort   bool          // SO_REUSEPORT
+	deferAccept time.Duration // TCP_DEFER_ACCEPT or the dataready filter
+	rcvBuf      int           // SO_RCVBUF
+	sndBuf      int           // SO_SNDBUF
+	v6only      *bool         // IPV6_V6ONLY, nil for the default
+	transparent bool          // IP_TRANSPARENT or IP_BINDANY
+	freebind    bool          // IP_FREEBIND or IP_BINDANY
+	tos         int           // IP_TOS or IPV6_TCLASS, -1 for the default
+	priority    int           // SO_PRIORITY, -1 for the default
+}
+
+func parseAddr(addr string) (network, address string, opts addrOpts,
+	err error) {
+	opts.tos, opts.priority = -1, -1
+	network, address = "tcp", addr
+	if strings.Contains(address, "://") {
+		network = strings.Split(address, "://")[0]
+		address = strings.Split(address, "://")[1]
+	}
+	if i := strings.IndexByte(address, '?'); i != -1 {
+		q, err := url.ParseQuery(address[i+1:])
+		if err != nil {
+			return "", "", opts, err
+		}
+		address = address[:i]
+		for key := range q {
+			switch key {
+			case "reuseport":
+				opts.reusePort, err = strconv.ParseBool(q.Get(key))
+			case "deferaccept":
+				opts.deferAccept, err = time.ParseDuration(q.Get(key))
+			case "rcvbuf":
+				opts.rcvBuf, err = strconv.Atoi(q.Get(key))
+			case "sndbuf":
+				opts.sndBuf, err = strconv.Atoi(q.Get(key))
+			case "tos":
+				opts.tos, err = strconv.Atoi(q.Get(key))
+			case "priority":
+				opts.priority, err = strconv.Atoi(q.Get(key))
+			case "freebind":
+				opts.freebind, err = strconv.ParseBool(q.Get(key))
+			case "transparent":
+				opts.transparent, err = strconv.ParseBool(q.Get(key))
+			case "v6only":
+				var v bool
+				v, err = strconv.ParseBool(q.Get(key))
+				opts.v6only = &v
+			default:
+				err = fmt.Errorf("%w: unknown option %q",
+					ErrUnsupportedAddress, key)
+			}
+			if err != nil {
+				return "", "", opts, err
+			}
+		}
+	}
+	return network, address, opts, nil
+}
+
+// control applies the options to the listener socket before it's bound.
+func (opts addrOpts) control(network, address string,
+	c syscall.RawConn) error {
+	var err error
+	if opts.v6only != nil && !strings.HasSuffix(network, "6") {
+		return fmt.Errorf("%w: v6only requires an IPv6 address, got %q",
+			ErrUnsupportedAddress, address)
+	}
+	if cerr := c.Control(func(fd uintptr) {
+		if opts.v6only != nil {
+			var v int
+			if *opts.v6only {
+				v = 1
+			}
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6,
+				syscall.IPV6_V6ONLY, v)
+		}
+		if err == nil && opts.tos >= 0 {
+			err = setTOS(int(fd), strings.HasSuffix(network, "6"), opts.tos)
+		}
+		if err == nil && opts.priority >= 0 {
+			err = setPriority(int(fd), opts.priority)
+		}
+		if err == nil && opts.freebind {
+			err = setFreebind(int(fd), strings.HasSuffix(network, "6"))
+		}
+		if err == nil && opts.transparent {
+			err = setTransparent(int(fd), strings.HasSuffix(network, "6"))
+		}
+		if err == nil && opts.reusePort {
+			err = setReusePort(int(fd))
+		}
+		if err == nil && (opts.rcvBuf > 0 || opts.sndBuf > 0) {
+			err = setBuffers(int(fd), opts.rcvBuf, opts.sndBuf)
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// listener is a server socket. It's either a stream listener, or a packet
+// conn for datagram networks.
+type listener struct {
+	ln   net.Listener   // stream listener
+	pc   net.PacketConn // datagram socket
+	f    *os.File       // dup of the socket
+	fd   int            // file descriptor of f
+	addr net.Addr       // listening address
+
+	events *Events // connection events, see Server.SetEvents
+}
+
+func listen(addr string, control func(network, address string,
+	c syscall.RawConn) error) (*listener, error) {
+	ln, err := listenAddr(addr, control)
+	if err != nil {
+		return nil, &ListenError{Addr: addr, Err: err}
+	}
+	return ln, nil
+}
+
+func listenAddr(addr string, control func(network, address string,
+	c syscall.RawConn) error) (*listener, error) {
+	network, address, opts, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	ln := new(listener)
+	lc := net.ListenConfig{Control: func(network, address string,
+		c syscall.RawConn) error {
+		if err := opts.control(network, address, c); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}}
+	switch network {
+	case "fd":
+		if opts != (addrOpts{tos: -1, priority: -1}) {
+			return nil, fmt.Errorf("%w: options are not supported for "+
+				"fd listeners", ErrUnsupportedAddress)
+		}
+		err = ln.inherit(address)
+	case "udp", "udp4", "udp6":
+		ln.pc, err = lc.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			return nil, err
+		}
+		ln.addr = ln.pc.LocalAddr()
+		ln.f, err = ln.pc.(*net.UDPConn).File()
+	case "tcp", "tcp4", "tcp6", "unix":
+		if network == "unix" {
+			os.RemoveAll(address)
+		}
+		ln.ln, err = lc.Listen(context.Background(), network, address)
+		if err != nil {
+			return nil, err
+		}
+		ln.addr = ln.ln.Addr()
+		switch netln := ln.ln.(type) {
+		case *net.TCPListener:
+			ln.f, err = netln.File()
+		case *net.UnixListener:
+			ln.f, err = netln.File()
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown network %q", ErrUnsupportedAddress,
+			network)
+	}
+	if err != nil {
+		ln.close()
+		return nil, err
+	}
+	ln.fd = int(ln.f.Fd())
+	if opts.deferAccept > 0 && ln.ln != nil {
+		// accept filters can only be set once the socket is listening
+		if err := setDeferAccept(ln.fd, opts.deferAccept); err != nil {
+			ln.close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// inherit uses a socket that was bound by the parent process, such as
+// systemd. The address is either the fd number, or a name from the
+// LISTEN_FDNAMES variable of socket activation.
+func (ln *listener) inherit(address string) error {
+	fd, err := strconv.Atoi(address)
+	if err != nil {
+		if fd, err = listenFD(address); err != nil {
+			return err
+		}
+	}
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return fmt.Errorf("fd %d: %w", fd, err)
+	}
+	f := os.NewFile(uintptr(fd), "fd://"+address)
+	defer f.Close()
+	if typ == syscall.SOCK_DGRAM {
+		ln.pc, err = net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		ln.addr = ln.pc.LocalAddr()
+		if pc, ok := ln.pc.(*net.UDPConn); ok {
+			ln.f, err = pc.File()
+			return err
+		}
+		return fmt.Errorf("%w: fd %d is not a udp socket",
+			ErrUnsupportedAddress, fd)
+	}
+	ln.ln, err = net.FileListener(f)
+	if err != nil {
+		return err
+	}
+	ln.addr = ln.ln.Addr()
+	switch netln := ln.ln.(type) {
+	case *net.TCPListener:
+		ln.f, err = netln.File()
+	case *net.UnixListener:
+		ln.f, err = netln.File()
+	}
+	return err
+}
+
+// listenFD returns the fd named by LISTEN_FDNAMES, following the
+// sd_listen_fds(3) protocol. The fds start at 3 and are only meant for the
+// process in LISTEN_PID.
+func listenFD(name string) (int, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid == os.Getpid() {
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n && i < len(names); i++ {
+			if names[i] == name {
+				return 3 + i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no listen fd named %q", name)
+}
+
+func (ln *listener) close() {
+	if ln.f != nil {
+		ln.f.Close()
+	}
+	if ln.ln != nil {
+		ln.ln.Close()
+	}
+	if ln.pc != nil {
+		ln.pc.Close()
+	}
+}
+
+// Serve starts handling events for the specified addresses.
+//
+// Addresses should use a scheme prefix and be formatted
+// like `tcp://192.168.0.10:9851` or `unix://socket`.
+// Valid network schemes:
+//
+//	tcp   - bind to both IPv4 and IPv6
+//	tcp4  - IPv4
+//	tcp6  - IPv6
+//	unix  - Unix Domain Socket
+//	udp   - UDP, also udp4 and udp6
+//	fd    - an inherited socket, such as `fd://3`, or a name from systemd
+//	        socket activation, such as `fd://http`
+//
+// For udp addresses the Data event fires once for each datagram and the
+// out return value is sent back to the datagram's source. The Opened and
+// Closed events do not fire, and a conn is only valid for the duration of
+// its Data event.
+//
+// The "tcp" network scheme is assumed when one is not specified.
+//
+// Options may follow the address as a query string, such as
+// `tcp://:9851?reuseport=true`. Valid options:
+//
+//	reuseport   - set SO_REUSEPORT so that multiple processes may listen
+//	              on the same address and share the incoming connections
+//	deferaccept - a duration, such as `deferaccept=5s`, to only accept
+//	              connections once data has arrived on them. This uses
+//	              TCP_DEFER_ACCEPT on Linux, where a connection is accepted
+//	              anyway after the duration, and the dataready accept filter
+//	              on FreeBSD and NetBSD, where the duration is ignored.
+//	rcvbuf      - the SO_RCVBUF size in bytes of the listener, which the
+//	              accepted connections inherit
+//	sndbuf      - the SO_SNDBUF size in bytes, the same as rcvbuf
+//	v6only      - whether an IPv6 address, such as `tcp://[::]:8080`, only
+//	              accepts IPv6 connections or also IPv4 connections. The
+//	              default depends on the network: "tcp" and "udp" are dual
+//	              stack, while "tcp6" and "udp6" are IPv6 only.
+//	tos         - the DSCP and ECN bits of the IP header of the accepted
+//	              connections, using IP_TOS or IPV6_TCLASS, such as
+//	              `tos=184` for expedited forwarding
+//	priority    - the SO_PRIORITY of the accepted connections, which
+//	              orders the packets in the queues of the host. This is
+//	              only supported on Linux.
+//	freebind    - bind to an address that is not configured on the host
+//	              yet, such as a virtual IP of a failover setup. This uses
+//	              IP_FREEBIND on Linux and IP_BINDANY on FreeBSD.
+//	transparent - accept connections for any destination address that
+//	              the firewall redirects to the listener, such as with a
+//	              TPROXY rule of iptables. Use Conn.OriginalDst for the
+//	              address that the client connected to. This uses
+//	              IP_TRANSPARENT on Linux, which requires CAP_NET_ADMIN,
+//	              and IP_BINDANY on FreeBSD.
+func Serve(events Events, addr ...string) error {
+	return ServeContext(context.Background(), events, addr...)
+}
+
+// ServeContext is the same as Serve, but the server shuts down gracefully,
+// the same as Server.Shutdown, once ctx is done. It then returns nil.
+func ServeContext(ctx context.Context, events Events, addr ...string) error {
+	lns, err := listenAll(addr, events.Control)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, events, lns)
+}
+
+// Start is the same as Serve, but it returns once the server is listening,
+// and the server runs on its own goroutine. Use Server.Wait to wait for it
+// to stop.
+func Start(events Events, addr ...string) (*Server, error) {
+	lns, err := listenAll(addr, events.Control)
+	if err != nil {
+		return nil, err
+	}
+	l, err := start(events, lns)
+	if err != nil {
+		return nil, err
+	}
+	s := l.server()
+	go l.serve(context.Background())
+	return &s, nil
+}
+
+// ServeListener starts handling events for listeners that were created by
+// the caller, such as with custom socket options. A listener must be a
+// *net.TCPListener, a *net.UnixListener, or have a File method that returns
+// its socket. The listeners are closed when the server stops.
+func ServeListener(events Events, ln ...net.Listener) error {
+	var lns []*listener
+	for _, nl := range ln {
+		fl, ok := nl.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeListeners(lns)
+			return fmt.Errorf("%w: listener %T has no file descriptor",
+				ErrUnsupportedAddress, nl)
+		}
+		f, err := fl.File()
+		if err != nil {
+			closeListeners(lns)
+			return err
+		}
+		lns = append(lns, &listener{ln: nl, f: f, fd: int(f.Fd()),
+			addr: nl.Addr()})
+	}
+	return serve(context.Background(), events, lns)
+}
+
+// listenAll listens on each address. Either all of them or none are
+// listening when it returns.
+func listenAll(addr []string, control func(network, address string,
+	c syscall.RawConn) error) ([]*listener, error) {
+	var lns []*listener
+	for _, a := range addr {
+		ln, err := listen(a, control)
+		if err != nil {
+			closeListeners(lns)
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+func closeListeners(lns []*listener) {
+	for _, ln := range lns {
+		ln.close()
+	}
+}
+
+// serve runs the server on the listeners, which it takes ownership of,
+// until it shuts down or ctx is done.
+func serve(ctx context.Context, events Events, lns []*listener) error {
+	l, err := start(events, lns)
+	if err != nil {
+		return err
+	}
+	return l.serve(ctx)
+}
+
+// start creates the loop for the listeners, which it takes ownership of.
+func start(events Events, lns []*listener) (*loop, error) {
+	l := &loop{events: events, lns: lns, conns: make(map[int]*conn),
+		ipconns: make(map[string]int), done: make(chan struct{})}
+	var err error
+	l.poll, err = newPoll(events.EdgeTriggered)
+	if err != nil {
+		closeListeners(lns)
+		return nil, err
+	}
+	l.edge = events.EdgeTriggered
+	l.spare = openSpare()
+	l.id = atomic.AddUint64(&lastLoopID, 1)
+	addrs := make([]string, len(lns))
+	for i, ln := range lns {
+		addrs[i] = ln.addr.Network() + "://" + ln.addr.String()
+	}
+	l.labels = pprof.Labels("evio_loop", strconv.FormatUint(l.id, 10),
+		"evio_addrs", strings.Join(addrs, ","))
+	for _, ln := range l.lns {
+		if err := l.register(ln); err != nil {
+			l.close()
+			return nil, err
+		}
+	}
+	if l.events.DataAsync != nil {
+		l.startWorkers()
+	}
+	return l, nil
+}
+
+// server returns the Server of the loop.
+func (l *loop) server() Server {
+	s := Server{loop: l}
+	for _, ln := range l.lns {
+		s.Addrs = append(s.Addrs, ln.addr)
+	}
+	return s
+}
+
+// serve runs the loop until it shuts down or ctx is done, and then closes
+// it.
+func (l *loop) serve(ctx context.Context) (err error) {
+	defer func() {
+		l.err = err
+		l.close()
+	}()
+	if len(l.events.Signals) > 0 {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, l.events.Signals...)
+		defer signal.Stop(sigs)
+		go func() {
+			for {
+				select {
+				case sig := <-sigs:
+					l.execute(func() { l.signal(sig) })
+				case <-l.done:
+					return
+				}
+			}
+		}()
+	}
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				l.execute(func() {
+					if !l.draining {
+						l.drain()
+					}
+				})
+			case <-l.done:
+			}
+		}()
+	}
+	// the labels are restored to those of ctx when the loop returns
+	pprof.Do(ctx, l.labels, func(context.Context) {
+		l.goid = goroutineID()
+		if l.events.Serving != nil {
+			if l.events.Serving(l.server()) == Shutdown {
+				return
+			}
+		}
+		err = l.run()
+	})
+	return err
+}
+
+// lastLoopID is the id of the last loop that was started.
+var lastLoopID uint64
+
+// goroutineID returns the id of the current goroutine, from the first line
+// of its stack trace, "goroutine 1 [running]:".
+func goroutineID() int64 {
+	var b [64]byte
+	f := strings.Fields(string(b[:runtime.Stack(b[:], false)]))
+	if len(f) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseInt(f[1], 10, 64)
+	return id
+}
+
+// loop is a running server. Everything but the metrics, id, labels, mu,
+// jobs, closed, nconns, and err fields is only accessed from the loop
+// goroutine.
+type loop struct {
+	metrics metrics // first, for the alignment of its atomics
+
+	events   Events         // server events
+	poll     *poll          // server poll
+	lns      []*listener    // listeners
+	conns    map[int]*conn  // open connections
+	ipconns  map[string]int // open connections per remote IP
+	packet   []byte         // read buffer
+	edge     bool           // edge-triggered poll
+	paused   bool           // not accepting, MaxConns or fd limit reached
+	timers   timers         // scheduled timers
+	failed   []*conn        // conns to close after the current batch
+	draining bool           // shutting down once all conns have closed
+	shutdown bool           // shutting down now
+	done     chan struct{}  // closed when Serve returns
+	now      time.Time      // when the poll last woke up
+	lastID   uint64         // ID of the last opened conn
+
+	iovs    []syscall.Iovec   // writev scratch space
+	tickers map[string]*timer // named tickers
+
+	groups map[string]map[*conn]struct{} // conns by group, see Conn.Join
+
+	spare   int           // reserved fd for shedding conns at the fd limit
+	backoff bool          // not accepting for a while after the fd limit
+	delay   time.Duration // current accept backoff
+	btimer  *timer        // ends the accept backoff
+
+	id     uint64         // unique id of the loop, see Server.LoopID
+	labels pprof.LabelSet // pprof labels of the loop goroutines
+	goid   int64          // id of the loop goroutine
+
+	work    chan func() // jobs for the DataAsync workers
+	working int         // jobs handed to the workers
+	backlog []func()    // jobs waiting for a worker
+
+	mu     sync.Mutex // guards jobs and closed
+	jobs   []func()   // pending jobs for the loop goroutine
+	closed bool       // loop is closed, no more jobs are accepted
+
+	nconns int32 // len(conns), for any goroutine
+	err    error // the error that stopped the loop, set before done is closed
+}
+
+// execute runs job on the loop goroutine. It's safe to call from any
+// goroutine. Returns false if the loop has closed.
+func (l *loop) execute(job func()) bool {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return false
+	}
+	l.jobs = append(l.jobs, job)
+	l.poll.trigger()
+	l.mu.Unlock()
+	return true
+}
+
+func (l *loop) runJobs() {
+	l.mu.Lock()
+	jobs := l.jobs
+	l.jobs = nil
+	l.mu.Unlock()
+	for _, job := range jobs {
+		if l.events.Panic != nil {
+			l.runJob(job)
+		} else {
+			job()
+		}
+	}
+}
+
+// runJob runs a job and recovers its panic.
+func (l *loop) runJob(job func()) {
+	defer l.rescue(nil)
+	job()
+}
+
+// fire fires the timers that are due.
+func (l *loop) fire(now time.Time) {
+	if l.events.Panic != nil {
+		// the timers that are left fire on the next loop
+		defer l.rescue(nil)
+	}
+	l.timers.fire(now)
+}
+
+// rescue is deferred around the events when the Panic event is set. It
+// recovers a panic of the events of c, or of the loop when c is nil.
+func (l *loop) rescue(c *conn) {
+	if v := recover(); v != nil {
+		l.panicked(c, v, debug.Stack())
+	}
+}
+
+// panicked closes the connection whose event panicked and fires the Panic
+// event.
+func (l *loop) panicked(c *conn, v interface{}, stack []byte) {
+	if c == nil {
+		l.events.Panic(nil, v, stack)
+		return
+	}
+	if c.poll != nil && !c.udp {
+		c.setErr(fmt.Errorf("%w: %v", ErrPanic, v))
+		l.failed = append(l.failed, c)
+	}
+	l.events.Panic(c, v, stack)
+}
+
+// startWorkers starts the goroutines for the DataAsync event.
+func (l *loop) startWorkers() {
+	n := l.events.Workers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	l.work = make(chan func(), n)
+	for i := 0; i < n; i++ {
+		labels := pprof.WithLabels(context.Background(), l.labels)
+		labels = pprof.WithLabels(labels, pprof.Labels("evio_worker",
+			strconv.Itoa(i)))
+		go func() {
+			pprof.SetGoroutineLabels(labels)
+			for job := range l.work {
+				job()
+			}
+		}()
+	}
+}
+
+// register adds a listener to the poll.
+func (l *loop) register(ln *listener) error {
+	if ln.events == nil {
+		ln.events = &l.events
+	}
+	if err := syscall.SetNonblock(ln.fd, true); err != nil {
+		return err
+	}
+	if _, ok := ln.ln.(*net.TCPListener); ok && l.events.UserTimeout > 0 &&
+		!hasUserTimeout {
+		// it's set on each accepted socket, so fail up front
+		return syscall.ENOPROTOOPT
+	}
+	if _, ok := ln.addr.(*net.UnixAddr); !ok && l.events.BusyPoll > 0 {
+		if ln.pc != nil {
+			// datagrams are read from the listener itself
+			if err := setBusyPoll(ln.fd, l.events.BusyPoll); err != nil {
+				return err
+			}
+		} else if !hasBusyPoll {
+			// it's set on each accepted socket, so fail up front
+			return syscall.ENOPROTOOPT
+		}
+	}
+	if err := l.poll.addRead(ln.fd); err != nil {
+		return err
+	}
+	if l.paused && ln.pc == nil {
+		return l.poll.modPaused(ln.fd, false)
+	}
+	return nil
+}
+
+// drain stops accepting new connections and closes the existing ones once
+// their output has been written.
+func (l *loop) drain() {
+	for _, ln := range l.lns {
+		if ln != nil {
+			ln.close()
+		}
+	}
+	l.lns = nil
+	for _, c := range l.conns {
+		c.Close()
+	}
+	l.draining = true
+}
+
+// signal handles a signal from the Signals list.
+func (l *loop) signal(sig os.Signal) {
+	if l.events.Signal != nil && l.events.Signal(sig) != Shutdown {
+		return
+	}
+	if l.draining {
+		l.shutdown = true
+	} else {
+		l.drain()
+	}
+}
+
+// detach removes the connection from the loop and hands it to the Detached
+// event as a net.Conn.
+func (l *loop) detach(c *conn) {
+	if err := l.release(c); err != nil {
+		l.fail(c, err)
+		return
+	}
+	nc, err := c.fileConn()
+	var action Action
+	if err != nil {
+		if c.events.Closed != nil {
+			action = c.events.Closed(c, err)
+		}
+	} else if c.events.Detached != nil {
+		action = c.events.Detached(c, nc)
+	} else {
+		nc.Close()
+	}
+	if action == Shutdown {
+		l.shutdown = true
+	}
+}
+
+// release removes the connection from the loop without closing its fd, for
+// detach and Conn.Hijack.
+func (l *loop) release(c *conn) error {
+	if err := l.poll.del(c.fd); err != nil {
+		return c.opError("poll", os.NewSyscallError("epoll_ctl", err))
+	}
+	delete(l.conns, c.fd)
+	atomic.AddInt32(&l.nconns, -1)
+	l.untrack(c)
+	c.poll = nil
+	if c.itimer != nil {
+		l.timers.stop(c.itimer)
+	}
+	for t := range c.timers {
+		t.Stop()
+	}
+	c.out.free(&l.events)
+	c.vec = nil
+	c.closeFiles()
+	c.in = nil
+	l.events.free(c.ibuf)
+	c.ibuf = nil
+	c.written(ErrConnClosed)
+	l.unpipe(c)
+	return nil
+}
+
+// fileConn returns a net.Conn for the fd of a released connection, which
+// is closed.
+func (c *conn) fileConn() (net.Conn, error) {
+	f := os.NewFile(uintptr(c.fd), "")
+	nc, err := net.FileConn(f)
+	f.Close()
+	return nc, err
+}
+
+// fail records an error that broke the connection. The connection is closed,
+// without flushing, once the current batch of events has been handled.
+func (l *loop) fail(c *conn, err error) {
+	if c.err == nil {
+		c.err = err
+		l.failed = append(l.failed, c)
+		if err != ErrHighWater && err != ErrWriteBufferFull {
+			l.error(c, err)
+		}
+	}
+}
+
+// error fires the Error event. A nil c is a failure of the loop itself.
+func (l *loop) error(c *conn, err error) {
+	if l.events.Error == nil {
+		return
+	}
+	var action Action
+	if c == nil {
+		// a nil *conn would be a non-nil Conn
+		action = l.events.Error(nil, err)
+	} else {
+		action = l.events.Error(c, err)
+	}
+	if action == Shutdown {
+		l.shutdown = true
+	}
+}
+
+// setErr records the reason the connection is closing, keeping the first
+// one.
+func (c *conn) setErr(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// opError wraps the error of a system call on the connection with its
+// addresses, the same as the errors of a net.Conn.
+func (c *conn) opError(op string, err error) error {
+	e := &net.OpError{Op: op, Source: c.laddr, Addr: c.RemoteAddr(), Err: err}
+	if c.laddr != nil {
+		e.Net = c.laddr.Network()
+	}
+	return e
+}
+
+// closeConn closes the connection and fires the Closed event. Any pending
+// output is discarded.
+func (l *loop) closeConn(c *conn) {
+	if l.events.Panic != nil {
+		defer l.rescue(c)
+	}
+	c.poll = nil
+	syscall.Close(c.fd)
+	delete(l.conns, c.fd)
+	atomic.AddInt32(&l.nconns, -1)
+	atomic.AddInt64(&l.metrics.closed, 1)
+	l.untrack(c)
+	c.out.free(&l.events)
+	c.vec = nil
+	c.closeFiles()
+	c.in = nil
+	l.events.free(c.ibuf)
+	c.ibuf = nil
+	c.written(ErrConnClosed)
+	l.unpipe(c)
+	if c.itimer != nil {
+		l.timers.stop(c.itimer)
+	}
+	for t := range c.timers {
+		t.Stop()
+	}
+	if c.events.Closed != nil {
+		end := l.span(c, "closed")
+		action := c.events.Closed(c, c.err)
+		if end != nil {
+			end(action)
+		}
+		if c.trace != nil {
+			c.trace("closed", action)
+		}
+		if c.action == Shutdown || action == Shutdown {
+			l.shutdown = true
+		}
+	}
+}
+
+func (l *loop) close() {
+	for cfd, c := range l.conns {
+		c.poll = nil
+		syscall.Close(cfd)
+		if c.splice {
+			syscall.Close(c.pipe[0])
+			syscall.Close(c.pipe[1])
+		}
+		c.out.free(&l.events)
+		c.closeFiles()
+		c.written(ErrConnClosed)
+		if c.events.Closed != nil {
+			func() {
+				if l.events.Panic != nil {
+					// close the others
+					defer l.rescue(c)
+				}
+				end := l.span(c, "closed")
+				action := c.events.Closed(c, c.err)
+				if end != nil {
+					end(action)
+				}
+			}()
+		}
+	}
+	atomic.AddInt64(&l.metrics.closed, int64(len(l.conns)))
+	atomic.StoreInt64(&l.metrics.writing, 0)
+	atomic.StoreInt64(&l.metrics.queued, 0)
+	atomic.StoreInt32(&l.nconns, 0)
+	for _, ln := range l.lns {
+		if ln != nil {
+			ln.close()
+		}
+	}
+	if l.spare >= 0 {
+		syscall.Close(l.spare)
+	}
+	l.mu.Lock()
+	l.closed = true
+	l.poll.close()
+	l.mu.Unlock()
+	if l.work != nil {
+		close(l.work)
+	}
+	close(l.done)
+}
+
+func (l *loop) run() error {
+	events := &l.events
+	if events.Tick != nil {
+		// Tick is a timer, so its delay is measured from the last tick and
+		// not from the last poll event
+		tick := &timer{index: -1}
+		tick.fn = func(now time.Time) {
+			if events.Panic != nil {
+				// rescheduled by a Tick that returns
+				l.timers.schedule(tick, now.Add(time.Second))
+			}
+			delay, action := events.Tick(now)
+			if action == Shutdown {
+				l.shutdown = true
+				return
+			}
+			if delay < 0 {
+				delay = 0
+			}
+			l.timers.schedule(tick, now.Add(delay))
+		}
+		l.timers.schedule(tick, l.clockNow())
+	}
+	size := events.ReadBufferSize
+	if size <= 0 {
+		size = 4096
+	}
+	l.packet = events.alloc(size)
+	defer func() { events.free(l.packet) }()
+	manual, _ := events.Clock.(*ManualClock)
+	if manual != nil {
+		manual.add(l)
+	}
+	for !l.shutdown {
+		start := time.Now()
+		timeout := l.timers.timeout(l.clockNow())
+		if manual != nil && timeout > 0 {
+			// woken by Advance
+			timeout = -1
+		}
+		if events.Spin || len(l.failed) > 0 {
+			timeout = 0
+		}
+		if !l.now.IsZero() {
+			// the time since the last wakeup is the last iteration
+			l.iterated(start.Sub(l.now))
+		}
+		fds, err := l.poll.wait(timeout)
+		l.now = time.Now()
+		if err != nil {
+			if events.Error == nil || events.Error(nil, err) == Shutdown {
+				return err
+			}
+			continue
+		}
+		atomic.AddInt64(&l.metrics.iterations, 1)
+		atomic.AddInt64(&l.metrics.waitTime, int64(l.now.Sub(start)))
+		l.runJobs()
+	nextfd:
+		for _, fd := range fds {
+			for i, ln := range l.lns {
+				if ln != nil && ln.fd == fd {
+					if ln.pc != nil {
+						l.readFrom(i, ln)
+					} else {
+						l.accept(i, ln)
+					}
+					continue nextfd
+				}
+			}
+			if c := l.conns[fd]; c != nil {
+				l.handle(c)
+			}
+			if l.shutdown {
+				break
+			}
+		}
+		for _, c := range l.failed {
+			if c.poll != nil {
+				l.closeConn(c)
+			}
+		}
+		l.failed = l.failed[:0]
+		l.fire(l.clockNow())
+		if l.shutdown {
+			break
+		}
+		if l.paused && !l.backoff && len(l.conns) < events.MaxConns {
+			l.resumeAccept()
+		}
+		if l.draining && len(l.conns) == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// accept accepts the pending connections on a stream listener.
+func (l *loop) accept(i int, ln *listener) {
+	if l.events.Panic != nil {
+		defer l.rescue(nil)
+	}
+	max := l.events.MaxConns
+	for {
+		if max > 0 && len(l.conns) >= max && !l.events.RejectConns {
+			l.pauseAccept()
+			return
+		}
+		fd, sa, err := acceptNonblock(ln.fd)
+		if err != nil {
+			switch err {
+			case syscall.EAGAIN:
+				return
+			case syscall.ECONNABORTED, syscall.EINTR:
+				continue
+			case syscall.EMFILE, syscall.ENFILE:
+				l.shed(ln)
+				fallthrough
+			case syscall.ENOBUFS, syscall.ENOMEM:
+				// the listener stays readable
+				l.backoffAccept()
+			}
+			l.acceptError(ln, os.NewSyscallError("accept", err))
+			return
+		}
+		l.delay = 0
+		if max > 0 && len(l.conns) >= max {
+			syscall.Close(fd)
+			continue
+		}
+		ip := sockaddrIP(sa)
+		if ip != "" && l.events.MaxConnsPerIP > 0 {
+			if l.ipconns[ip] >= l.events.MaxConnsPerIP {
+				syscall.Close(fd)
+				continue
+			}
+		} else {
+			ip = ""
+		}
+		if err := l.setup(ln, fd); err != nil {
+			syscall.Close(fd)
+			l.acceptError(ln, err)
+			if l.shutdown {
+				return
+			}
+			continue
+		}
+		c := &conn{fd: fd, sa: sa, poll: l.poll, saddr: i, laddr: ln.addr,
+			loop: l, ip: ip, events: ln.events}
+		l.open(c)
+	}
+}
+
+// setup applies the socket options of the server to an accepted connection
+// and adds it to the poll.
+func (l *loop) setup(ln *listener, fd int) error {
+	if _, ok := ln.ln.(*net.TCPListener); ok {
+		if err := l.keepAlive(fd); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+		if l.events.NoDelay {
+			if err := setNoDelay(fd, true); err != nil {
+				return os.NewSyscallError("setsockopt", err)
+			}
+		}
+		if l.events.UserTimeout > 0 {
+			err := setUserTimeout(fd, l.events.UserTimeout)
+			if err != nil {
+				return os.NewSyscallError("setsockopt", err)
+			}
+		}
+	}
+	if _, ok := ln.addr.(*net.UnixAddr); !ok && l.events.BusyPoll > 0 {
+		if err := setBusyPoll(fd, l.events.BusyPoll); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := l.poll.addRead(fd); err != nil {
+		return os.NewSyscallError("epoll_ctl", err)
+	}
+	return nil
+}
+
+// acceptError fires the AcceptError event with the error wrapped in the
+// address of the listener.
+func (l *loop) acceptError(ln *listener, err error) {
+	if l.events.AcceptError == nil {
+		return
+	}
+	err = &net.OpError{Op: "accept", Net: ln.addr.Network(), Addr: ln.addr,
+		Err: err}
+	if l.events.AcceptError(err) == Shutdown {
+		l.shutdown = true
+	}
+}
+
+// span starts the span of an event, returning the func that ends it or nil.
+// It also times the event for the Slow event.
+func (l *loop) span(c *conn, event string) func(action Action) {
+	var end func(action Action)
+	if l.events.Span != nil {
+		end = l.events.Span(c, event)
+	}
+	if l.events.SlowEvent <= 0 || l.events.Slow == nil {
+		return end
+	}
+	start := time.Now()
+	return func(action Action) {
+		if end != nil {
+			end(action)
+		}
+		if d := time.Since(start); d >= l.events.SlowEvent {
+			l.events.Slow(c, event, d)
+		}
+	}
+}
+
+// iterated records the time the loop spent handling the events of one
+// wakeup.
+func (l *loop) iterated(d time.Duration) {
+	atomic.AddInt64(&l.metrics.busyTime, int64(d))
+	if l.events.SlowEvent > 0 && l.events.Slow != nil &&
+		d >= l.events.SlowEvent {
+		l.events.Slow(nil, "loop", d)
+	}
+}
+
+// open adds a new connection to the loop and fires the Opened event.
+func (l *loop) open(c *conn) {
+	if l.events.Panic != nil {
+		defer l.rescue(c)
+	}
+	l.lastID++
+	c.id = l.lastID
+	atomic.AddInt64(&l.metrics.accepted, 1)
+	c.opened = time.Now()
+	c.last = c.opened
+	l.conns[c.fd] = c
+	atomic.AddInt32(&l.nconns, 1)
+	if c.ip != "" {
+		l.ipconns[c.ip]++
+	}
+	if c.events.IdleTimeout > 0 {
+		c.SetIdleTimeout(c.events.IdleTimeout)
+	}
+	if c.events.NewCodec != nil {
+		c.codec = c.events.NewCodec()
+	}
+	if c.events.Opened != nil {
+		end := l.span(c, "opened")
+		out, action := c.events.Opened(c)
+		if end != nil {
+			end(action)
+		}
+		if c.trace != nil {
+			c.trace("opened", action)
+		}
+		if len(out) > 0 || action != None {
+			if len(out) > 0 {
+				c.appendFrame(out)
+			}
+			c.action = action
+			c.modReadWrite()
+		}
+		l.highWater(c)
+	}
+}
+
+// keepAlive turns on keep-alive for an accepted TCP connection, with the
+// timings of the server.
+func (l *loop) keepAlive(fd int) error {
+	idle := l.events.KeepAlive
+	if idle < 0 {
+		return nil
+	}
+	if idle == 0 {
+		idle = 300 * time.Second
+	}
+	intvl := l.events.KeepAliveInterval
+	if intvl <= 0 {
+		intvl = idle
+	}
+	return setKeepAlive(fd, idle, intvl, l.events.KeepAliveCount)
+}
+
+// setKeepAliveOpts sets SO_KEEPALIVE and the TCP level options for the idle
+// time, the probe interval, and the probe count. The times are rounded up
+// to whole seconds. A count of zero is left to the system.
+func setKeepAliveOpts(fd int, idle, intvl time.Duration, cnt int, idleOpt,
+	intvlOpt, cntOpt int) error {
+	secs := func(d time.Duration) int {
+		return int((d + time.Second - 1) / time.Second)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET,
+		syscall.SO_KEEPALIVE, 1); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, idleOpt,
+		secs(idle)); err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, intvlOpt,
+		secs(intvl)); err != nil {
+		return err
+	}
+	if cnt > 0 {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, cntOpt, cnt)
 	}
 	return nil
 }
+
+// openSpare opens the reserved fd, or returns -1.
+func openSpare() int {
+	fd, err := syscall.Open("/dev/null", syscall.O_RDONLY|syscall.O_CLOEXEC,
+		0)
+	if err != nil {
+		return -1
+	}
+	return fd
+}
+
+// shed handles running out of fds while accepting. The reserved fd is
+// freed to accept and close one pending connection, so that its client
+// isn't left waiting in the backlog.
+func (l *loop) shed(ln *listener) {
+	if l.spare >= 0 {
+		syscall.Close(l.spare)
+		if fd, _, err := syscall.Accept(ln.fd); err == nil {
+			syscall.Close(fd)
+		}
+		l.spare = openSpare()
+	}
+}
+
+// backoffAccept stops accepting for a while after an accept failed for
+// lack of resources. The backoff starts at 5ms and doubles up to a second
+// while accepting keeps failing.
+func (l *loop) backoffAccept() {
+	l.delay *= 2
+	if l.delay == 0 {
+		l.delay = 5 * time.Millisecond
+	} else if l.delay > time.Second {
+		l.delay = time.Second
+	}
+	if l.btimer == nil {
+		l.btimer = &timer{index: -1, fn: func(time.Time) {
+			l.backoff = false
+			max := l.events.MaxConns
+			if l.paused && (max <= 0 || len(l.conns) < max) {
+				l.resumeAccept()
+			}
+		}}
+	}
+	l.pauseAccept()
+	l.backoff = true
+	l.timers.schedule(l.btimer, l.clockNow().Add(l.delay))
+}
+
+// acceptCloexec accepts a connection and then makes it nonblocking and
+// close-on-exec, for systems without accept4. The fork lock keeps the fd
+// from leaking to a process that's started in between.
+func acceptCloexec(fd int) (int, syscall.Sockaddr, error) {
+	syscall.ForkLock.RLock()
+	nfd, sa, err := syscall.Accept(fd)
+	if err == nil {
+		syscall.CloseOnExec(nfd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return -1, nil, err
+	}
+	if err := syscall.SetNonblock(nfd, true); err != nil {
+		syscall.Close(nfd)
+		return -1, nil, err
+	}
+	return nfd, sa, nil
+}
+
+// sockaddrIP returns the IP of an inet socket address as a map key, or an
+// empty string for other addresses.
+func sockaddrIP(sa syscall.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return string(sa.Addr[:])
+	case *syscall.SockaddrInet6:
+		if ip := net.IP(sa.Addr[:]).To4(); ip != nil {
+			// count v4-mapped addresses as v4
+			return string(ip)
+		}
+		return string(sa.Addr[:])
+	}
+	return ""
+}
+
+// untrack removes the connection from the per-IP connection counts, its
+// groups, and the writing and queued metrics.
+func (l *loop) untrack(c *conn) {
+	if c.write {
+		c.write = false
+		atomic.AddInt64(&l.metrics.writing, -1)
+	}
+	atomic.AddInt64(&l.metrics.queued, -c.nqueue)
+	c.nqueue = 0
+	for group := range c.groups {
+		c.Leave(group)
+	}
+	if c.ip == "" {
+		return
+	}
+	if l.ipconns[c.ip]--; l.ipconns[c.ip] <= 0 {
+		delete(l.ipconns, c.ip)
+	}
+	c.ip = ""
+}
+
+// pauseAccept stops accepting connections on the stream listeners until
+// resumeAccept is called.
+func (l *loop) pauseAccept() {
+	for _, ln := range l.lns {
+		if ln != nil && ln.pc == nil {
+			if err := l.poll.modPaused(ln.fd, false); err != nil {
+				l.error(nil, os.NewSyscallError("epoll_ctl", err))
+			}
+		}
+	}
+	l.paused = true
+}
+
+func (l *loop) resumeAccept() {
+	for _, ln := range l.lns {
+		if ln != nil && ln.pc == nil {
+			if err := l.poll.modResumed(ln.fd, false); err != nil {
+				l.error(nil, os.NewSyscallError("epoll_ctl", err))
+			}
+		}
+	}
+	l.paused = false
+}
+
+// readFrom reads the pending datagrams on a packet listener.
+func (l *loop) readFrom(i int, ln *listener) {
+	for !l.shutdown {
+		n, sa, err := syscall.Recvfrom(ln.fd, l.packet, 0)
+		if err != nil {
+			if err != syscall.EAGAIN && err != syscall.EINTR {
+				l.error(nil, os.NewSyscallError("recvfrom", err))
+			}
+			return
+		}
+		if ln.events.Data != nil {
+			l.datagram(i, ln, sa, l.packet[:n])
+		}
+	}
+}
+
+// datagram fires the Data event for a datagram and sends the output back.
+func (l *loop) datagram(i int, ln *listener, sa syscall.Sockaddr, in []byte) {
+	c := &conn{fd: ln.fd, sa: sa, poll: l.poll, saddr: i,
+		laddr: ln.addr, loop: l, udp: true, events: ln.events}
+	if l.events.Panic != nil {
+		defer l.rescue(c)
+	}
+	atomic.AddInt64(&l.metrics.bytesRead, int64(len(in)))
+	end := l.span(c, "data")
+	out, action := c.events.Data(c, l.deliver(in))
+	if end != nil {
+		end(action)
+	}
+	c.appendOut(out)
+	// the buffer of a new conn doesn't wrap
+	if out, _ := c.out.bufs(); len(out) > 0 {
+		if err := syscall.Sendto(ln.fd, out, 0, sa); err != nil {
+			err = c.opError("write", os.NewSyscallError("sendto", err))
+			c.written(err)
+			l.error(c, err)
+		} else {
+			atomic.AddInt64(&l.metrics.bytesWritten, int64(len(out)))
+			c.nwrite = int64(len(out))
+			c.written(nil)
+		}
+	}
+	c.poll = nil
+	c.out.free(&l.events)
+	if action == Shutdown {
+		l.shutdown = true
+	}
+}
+
+// handle handles a poll event for the connection.
+func (l *loop) handle(c *conn) {
+	if l.events.Panic != nil {
+		defer l.rescue(c)
+	}
+	if c.stream && !c.pending() && c.action == None {
+		l.pull(c)
+	}
+	if c.pending() || c.wshut && !c.wdone {
+		if !l.flush(c) || !l.edge {
+			// wait for the next event
+			return
+		}
+	}
+	if c.action == Detach {
+		l.detach(c)
+	} else if c.action >= Close {
+		l.closeConn(c)
+	} else if c.paused {
+		// only errors and hangups are reported while paused
+		var b [1]byte
+		n, _, err := syscall.Recvfrom(c.fd, b[:], syscall.MSG_PEEK)
+		if err != syscall.EAGAIN && (err != nil || n == 0) {
+			if err == nil {
+				c.setErr(io.EOF)
+			} else {
+				c.setErr(c.opError("read", os.NewSyscallError("recvfrom",
+					err)))
+			}
+			l.closeConn(c)
+		}
+	} else if l.read(c) && l.edge {
+		// edge-triggered events only fire once, so keep reading until
+		// the socket is drained.
+		for l.read(c) {
+		}
+	}
+}
+
+// flush writes the pending output to the connection. Returns false if the
+// socket couldn't take all of it.
+func (l *loop) flush(c *conn) bool {
+	if l.events.PreWrite != nil {
+		l.events.PreWrite()
+	}
+	var err error
+	var total int
+	var call string
+	for c.pending() {
+		var n int
+		var max int
+		if l.events.Fault != nil {
+			if max, err = l.fault(c, "write", c.writeSize()); err != nil {
+				call = "write"
+				break
+			}
+		}
+		if c.out.n == 0 && len(c.vec) == 0 {
+			call = "sendfile"
+			n, err = c.sendFile(max)
+		} else if max > 0 {
+			// partial write of the first buffer
+			buf, _ := c.out.bufs()
+			if len(buf) == 0 {
+				buf = c.vec[0]
+			}
+			if len(buf) > max {
+				buf = buf[:max]
+			}
+			call = "write"
+			n, err = syscall.Write(c.fd, buf)
+		} else if out, wrapped := c.out.bufs(); len(c.vec) == 0 &&
+			len(wrapped) == 0 {
+			call = "write"
+			n, err = syscall.Write(c.fd, out)
+		} else {
+			call = "writev"
+			n, err = l.writev(c)
+		}
+		if c.trace != nil {
+			c.trace("write", n)
+		}
+		if err != nil {
+			break
+		}
+		if call != "sendfile" {
+			c.advance(n)
+		}
+		total += n
+		c.nwrite += int64(n)
+		atomic.AddInt64(&l.metrics.bytesWritten, int64(n))
+		c.writes++
+		c.last = l.now
+		if c.idle > 0 {
+			c.active = l.clockNow()
+		}
+	}
+	c.written(nil)
+	c.countQueued()
+	if err == syscall.EAGAIN {
+		// socket buffer is full, wait until it's writable
+		l.wrote(c, total)
+		return false
+	}
+	if err != nil {
+		err = c.opError("write", os.NewSyscallError(call, err))
+		c.setErr(err)
+		if c.action < Close {
+			c.action = Close
+		}
+		c.written(err)
+		l.error(c, err)
+	}
+	c.out.discard(c.out.n)
+	c.vec = nil
+	c.countQueued()
+	c.high = false
+	max := l.events.MaxIdleWriteBufferSize
+	if max == 0 {
+		max = 4096
+	}
+	c.out.release(&l.events, max)
+	if c.wshut && !c.wdone && err == nil {
+		c.wdone = true
+		if err := syscall.Shutdown(c.fd, syscall.SHUT_WR); err != nil {
+			l.fail(c, c.opError("write", os.NewSyscallError("shutdown",
+				err)))
+		}
+	}
+	if c.action == None {
+		if c.stream {
+			// rearmed, so that an edge-triggered poll reports it again
+			c.modReadWrite()
+		} else {
+			c.modRead()
+		}
+	}
+	l.wrote(c, total)
+	return true
+}
+
+// fault fires the Fault event for a system call of up to n bytes, and
+// returns the error to fail the call with, or the size of a short call,
+// which is zero for a call of n bytes.
+func (l *loop) fault(c *conn, op string, n int) (int, error) {
+	max, err := l.events.Fault(c, op, n)
+	if err != nil {
+		if c.trace != nil {
+			c.trace("fault", err)
+		}
+		if err == syscall.EAGAIN && l.edge {
+			// the poll won't report the connection again
+			l.execute(func() {
+				if c.poll != nil {
+					l.handle(c)
+				}
+			})
+		}
+		return 0, err
+	}
+	if max <= 0 || max >= n {
+		return 0, nil
+	}
+	if c.trace != nil {
+		c.trace("fault", max)
+	}
+	return max, nil
+}
+
+// pull fires the Writable event for the next part of the output of a
+// streaming connection.
+func (l *loop) pull(c *conn) {
+	out, more := c.events.Writable(c)
+	c.stream = more
+	if c.trace != nil {
+		c.trace("writable", more)
+	}
+	if len(out) > 0 {
+		c.appendFrame(out)
+	} else if !more && !c.pending() && c.action == None {
+		c.modRead()
+	}
+}
+
+// wrote fires the Written event for the n bytes written by a flush.
+func (l *loop) wrote(c *conn, n int) {
+	if n == 0 || c.events.Written == nil {
+		return
+	}
+	action := c.events.Written(c, n)
+	if c.trace != nil {
+		c.trace("written", action)
+	}
+	if action != None {
+		c.action = action
+		c.modReadWrite()
+	}
+}
+
+// forward writes the n bytes that were read from the connection to its
+// peer. When spliced, the bytes are waiting in the connection's pipe rather
+// than in the packet buffer.
+func (l *loop) forward(c *conn, n int, spliced bool) {
+	p := c.peer
+	if !spliced {
+		p.Write(l.packet[:n])
+		l.highWater(p)
+		return
+	}
+	m, err := splice(c.pipe[0], p.fd, n)
+	if p.trace != nil {
+		p.trace("write", m)
+	}
+	if err != nil {
+		if err != syscall.EAGAIN {
+			l.fail(p, p.opError("write", os.NewSyscallError("splice", err)))
+		}
+		m = 0
+	} else {
+		p.nwrite += int64(m)
+		atomic.AddInt64(&l.metrics.bytesWritten, int64(m))
+		p.writes++
+		p.last = l.now
+		if p.idle > 0 {
+			p.active = l.clockNow()
+		}
+	}
+	if m < n {
+		// the peer can't take it all, so move the rest to its output
+		// to keep the pipe empty.
+		m, _ = syscall.Read(c.pipe[0], l.packet[:n-m])
+		if m > 0 {
+			p.Write(l.packet[:m])
+			l.highWater(p)
+		}
+	}
+}
+
+// input fires the Input event with the kept input followed by data, and
+// keeps the input that it didn't consume.
+func (l *loop) input(c *conn, data []byte) {
+	in := data
+	if len(c.in) > 0 {
+		l.keep(c, c.in, data)
+		in = c.ibuf
+	}
+	c.in = in
+	end := l.span(c, "data")
+	n, out, action := c.events.Input(c, l.deliver(in))
+	if end != nil {
+		end(action)
+	}
+	// the bytes discarded by the event come first
+	if n < 0 {
+		n = 0
+	}
+	n += len(in) - len(c.in)
+	if n > len(in) {
+		n = len(in)
+	}
+	if c.poll != nil {
+		l.keep(c, in[n:], nil)
+		c.in = c.ibuf
+	}
+	if c.trace != nil {
+		c.trace("data", action)
+	}
+	if len(out) > 0 || action != None {
+		c.appendOut(out)
+		c.action = action
+		c.modReadWrite()
+	}
+	l.highWater(c)
+}
+
+// keep sets the kept input of the connection to a followed by b. The a
+// bytes may be in the kept input already.
+func (l *loop) keep(c *conn, a, b []byte) {
+	n := len(a) + len(b)
+	if n == 0 && cap(c.ibuf) > 4096 {
+		l.events.free(c.ibuf)
+		c.ibuf = nil
+		return
+	}
+	if n > cap(c.ibuf) {
+		buf := l.events.alloc(n)
+		copy(buf, a)
+		l.events.free(c.ibuf)
+		c.ibuf = buf[:len(a)]
+	} else {
+		c.ibuf = c.ibuf[:copy(c.ibuf[:len(a)], a)]
+	}
+	c.ibuf = append(c.ibuf, b...)
+}
+
+// deliver returns the input for an event, which is a copy with CopyInput.
+func (l *loop) deliver(in []byte) []byte {
+	if l.events.CopyInput {
+		return append([]byte(nil), in...)
+	}
+	return in
+}
+
+// decode fires the Data event for each frame that the codec of the
+// connection decodes from data.
+func (l *loop) decode(c *conn, data []byte) {
+	frames, err := c.codec.Decode(data)
+	for _, frame := range frames {
+		if c.events.Data == nil || c.action != None {
+			break
+		}
+		end := l.span(c, "data")
+		out, action := c.events.Data(c, l.deliver(frame))
+		if end != nil {
+			end(action)
+		}
+		if c.trace != nil {
+			c.trace("data", action)
+		}
+		if len(out) > 0 || action != None {
+			if len(out) > 0 {
+				c.appendFrame(out)
+			}
+			c.action = action
+			c.modReadWrite()
+		}
+	}
+	if err != nil && c.action == None {
+		c.setErr(err)
+		c.Close()
+	}
+	l.highWater(c)
+}
+
+// dispatch hands a copy of the input to a worker for the DataAsync event.
+// Reading from the connection is paused until the result is back on the
+// loop, so the output stays in order.
+func (l *loop) dispatch(c *conn, in []byte) {
+	in = append([]byte(nil), in...)
+	c.busy = true
+	c.pause()
+	job := func() {
+		var out []byte
+		var action Action
+		var v interface{}
+		var stack []byte
+		func() {
+			if l.events.Panic != nil {
+				// handed to the loop with the result
+				defer func() {
+					if v = recover(); v != nil {
+						stack = debug.Stack()
+					}
+				}()
+			}
+			end := l.span(c, "data")
+			out, action = c.events.DataAsync(c, in)
+			if end != nil {
+				end(action)
+			}
+		}()
+		l.execute(func() {
+			l.working--
+			l.dispatchBacklog()
+			c.busy = false
+			if v != nil {
+				l.panicked(c, v, stack)
+				return
+			}
+			if c.poll == nil {
+				// closed while the worker was busy
+				return
+			}
+			if c.trace != nil {
+				c.trace("data", action)
+			}
+			if len(out) > 0 || action != None {
+				c.appendOut(out)
+				c.action = action
+				c.modReadWrite()
+			}
+			l.highWater(c)
+			if !c.hold {
+				c.resume()
+			}
+		})
+	}
+	if l.working < cap(l.work) {
+		l.working++
+		l.work <- job
+	} else {
+		l.backlog = append(l.backlog, job)
+	}
+}
+
+// dispatchBacklog hands the waiting jobs to the idle workers.
+func (l *loop) dispatchBacklog() {
+	for len(l.backlog) > 0 && l.working < cap(l.work) {
+		l.working++
+		l.work <- l.backlog[0]
+		l.backlog[0] = nil
+		l.backlog = l.backlog[1:]
+	}
+}
+
+// highWater fires the HighWater event when the output buffered for the
+// connection has grown past the high-water mark.
+func (l *loop) highWater(c *conn) {
+	max := c.events.WriteHighWater
+	if max <= 0 || c.high || c.poll == nil || c.BufferedWrite() <= max {
+		return
+	}
+	c.high = true
+	action := Close
+	if c.events.HighWater != nil {
+		action = c.events.HighWater(c)
+	}
+	if c.trace != nil {
+		c.trace("highwater", action)
+	}
+	if action >= Close {
+		l.fail(c, ErrHighWater)
+		if action == Shutdown {
+			l.shutdown = true
+		}
+	}
+}
+
+// unpipe disconnects the connection from its peer and closes the peer once
+// its pending output has been written.
+func (l *loop) unpipe(c *conn) {
+	for _, c := range []*conn{c, c.peer} {
+		if c != nil && c.splice {
+			syscall.Close(c.pipe[0])
+			syscall.Close(c.pipe[1])
+			c.splice = false
+		}
+	}
+	if p := c.peer; p != nil {
+		c.peer = nil
+		p.peer = nil
+		p.Close()
+	}
+}
+
+// maxIovecs is the most buffers passed to a single writev call, which is
+// the IOV_MAX of the supported systems.
+const maxIovecs = 1024
+
+// writev writes the pending output of the connection with one writev call.
+func (l *loop) writev(c *conn) (int, error) {
+	iovs := l.iovs[:0]
+	a, b := c.out.bufs()
+	for _, buf := range [2][]byte{a, b} {
+		if len(buf) > 0 {
+			iovs = append(iovs, syscall.Iovec{Base: &buf[0]})
+			iovs[len(iovs)-1].SetLen(len(buf))
+		}
+	}
+	for i := 0; i < len(c.vec) && len(iovs) < maxIovecs; i++ {
+		iovs = append(iovs, syscall.Iovec{Base: &c.vec[i][0]})
+		iovs[len(iovs)-1].SetLen(len(c.vec[i]))
+	}
+	r, _, errno := syscall.Syscall(syscall.SYS_WRITEV, uintptr(c.fd),
+		uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	for i := range iovs {
+		// don't hold on to the written buffers
+		iovs[i] = syscall.Iovec{}
+	}
+	l.iovs = iovs
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// read reads once from the connection and fires the Data event. Returns
+// true if the connection may have more to read.
+func (l *loop) read(c *conn) bool {
+	var n int
+	var err error
+	spliced := c.peer != nil && c.splice && !c.peer.pending()
+	if spliced {
+		n, err = splice(c.fd, c.pipe[1], len(l.packet))
+	} else if l.events.Fault == nil {
+		n, err = syscall.Read(c.fd, l.packet)
+	} else if max, ferr := l.fault(c, "read", len(l.packet)); ferr != nil {
+		err = ferr
+	} else if max > 0 {
+		n, err = syscall.Read(c.fd, l.packet[:max])
+	} else {
+		n, err = syscall.Read(c.fd, l.packet)
+	}
+	if c.trace != nil {
+		c.trace("read", n)
+	}
+	if err != nil || n == 0 {
+		if err != syscall.EAGAIN {
+			if err == nil {
+				c.setErr(io.EOF)
+			} else if spliced {
+				c.setErr(c.opError("read", os.NewSyscallError("splice", err)))
+			} else {
+				c.setErr(c.opError("read", os.NewSyscallError("read", err)))
+			}
+			c.action = Close
+			if l.edge && !c.write {
+				// there won't be another read event, so wait for a
+				// write event to close the connection.
+				c.modReadWrite()
+			}
+		}
+		return false
+	}
+	c.nread += int64(n)
+	atomic.AddInt64(&l.metrics.bytesRead, int64(n))
+	c.reads++
+	c.last = l.now
+	if c.idle > 0 {
+		c.active = l.clockNow()
+	}
+	if c.rlimit > 0 && c.nread > c.rlimit {
+		c.setErr(ErrReadLimitExceeded)
+		c.Close()
+		return false
+	}
+	if c.peer != nil {
+		l.forward(c, n, spliced)
+	} else if c.codec != nil {
+		l.decode(c, l.packet[:n])
+	} else if c.events.DataAsync != nil {
+		l.dispatch(c, l.packet[:n])
+	} else if c.events.Input != nil {
+		l.input(c, l.packet[:n])
+	} else if c.events.Data != nil {
+		end := l.span(c, "data")
+		out, action := c.events.Data(c, l.deliver(l.packet[:n]))
+		if end != nil {
+			end(action)
+		}
+		if c.trace != nil {
+			c.trace("data", action)
+		}
+		if len(out) > 0 || action != None {
+			c.appendOut(out)
+			c.action = action
+			c.modReadWrite()
+		}
+		l.highWater(c)
+	}
+	if max := l.events.MaxReadBufferSize; n == len(l.packet) && n < max {
+		// the read filled the buffer, grow it for the next one
+		size := n * 2
+		if size > max {
+			size = max
+		}
+		l.events.free(l.packet)
+		l.packet = l.events.alloc(size)
+	}
+	return c.poll != nil && c.action == None && !c.paused
+}
@@ -5,10 +5,25 @@
 package evio
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/tidwall/evio-lite/codec"
 )
 
 func TestEvioLite(t *testing.T) {
@@ -90,7 +105,7 @@ func TestEvioLite(t *testing.T) {
 		}
 		return []byte("HI THERE"), None
 	}
-	events.Closed = func(c Conn) (action Action) {
+	events.Closed = func(c Conn, err error) (action Action) {
 		opened--
 		return
 	}
@@ -135,3 +150,3429 @@ func TestEvioLite(t *testing.T) {
 	c2.Write(nil)
 	c2.Close()
 }
+
+func TestTrace(t *testing.T) {
+	addr := ":9992"
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			c.Write([]byte("HELLO"))
+			var data [64]byte
+			c.Read(data[:])
+			c.Close()
+		}()
+		return
+	}
+	var traced []string
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		c.EnableTrace(func(event string, data interface{}) {
+			traced = append(traced, event)
+		})
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	expect := "opened read data poll write poll read closed"
+	if strings.Join(traced, " ") != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, strings.Join(traced, " "))
+	}
+}
+
+func TestMemAlloc(t *testing.T) {
+	addr := ":9993"
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			c.Write([]byte("HELLO"))
+			var data [64]byte
+			c.Read(data[:])
+			c.Write([]byte("SHUTDOWN"))
+			c.Read(data[:])
+		}()
+		return
+	}
+	allocs := make(map[*byte]bool)
+	events.MemAlloc = func(size int) []byte {
+		buf := make([]byte, size)
+		allocs[&buf[0]] = true
+		return buf
+	}
+	events.MemFree = func(buf []byte) {
+		if !allocs[&buf[0]] {
+			t.Fatal("freed unknown buffer")
+		}
+		delete(allocs, &buf[0])
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "SHUTDOWN" {
+			return []byte("GOOD BYE"), Shutdown
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 0 {
+		t.Fatalf("expected zero, got %d", len(allocs))
+	}
+}
+
+func TestWriteVarInt(t *testing.T) {
+	addr := ":9994"
+	var events Events
+	res := make(chan []byte, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			var data [64]byte
+			n, _ := c.Read(data[:])
+			res <- data[:n]
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		c.WriteVarInt(300)
+		c.WriteVarInt32(1)
+		return nil, Close
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-res; string(data) != "\xac\x02\x01" {
+		t.Fatalf("expected '%x', got '%x'", "\xac\x02\x01", data)
+	}
+}
+
+func TestBrokenPipe(t *testing.T) {
+	addr := ":9995"
+	seen := make(chan bool)
+	reset := make(chan bool)
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			c.Write([]byte("HELLO"))
+			<-seen
+			c.(*net.TCPConn).SetLinger(0)
+			c.Close()
+			close(reset)
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		// stop reading, so that the reset is found by writing the output
+		c.PauseRead()
+		close(seen)
+		<-reset
+		// the peer reset the connection, writing must close the
+		// connection instead of raising SIGPIPE.
+		return in, None
+	}
+	var cerr error
+	events.Closed = func(c Conn, err error) (action Action) {
+		cerr = err
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	var oe *net.OpError
+	broken := errors.Is(cerr, syscall.EPIPE) ||
+		errors.Is(cerr, syscall.ECONNRESET)
+	if !errors.As(cerr, &oe) || oe.Op != "write" || !broken {
+		t.Fatalf("expected a write error, got '%v'", cerr)
+	}
+}
+
+func TestLimitReadBytes(t *testing.T) {
+	addr := ":9996"
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			var data [64]byte
+			c.Write([]byte("HELLO"))
+			c.Read(data[:])
+			c.Write([]byte("WORLD"))
+			c.Read(data[:])
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		c.LimitReadBytes(5)
+		return
+	}
+	var ins []string
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		ins = append(ins, string(in))
+		return in, None
+	}
+	var cerr error
+	events.Closed = func(c Conn, err error) (action Action) {
+		cerr = err
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ins, ",") != "HELLO" {
+		t.Fatalf("expected '%s', got '%s'", "HELLO", strings.Join(ins, ","))
+	}
+	if cerr != ErrReadLimitExceeded {
+		t.Fatalf("expected '%v', got '%v'", ErrReadLimitExceeded, cerr)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	addr := "tcp://127.0.0.1:9997?reuseport=true"
+	var events Events
+	var err2 error
+	events.Serving = func(s Server) (action Action) {
+		// listen on the same address while the first server is running
+		var events2 Events
+		events2.Serving = func(s Server) (action Action) {
+			return Shutdown
+		}
+		err2 = Serve(events2, addr)
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	if err := Serve(events, "tcp://:9997?reuseport=maybe"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestUDP(t *testing.T) {
+	addr := "127.0.0.1:9998"
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("udp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			var data [64]byte
+			c.Write([]byte("HELLO"))
+			n, _ := c.Read(data[:])
+			if string(data[:n]) != "HELLO" {
+				panic("expected HELLO")
+			}
+			c.Write([]byte("SHUTDOWN"))
+		}()
+		return
+	}
+	var raddr net.Addr
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		raddr = c.RemoteAddr()
+		if string(in) == "SHUTDOWN" {
+			return nil, Shutdown
+		}
+		c.Write(in)
+		return
+	}
+	if err := Serve(events, "udp://"+addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raddr.(*net.UDPAddr); !ok {
+		t.Fatalf("expected udp address, got %T", raddr)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	addr := ":9999"
+	var events Events
+	errs := make(chan error, 2)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			// one client that reads everything and one that reads nothing
+			c1, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c1.Close()
+			c2, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c2.Close()
+			var data [64]byte
+			n, _ := c1.Read(data[:])
+			if string(data[:n]) != "HI THERE" {
+				panic("expected HI THERE")
+			}
+			c2.Read(data[:1])
+			ctx, cancel := context.WithTimeout(context.Background(),
+				time.Second/10)
+			defer cancel()
+			errs <- s.Shutdown(ctx)
+			errs <- s.Shutdown(context.Background())
+		}()
+		return
+	}
+	var opened, closed int
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		opened++
+		if opened == 2 {
+			// more than the socket buffers can hold
+			return make([]byte, 64*1024*1024), None
+		}
+		return []byte("HI THERE"), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed++
+		return
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != context.DeadlineExceeded {
+		t.Fatalf("expected '%v', got '%v'", context.DeadlineExceeded, err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if closed != 2 {
+		t.Fatalf("expected 2, got %d", closed)
+	}
+}
+
+func TestAsyncWrite(t *testing.T) {
+	addr := ":10000"
+	var events Events
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			var all []byte
+			var data [64]byte
+			for {
+				n, err := c.Read(data[:])
+				if err != nil {
+					break
+				}
+				all = append(all, data[:n]...)
+			}
+			res <- string(all)
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		go func() {
+			data := []byte("HELLO")
+			c.AsyncWrite(data)
+			copy(data, "WORLD")
+			c.AsyncClose()
+		}()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-res; s != "HELLO" {
+		t.Fatalf("expected '%s', got '%s'", "HELLO", s)
+	}
+}
+
+func TestDetach(t *testing.T) {
+	addr := ":10001"
+	var events Events
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			var all []byte
+			var data [64]byte
+			for {
+				n, err := c.Read(data[:])
+				if err != nil {
+					break
+				}
+				all = append(all, data[:n]...)
+				if string(all) == "HI THERE" {
+					c.Write([]byte("HELLO"))
+				}
+			}
+			res <- string(all)
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		return []byte("HI THERE"), Detach
+	}
+	events.Detached = func(c Conn, nc net.Conn) (action Action) {
+		go func() {
+			defer nc.Close()
+			var data [64]byte
+			n, _ := nc.Read(data[:])
+			nc.Write(append([]byte(" "), data[:n]...))
+		}()
+		return Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		t.Fatal("closed should not fire")
+		return
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-res; s != "HI THERE HELLO" {
+		t.Fatalf("expected '%s', got '%s'", "HI THERE HELLO", s)
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	addr := ":10002"
+	var events Events
+	events.ReadBufferSize = 16
+	events.MaxReadBufferSize = 40
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			c.Write(make([]byte, 100))
+		}()
+		return
+	}
+	var sizes []int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		sizes = append(sizes, len(in))
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sizes) != "[16 32 40 12]" {
+		t.Fatalf("expected '%s', got '%v'", "[16 32 40 12]", sizes)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := ":10003"
+	var events Events
+	events.IdleTimeout = time.Hour
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			time.Sleep(time.Second / 20)
+			c.Write([]byte("HELLO"))
+			var data [64]byte
+			c.Read(data[:])
+		}()
+		return
+	}
+	var start time.Time
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		start = time.Now()
+		c.SetIdleTimeout(time.Second / 10)
+		return
+	}
+	var elapsed time.Duration
+	events.Closed = func(c Conn, err error) (action Action) {
+		elapsed = time.Since(start)
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed < time.Second/20*3 || elapsed > time.Second/2 {
+		t.Fatalf("expected around 150ms, got %s", elapsed)
+	}
+}
+
+type testHandler struct {
+	BuiltinEventHandler
+	addr string
+	in   string
+}
+
+func (h *testHandler) OnBoot(s Server) (action Action) {
+	go func() {
+		c, err := net.Dial("tcp", h.addr)
+		if err != nil {
+			panic(err)
+		}
+		defer c.Close()
+		c.Write([]byte("HELLO"))
+	}()
+	return
+}
+
+func (h *testHandler) OnData(c Conn, in []byte) (out []byte, action Action) {
+	h.in += string(in)
+	return
+}
+
+func (h *testHandler) OnClose(c Conn, err error) (action Action) {
+	return Shutdown
+}
+
+func TestEventHandler(t *testing.T) {
+	h := &testHandler{addr: ":10004"}
+	if err := ServeHandler(h, h.addr); err != nil {
+		t.Fatal(err)
+	}
+	if h.in != "HELLO" {
+		t.Fatalf("expected '%s', got '%s'", "HELLO", h.in)
+	}
+}
+
+func TestEdgeTriggered(t *testing.T) {
+	addr := ":10005"
+	var events Events
+	events.EdgeTriggered = true
+	events.ReadBufferSize = 16
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			c.Write([]byte(strings.Repeat("HELLO", 20)))
+			data := make([]byte, 100)
+			var n int
+			for n < len(data) {
+				nn, err := c.Read(data[n:])
+				if err != nil {
+					break
+				}
+				n += nn
+			}
+			res <- string(data[:n])
+		}()
+		return
+	}
+	var total int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		total += len(in)
+		return append([]byte{}, in...), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if total != 100 {
+		t.Fatalf("expected '%d', got '%d'", 100, total)
+	}
+	if s := <-res; s != strings.Repeat("HELLO", 20) {
+		t.Fatalf("expected '%s', got '%s'", strings.Repeat("HELLO", 20), s)
+	}
+}
+
+func TestWritev(t *testing.T) {
+	addr := ":10006"
+	var events Events
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			c.Write([]byte("HELLO"))
+			data := make([]byte, 64)
+			var n int
+			for n < 20 {
+				nn, err := c.Read(data[n:])
+				if err != nil {
+					break
+				}
+				n += nn
+			}
+			res <- string(data[:n])
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		c.Write([]byte("HEAD "))
+		c.Writev([][]byte{[]byte("BODY "), nil, []byte("MORE ")})
+		c.Write([]byte("TAIL"))
+		return []byte("\n"), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-res; s != "HEAD BODY MORE TAIL\n" {
+		t.Fatalf("expected '%s', got '%s'", "HEAD BODY MORE TAIL\n", s)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	addr := ":10007"
+	var events Events
+	res := make(chan string, 2)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c1, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c1.Close()
+			c2, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c2.Close()
+			var data [64]byte
+			c1.Write([]byte("HELLO"))
+			n, _ := c2.Read(data[:])
+			res <- string(data[:n])
+			c2.Write([]byte("WORLD"))
+			n, _ = c1.Read(data[:])
+			res <- string(data[:n])
+			c1.Close()
+			c2.Read(data[:])
+		}()
+		return
+	}
+	var first Conn
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		if first == nil {
+			first = c
+		} else if err := Pipe(first, c); err != nil {
+			panic(err)
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		panic("unexpected data event")
+	}
+	var closed int
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed++
+		if closed == 2 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"HELLO", "WORLD"} {
+		if s := <-res; s != expect {
+			t.Fatalf("expected '%s', got '%s'", expect, s)
+		}
+	}
+}
+
+func TestHighWater(t *testing.T) {
+	addr := ":10008"
+	var events Events
+	events.WriteHighWater = 1024
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			c.Write([]byte("HELLO"))
+			var data [64]byte
+			c.Read(data[:])
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		c.Write(make([]byte, 1000))
+		return make([]byte, 1000), None
+	}
+	var buffered int
+	events.HighWater = func(c Conn) (action Action) {
+		buffered = c.BufferedWrite()
+		return Close
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if buffered != 2000 {
+		t.Fatalf("expected '%d', got '%d'", 2000, buffered)
+	}
+}
+
+func TestPauseRead(t *testing.T) {
+	addr := ":10009"
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			c.Write([]byte("HELLO"))
+			var data [64]byte
+			c.Read(data[:])
+			c.Write([]byte("WORLD"))
+			c.Read(data[:])
+		}()
+		return
+	}
+	var paused Conn
+	var resumed bool
+	var ins []string
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		ins = append(ins, fmt.Sprintf("%s:%v", in, resumed))
+		if paused == nil {
+			paused = c
+			c.PauseRead()
+		}
+		return in, None
+	}
+	var ticks int
+	events.Tick = func(now time.Time) (delay time.Duration, action Action) {
+		if paused != nil {
+			ticks++
+			if ticks == 5 {
+				resumed = true
+				paused.ResumeRead()
+			}
+		}
+		return time.Second / 50, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ins) != "[HELLO:false WORLD:true]" {
+		t.Fatalf("expected '%s', got '%v'", "[HELLO:false WORLD:true]", ins)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	addr := ":10010"
+	var events Events
+	events.MaxConns = 1
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c1, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			var data [64]byte
+			c1.Write([]byte("1"))
+			c1.Read(data[:])
+			c2, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c2.Close()
+			c2.Write([]byte("2"))
+			time.Sleep(time.Second / 20)
+			c1.Close()
+			c2.Read(data[:])
+		}()
+		return
+	}
+	var log []string
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		log = append(log, "opened")
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		log = append(log, string(in))
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		log = append(log, "closed")
+		if len(log) == 6 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	expect := "[opened 1 closed opened 2 closed]"
+	if fmt.Sprint(log) != expect {
+		t.Fatalf("expected '%s', got '%v'", expect, log)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	addr := ":10011"
+	var events Events
+	events.MaxConnsPerIP = 1
+	res := make(chan error, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c1, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c1.Close()
+			c2, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c2.Close()
+			var data [64]byte
+			_, err = c2.Read(data[:])
+			res <- err
+		}()
+		return
+	}
+	var opened int
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		opened++
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-res; err == nil {
+		t.Fatal("expected an error")
+	}
+	if opened != 1 {
+		t.Fatalf("expected '%d', got '%d'", 1, opened)
+	}
+}
+
+func TestAfterFunc(t *testing.T) {
+	addr := ":10013"
+	var events Events
+	res := make(chan string, 1)
+	var fired bool
+	events.Serving = func(s Server) (action Action) {
+		s.AfterFunc(time.Millisecond, func() { fired = true })
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			var data [64]byte
+			n, _ := c.Read(data[:])
+			res <- string(data[:n])
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		c.AfterFunc(time.Second/20, func() { c.Write([]byte("LATE")) })
+		t := c.AfterFunc(time.Second/50, func() { c.Write([]byte("EARLY")) })
+		if !t.Stop() {
+			panic("expected the timer to stop")
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-res; s != "LATE" {
+		t.Fatalf("expected '%s', got '%s'", "LATE", s)
+	}
+	if !fired {
+		t.Fatal("expected the server timer to fire")
+	}
+}
+
+func TestExecute(t *testing.T) {
+	addr := ":10014"
+	var events Events
+	res := make(chan string, 1)
+	var server Server
+	events.Serving = func(s Server) (action Action) {
+		server = s
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			var data [64]byte
+			n, _ := c.Read(data[:])
+			res <- string(data[:n])
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		go func() {
+			server.Execute(func() {
+				c.Write([]byte("FROM LOOP"))
+			})
+		}()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-res; s != "FROM LOOP" {
+		t.Fatalf("expected '%s', got '%s'", "FROM LOOP", s)
+	}
+	if server.Execute(func() {}) {
+		t.Fatal("expected false after the server stopped")
+	}
+}
+
+func TestDataAsync(t *testing.T) {
+	addr := ":10015"
+	var events Events
+	events.Workers = 2
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			data := make([]byte, 64)
+			var n int
+			for _, s := range []string{"hello ", "async ", "world"} {
+				c.Write([]byte(s))
+			}
+			for n < 17 {
+				nn, err := c.Read(data[n:])
+				if err != nil {
+					break
+				}
+				n += nn
+			}
+			res <- string(data[:n])
+		}()
+		return
+	}
+	events.DataAsync = func(c Conn, in []byte) (out []byte, action Action) {
+		time.Sleep(time.Millisecond)
+		return []byte(strings.ToUpper(string(in))), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-res; s != "HELLO ASYNC WORLD" {
+		t.Fatalf("expected '%s', got '%s'", "HELLO ASYNC WORLD", s)
+	}
+}
+
+func TestTicker(t *testing.T) {
+	var events Events
+	counts := make(map[string]int)
+	events.Serving = func(s Server) (action Action) {
+		s.Ticker("fast", time.Millisecond, func(now time.Time) Action {
+			counts["fast"]++
+			return None
+		})
+		s.Ticker("removed", time.Millisecond, func(now time.Time) Action {
+			counts["removed"]++
+			return None
+		})
+		s.Ticker("removed", 0, nil)
+		s.Ticker("slow", time.Second/20, func(now time.Time) Action {
+			counts["slow"]++
+			return Shutdown
+		})
+		return
+	}
+	if err := Serve(events, ":10016"); err != nil {
+		t.Fatal(err)
+	}
+	if counts["slow"] != 1 || counts["removed"] != 0 || counts["fast"] < 10 {
+		t.Fatalf("unexpected counts '%v'", counts)
+	}
+}
+
+func TestTickDelay(t *testing.T) {
+	var events Events
+	var ticks []time.Time
+	delay := time.Millisecond * 3 / 2
+	events.Tick = func(now time.Time) (time.Duration, Action) {
+		ticks = append(ticks, time.Now())
+		if len(ticks) == 20 {
+			return 0, Shutdown
+		}
+		return delay, None
+	}
+	if err := Serve(events, ":10017"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(ticks); i++ {
+		// sub-millisecond delays are not truncated
+		if d := ticks[i].Sub(ticks[i-1]); d < delay {
+			t.Fatalf("expected '%v', got '%v'", delay, d)
+		}
+	}
+}
+
+func TestSignal(t *testing.T) {
+	var events Events
+	var got []os.Signal
+	events.Signals = []os.Signal{syscall.SIGUSR1}
+	events.Signal = func(sig os.Signal) (action Action) {
+		got = append(got, sig)
+		if len(got) == 1 {
+			// ignored
+			syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+			return None
+		}
+		return Shutdown
+	}
+	events.Serving = func(s Server) (action Action) {
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		return
+	}
+	if err := Serve(events, ":10018"); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1] != syscall.SIGUSR1 {
+		t.Fatalf("expected '%v', got '%v'", syscall.SIGUSR1, got)
+	}
+}
+
+func TestListenFD(t *testing.T) {
+	nln, err := net.Listen("tcp", ":10019")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := nln.(*net.TCPListener).File()
+	nln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the dup is closed by Serve
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	os.Setenv("LISTEN_FDNAMES", "stdin:web")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if _, err := listenFD("web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenFD("admin"); err == nil {
+		t.Fatal("expected an error")
+	}
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10019")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var got string
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		got = string(in)
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, fmt.Sprintf("fd://%d", fd)); err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Fatalf("expected '%s', got '%s'", "hello", got)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	if os.Getenv("EVIO_TEST_UPGRADE") != "" {
+		// the new process
+		var events Events
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			return []byte("new"), Close
+		}
+		events.Closed = func(c Conn, err error) (action Action) {
+			return Shutdown
+		}
+		if err := Serve(events, "fd://3"); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	var cmd *exec.Cmd
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		cmd = exec.Command(os.Args[0], "-test.run=^TestUpgrade$")
+		cmd.Env = append(os.Environ(), "EVIO_TEST_UPGRADE=1")
+		if err := s.Upgrade(cmd); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return []byte("old"), Close
+	}
+	if err := Serve(events, ":10020"); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	conn, err := net.Dial("tcp", ":10020")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	data, _ := ioutil.ReadAll(conn)
+	if string(data) != "new" {
+		t.Fatalf("expected '%s', got '%s'", "new", data)
+	}
+}
+
+func TestAddListener(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		i, err := s.AddListener("tcp://:10022")
+		if err != nil || i != 1 {
+			t.Fatalf("expected '%d', got '%d' (%v)", 1, i, err)
+		}
+		if err := s.RemoveListener(0); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RemoveListener(0); err == nil {
+			t.Fatal("expected an error")
+		}
+		go func() {
+			if _, err := net.Dial("tcp", ":10021"); err == nil {
+				panic("removed listener accepted a connection")
+			}
+			conn, err := net.Dial("tcp", ":10022")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	index := -1
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		index = c.AddrIndex()
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10021"); err != nil {
+		t.Fatal(err)
+	}
+	if index != 1 {
+		t.Fatalf("expected '%d', got '%d'", 1, index)
+	}
+}
+
+func TestSetEvents(t *testing.T) {
+	var events, admin Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return []byte("data"), Close
+	}
+	admin.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return []byte("admin"), Close
+	}
+	var closed int
+	admin.Closed = func(c Conn, err error) (action Action) {
+		closed++
+		return Shutdown
+	}
+	events.Serving = func(s Server) (action Action) {
+		if err := s.SetEvents(1, admin); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for _, addr := range []string{":10023", ":10024"} {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					panic(err)
+				}
+				conn.Write([]byte("hello"))
+				data, _ := ioutil.ReadAll(conn)
+				conn.Close()
+				if addr == ":10023" && string(data) != "data" {
+					panic(fmt.Sprintf("expected '%s', got '%s'", "data", data))
+				}
+				if addr == ":10024" && string(data) != "admin" {
+					panic(fmt.Sprintf("expected '%s', got '%s'", "admin", data))
+				}
+			}
+		}()
+		return
+	}
+	if err := Serve(events, ":10023", ":10024"); err != nil {
+		t.Fatal(err)
+	}
+	if closed != 1 {
+		t.Fatalf("expected '%d', got '%d'", 1, closed)
+	}
+}
+
+func TestServeListener(t *testing.T) {
+	nln, err := net.Listen("tcp", ":10025")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		if s.Addrs[0].String() != nln.Addr().String() {
+			t.Fatalf("expected '%s', got '%s'", nln.Addr(), s.Addrs[0])
+		}
+		go func() {
+			conn, err := net.Dial("tcp", ":10025")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var got string
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		got = string(in)
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := ServeListener(events, nln); err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Fatalf("expected '%s', got '%s'", "hello", got)
+	}
+	if _, err := net.Dial("tcp", ":10025"); err == nil {
+		t.Fatal("expected the listener to be closed")
+	}
+}
+
+func TestAttach(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := os.NewFile(uintptr(fds[1]), "")
+	defer f.Close()
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		c, err := s.Attach(fds[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.AddrIndex() != -1 {
+			t.Fatalf("expected '%d', got '%d'", -1, c.AddrIndex())
+		}
+		go func() {
+			f.Write([]byte("hello"))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		return []byte("hi "), None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, Close
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(f)
+	if string(data) != "hi hello" {
+		t.Fatalf("expected '%s', got '%s'", "hi hello", data)
+	}
+}
+
+func TestControl(t *testing.T) {
+	var events Events
+	var called []string
+	events.Control = func(network, address string, c syscall.RawConn) error {
+		called = append(called, network+" "+address)
+		var err error
+		c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+				syscall.SO_RCVBUF, 1<<16)
+		})
+		return err
+	}
+	events.Serving = func(s Server) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, "tcp4://127.0.0.1:10026"); err != nil {
+		t.Fatal(err)
+	}
+	if len(called) != 1 || called[0] != "tcp4 127.0.0.1:10026" {
+		t.Fatalf("unexpected calls '%v'", called)
+	}
+	errFailed := fmt.Errorf("failed")
+	events.Control = func(network, address string, c syscall.RawConn) error {
+		return errFailed
+	}
+	if err := Serve(events, ":10026"); err == nil ||
+		!strings.Contains(err.Error(), "failed") {
+		t.Fatalf("expected '%v', got '%v'", errFailed, err)
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	var events Events
+	events.NoDelay = true
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10027")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var values []int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		fd := c.(*conn).fd
+		v, _ := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP,
+			syscall.TCP_NODELAY)
+		values = append(values, v)
+		if err := c.SetNoDelay(false); err != nil {
+			t.Fatal(err)
+		}
+		err := c.SetQuickAck(true)
+		if runtime.GOOS == "linux" && err != nil {
+			t.Fatal(err)
+		} else if runtime.GOOS != "linux" && err != syscall.ENOPROTOOPT {
+			t.Fatalf("expected '%v', got '%v'", syscall.ENOPROTOOPT, err)
+		}
+		v, _ = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP,
+			syscall.TCP_NODELAY)
+		values = append(values, v)
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10027"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(values) != "[1 0]" {
+		t.Fatalf("expected '%s', got '%v'", "[1 0]", values)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	var events Events
+	events.KeepAlive = 10 * time.Second
+	events.KeepAliveInterval = 1500 * time.Millisecond
+	events.KeepAliveCount = 4
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10028")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var values []int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		opts := [][2]int{{syscall.SOL_SOCKET, syscall.SO_KEEPALIVE}}
+		if runtime.GOOS == "linux" {
+			// TCP_KEEPIDLE, TCP_KEEPINTVL, TCP_KEEPCNT
+			opts = append(opts, [2]int{syscall.IPPROTO_TCP, 0x4},
+				[2]int{syscall.IPPROTO_TCP, 0x5},
+				[2]int{syscall.IPPROTO_TCP, 0x6})
+		}
+		for _, opt := range opts {
+			v, err := syscall.GetsockoptInt(c.(*conn).fd, opt[0], opt[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, v)
+		}
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10028"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "[1 10 2 4]"
+	if runtime.GOOS != "linux" {
+		expect = "[1]"
+	}
+	if fmt.Sprint(values) != expect {
+		t.Fatalf("expected '%s', got '%v'", expect, values)
+	}
+}
+
+func TestUserTimeout(t *testing.T) {
+	var events Events
+	events.UserTimeout = 2500 * time.Millisecond
+	if runtime.GOOS != "linux" {
+		if err := Serve(events, ":10029"); err != syscall.ENOPROTOOPT {
+			t.Fatalf("expected '%v', got '%v'", syscall.ENOPROTOOPT, err)
+		}
+		return
+	}
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10029")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var value int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		// TCP_USER_TIMEOUT
+		value, _ = syscall.GetsockoptInt(c.(*conn).fd, syscall.IPPROTO_TCP,
+			0x12)
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10029"); err != nil {
+		t.Fatal(err)
+	}
+	if value != 2500 {
+		t.Fatalf("expected '%d', got '%d'", 2500, value)
+	}
+}
+
+func TestDeferAccept(t *testing.T) {
+	if err := Serve(Events{}, "tcp://:10030?deferaccept=soon"); err == nil {
+		t.Fatal("expected error")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("accept filters depend on the system")
+	}
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10030")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var got string
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		got = string(in)
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, "tcp://:10030?deferaccept=5s"); err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Fatalf("expected '%s', got '%s'", "hello", got)
+	}
+}
+
+func TestBuffers(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10031")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var sizes []int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		fd := c.(*conn).fd
+		rcv, _ := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET,
+			syscall.SO_RCVBUF)
+		if err := c.SetBuffers(0, 64*1024); err != nil {
+			t.Fatal(err)
+		}
+		snd, _ := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET,
+			syscall.SO_SNDBUF)
+		sizes = append(sizes, rcv, snd)
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, "tcp://:10031?rcvbuf=32768"); err != nil {
+		t.Fatal(err)
+	}
+	// linux doubles the sizes for bookkeeping
+	if len(sizes) != 2 || sizes[0] < 32768 || sizes[0] > 2*32768 ||
+		sizes[1] < 64*1024 || sizes[1] > 2*64*1024 {
+		t.Fatalf("unexpected sizes '%v'", sizes)
+	}
+}
+
+func TestLinger(t *testing.T) {
+	var events Events
+	errc := make(chan error, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10032")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			_, err = ioutil.ReadAll(conn)
+			errc <- err
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if err := c.SetLinger(0); err != nil {
+			t.Fatal(err)
+		}
+		return nil, Close
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10032"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err == nil || !strings.Contains(err.Error(), "reset") {
+		t.Fatalf("expected a reset, got '%v'", err)
+	}
+}
+
+func TestV6Only(t *testing.T) {
+	if err := Serve(Events{}, "tcp4://:10033?v6only=true"); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, v6only := range []bool{true, false} {
+		var events Events
+		var err2 error
+		events.Serving = func(s Server) (action Action) {
+			var conn net.Conn
+			conn, err2 = net.Dial("tcp4", "127.0.0.1:10033")
+			if err2 == nil {
+				conn.Close()
+			}
+			return Shutdown
+		}
+		addr := fmt.Sprintf("tcp://[::]:10033?v6only=%t", v6only)
+		if err := Serve(events, addr); err != nil {
+			t.Skip(err)
+		}
+		if v6only && err2 == nil {
+			t.Fatal("expected the IPv4 dial to fail")
+		} else if !v6only && err2 != nil {
+			t.Fatal(err2)
+		}
+	}
+}
+
+func TestOriginalDst(t *testing.T) {
+	if err := Serve(Events{}, "tcp://:10034?transparent=maybe"); err == nil {
+		t.Fatal("expected error")
+	}
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", "127.0.0.1:10034")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var dst string
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		addr, err := c.OriginalDst()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst = addr.String()
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, "tcp4://:10034"); err != nil {
+		t.Fatal(err)
+	}
+	// not redirected, so it's the local address
+	if dst != "127.0.0.1:10034" {
+		t.Fatalf("expected '%s', got '%s'", "127.0.0.1:10034", dst)
+	}
+}
+
+func TestFreebind(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("freebind depends on the system")
+	}
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		return Shutdown
+	}
+	// TEST-NET-1, which is not configured on the host
+	if err := Serve(events, "tcp://192.0.2.1:10035"); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := Serve(events, "tcp://192.0.2.1:10035?freebind=true"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTOS(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", "127.0.0.1:10036")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var values []int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		fd := c.(*conn).fd
+		v, _ := syscall.GetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS)
+		values = append(values, v)
+		if err := c.SetTOS(0x10); err != nil {
+			t.Fatal(err)
+		}
+		v, _ = syscall.GetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS)
+		values = append(values, v)
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, "tcp4://:10036?tos=184"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(values) != "[184 16]" {
+		t.Fatalf("expected '%s', got '%v'", "[184 16]", values)
+	}
+}
+
+func TestSpin(t *testing.T) {
+	var events Events
+	events.Spin = true
+	events.BusyPoll = 50 * time.Microsecond
+	if runtime.GOOS != "linux" {
+		events.BusyPoll = 0
+	}
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10037")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var value int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if runtime.GOOS == "linux" {
+			// SO_BUSY_POLL
+			value, _ = syscall.GetsockoptInt(c.(*conn).fd,
+				syscall.SOL_SOCKET, 0x2e)
+		}
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10037"); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && value != 50 {
+		t.Fatalf("expected '%d', got '%d'", 50, value)
+	}
+}
+
+func TestAcceptCloexec(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10038")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	var fdflags, flflags uintptr
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		fd := uintptr(c.(*conn).fd)
+		fdflags, _, _ = syscall.Syscall(syscall.SYS_FCNTL, fd,
+			syscall.F_GETFD, 0)
+		flflags, _, _ = syscall.Syscall(syscall.SYS_FCNTL, fd,
+			syscall.F_GETFL, 0)
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10038"); err != nil {
+		t.Fatal(err)
+	}
+	if fdflags&syscall.FD_CLOEXEC == 0 || flflags&syscall.O_NONBLOCK == 0 {
+		t.Fatalf("unexpected flags '%x' '%x'", fdflags, flflags)
+	}
+}
+
+func TestAcceptFDLimit(t *testing.T) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
+	low := rlim
+	low.Cur = 256
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &low); err != nil {
+		t.Fatal(err)
+	}
+	var filler []int
+	defer func() {
+		for _, fd := range filler {
+			syscall.Close(fd)
+		}
+	}()
+	var events Events
+	errc := make(chan error, 1)
+	events.Serving = func(s Server) (action Action) {
+		// use every fd but one, which is for the client
+		for {
+			fd, err := syscall.Open("/dev/null", syscall.O_RDONLY, 0)
+			if err != nil {
+				break
+			}
+			filler = append(filler, fd)
+		}
+		syscall.Close(filler[len(filler)-1])
+		filler = filler[:len(filler)-1]
+		go func() {
+			conn, err := net.Dial("tcp", ":10039")
+			if err != nil {
+				errc <- err
+				return
+			}
+			defer conn.Close()
+			// the server closes it without a Data event
+			_, err = conn.Read(make([]byte, 1))
+			errc <- err
+		}()
+		return
+	}
+	var acceptErr error
+	events.AcceptError = func(err error) (action Action) {
+		acceptErr = err
+		return Shutdown
+	}
+	if err := Serve(events, ":10039"); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(acceptErr, syscall.EMFILE) {
+		t.Fatalf("expected '%v', got '%v'", syscall.EMFILE, acceptErr)
+	}
+	if err := <-errc; err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestAcceptError(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the keep-alive limits depend on the system")
+	}
+	var events Events
+	// more than the 32767 seconds that linux allows
+	events.KeepAlive = 100000 * time.Second
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10040")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}()
+		return
+	}
+	var acceptErr error
+	events.AcceptError = func(err error) (action Action) {
+		acceptErr = err
+		return Shutdown
+	}
+	if err := Serve(events, ":10040"); err != nil {
+		t.Fatal(err)
+	}
+	var serr *os.SyscallError
+	if !errors.As(acceptErr, &serr) || serr.Syscall != "setsockopt" ||
+		!errors.Is(acceptErr, syscall.EINVAL) {
+		t.Fatalf("unexpected error '%v'", acceptErr)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	var events Events
+	closed := make(chan error)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			// closed by the server
+			conn, err := net.Dial("tcp", ":10041")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("close"))
+			<-closed
+			// closed by the client
+			conn, err = net.Dial("tcp", ":10041")
+			if err != nil {
+				panic(err)
+			}
+			conn.Close()
+			<-closed
+			// reset by the client
+			conn, err = net.Dial("tcp", ":10041")
+			if err != nil {
+				panic(err)
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Close
+	}
+	var errs []error
+	events.Closed = func(c Conn, err error) (action Action) {
+		errs = append(errs, err)
+		if len(errs) == 3 {
+			return Shutdown
+		}
+		closed <- nil
+		return
+	}
+	if err := Serve(events, ":10041"); err != nil {
+		t.Fatal(err)
+	}
+	expect := []error{nil, io.EOF, syscall.ECONNRESET}
+	for i := range expect {
+		if !errors.Is(errs[i], expect[i]) {
+			t.Fatalf("expected '%v', got '%v'", expect[i], errs[i])
+		}
+	}
+	var operr *net.OpError
+	if !errors.As(errs[2], &operr) || operr.Op != "read" {
+		t.Fatalf("unexpected error '%v'", errs[2])
+	}
+}
+
+func TestError(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10042")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("x"))
+			conn.Read(make([]byte, 1))
+			// reset while the server is still writing
+			conn.(*net.TCPConn).SetLinger(0)
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return make([]byte, 64*1024*1024), None
+	}
+	var errConn Conn
+	var errErr, closeErr error
+	events.Error = func(c Conn, err error) (action Action) {
+		errConn, errErr = c, err
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closeErr = err
+		return Shutdown
+	}
+	if err := Serve(events, ":10042"); err != nil {
+		t.Fatal(err)
+	}
+	var serr *os.SyscallError
+	if errConn == nil || !errors.As(errErr, &serr) || serr.Syscall != "write" ||
+		!(errors.Is(errErr, syscall.ECONNRESET) ||
+			errors.Is(errErr, syscall.EPIPE)) {
+		t.Fatalf("unexpected error '%v'", errErr)
+	}
+	if !errors.Is(errErr, closeErr) {
+		t.Fatalf("expected '%v', got '%v'", serr.Err, closeErr)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	var events Events
+	var ticks int
+	events.Serving = func(s Server) (action Action) {
+		s.Ticker("tick", 10*time.Millisecond,
+			func(now time.Time) (action Action) {
+				if ticks++; ticks == 1 {
+					panic("tick")
+				}
+				return
+			})
+		go func() {
+			// after the first tick
+			time.Sleep(50 * time.Millisecond)
+			conn, err := net.Dial("tcp", ":10043")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("panic"))
+			conn.Read(make([]byte, 1))
+			time.Sleep(50 * time.Millisecond)
+			// the loop is still serving
+			conn, err = net.Dial("tcp", ":10043")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "panic" {
+			panic("data")
+		}
+		return in, None
+	}
+	var panics []string
+	events.Panic = func(c Conn, v interface{}, stack []byte) {
+		if !strings.Contains(string(stack), "TestPanic") {
+			t.Fatalf("unexpected stack '%s'", stack)
+		}
+		panics = append(panics, fmt.Sprintf("%v %v", c != nil, v))
+	}
+	var errs []error
+	events.Closed = func(c Conn, err error) (action Action) {
+		if errs = append(errs, err); len(errs) == 2 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, ":10043"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(panics) != "[false tick true data]" {
+		t.Fatalf("expected '%s', got '%s'", "[false tick true data]", panics)
+	}
+	if fmt.Sprint(errs) != "[panic: data EOF]" {
+		t.Fatalf("expected '%s', got '%s'", "[panic: data EOF]", errs)
+	}
+	if ticks < 2 {
+		t.Fatalf("expected '%d', got '%d'", 2, ticks)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, addr := range []string{"sctp://:10044", "tcp://:10044?fast=true",
+		"tcp4://:10044?v6only=true"} {
+		err := Serve(Events{}, addr)
+		var lerr *ListenError
+		if !errors.As(err, &lerr) || lerr.Addr != addr ||
+			!errors.Is(err, ErrUnsupportedAddress) {
+			t.Fatalf("unexpected error '%v'", err)
+		}
+	}
+	ln, err := net.Listen("tcp", ":10044")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := Serve(Events{}, "tcp://:10044"); !errors.Is(err,
+		syscall.EADDRINUSE) {
+		t.Fatalf("unexpected error '%v'", err)
+	}
+	var events Events
+	var errs []error
+	events.Serving = func(s Server) (action Action) {
+		errs = append(errs, s.RemoveListener(1))
+		errs = append(errs, s.SetEvents(-1, Events{}))
+		return Shutdown
+	}
+	if err := Serve(events, "tcp://:10045"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrListenerClosed) {
+			t.Fatalf("unexpected error '%v'", err)
+		}
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10046")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+			cancel()
+			conn.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	var closed int
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed++
+		return
+	}
+	if err := ServeContext(ctx, events, ":10046"); err != nil {
+		t.Fatal(err)
+	}
+	if closed != 1 {
+		t.Fatalf("expected '%d', got '%d'", 1, closed)
+	}
+}
+
+func TestStart(t *testing.T) {
+	if _, err := Start(Events{}, "sctp://:10047"); err == nil {
+		t.Fatal("expected an error")
+	}
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	var closed int
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed++
+		return
+	}
+	s, err := Start(events, ":10047")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Addrs) != 1 {
+		t.Fatalf("expected '%d', got '%d'", 1, len(s.Addrs))
+	}
+	conn, err := net.Dial("tcp", ":10047")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	conn.Read(make([]byte, 5))
+	if n := s.NumConns(); n != 1 {
+		t.Fatalf("expected '%d', got '%d'", 1, n)
+	}
+	s.Stop()
+	if err := s.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.NumConns(); n != 0 || closed != 1 {
+		t.Fatalf("expected '%d %d', got '%d %d'", 0, 1, n, closed)
+	}
+}
+
+func TestForEachConn(t *testing.T) {
+	var events Events
+	var srv Server
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			for i := 0; i < 3; i++ {
+				conn, err := net.Dial("tcp", ":10048")
+				if err != nil {
+					panic(err)
+				}
+				defer conn.Close()
+				conn.Write([]byte("hello"))
+				conn.Read(make([]byte, 5))
+			}
+			conn, err := net.Dial("tcp", ":10048")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("all"))
+			conn.Read(make([]byte, 1))
+		}()
+		return
+	}
+	var visited int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) != "all" {
+			return in, None
+		}
+		srv.ForEachConn(func(c Conn) bool {
+			visited++
+			c.Close()
+			return true
+		})
+		return
+	}
+	var closed int
+	events.Closed = func(c Conn, err error) (action Action) {
+		if closed++; closed == 4 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, ":10048"); err != nil {
+		t.Fatal(err)
+	}
+	if visited != 4 {
+		t.Fatalf("expected '%d', got '%d'", 4, visited)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	var events Events
+	var srv Server
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			var conns []net.Conn
+			for i := 0; i < 4; i++ {
+				conn, err := net.Dial("tcp", ":10049")
+				if err != nil {
+					panic(err)
+				}
+				defer conn.Close()
+				conn.Write([]byte("hello"))
+				conn.Read(make([]byte, 5))
+				conns = append(conns, conn)
+			}
+			var all []string
+			for _, msg := range []string{"all", "others"} {
+				conns[3].Write([]byte(msg))
+				for i, conn := range conns {
+					if msg == "others" && i == 3 {
+						continue
+					}
+					buf := make([]byte, 4)
+					n, _ := io.ReadFull(conn, buf)
+					all = append(all, string(buf[:n]))
+				}
+			}
+			res <- strings.Join(all, ",")
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "all":
+			srv.Broadcast([]byte("news"))
+		case "others":
+			srv.BroadcastFunc([]byte("more"), func(other Conn) bool {
+				return other != c
+			})
+		default:
+			return in, None
+		}
+		return
+	}
+	var closed int
+	events.Closed = func(c Conn, err error) (action Action) {
+		if closed++; closed == 4 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, ":10049"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "news,news,news,news,more,more,more"
+	if s := <-res; s != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, s)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	var events Events
+	var srv Server
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			var conns []net.Conn
+			for _, cmd := range []string{"join a", "join a", "join b",
+				"leave a"} {
+				if len(conns) < 3 {
+					conn, err := net.Dial("tcp", ":10050")
+					if err != nil {
+						panic(err)
+					}
+					conns = append(conns, conn)
+				}
+				conn := conns[len(conns)-1]
+				if cmd == "leave a" {
+					conn = conns[1]
+				}
+				conn.Write([]byte(cmd))
+				conn.Read(make([]byte, 2))
+			}
+			conns[2].Write([]byte("pub a"))
+			buf := make([]byte, 4)
+			n, _ := io.ReadFull(conns[0], buf)
+			// left the group
+			conns[1].SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			m, _ := conns[1].Read(buf)
+			res <- string(buf[:n]) + strings.Repeat("!", m)
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		args := strings.Fields(string(in))
+		switch args[0] {
+		case "join":
+			c.Join(args[1])
+		case "leave":
+			c.Leave(args[1])
+		case "pub":
+			srv.Publish(args[1], []byte("msg!"))
+			return
+		}
+		return []byte("ok"), None
+	}
+	var closed int
+	events.Closed = func(c Conn, err error) (action Action) {
+		if closed++; closed == 3 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, ":10050"); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-res; s != "msg!" {
+		t.Fatalf("expected '%s', got '%s'", "msg!", s)
+	}
+	if len(srv.loop.groups) != 0 {
+		t.Fatalf("expected '%d', got '%d'", 0, len(srv.loop.groups))
+	}
+}
+
+func TestConnID(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			for i := 0; i < 3; i++ {
+				conn, err := net.Dial("tcp", ":10051")
+				if err != nil {
+					panic(err)
+				}
+				conn.Write([]byte("hello"))
+				conn.Read(make([]byte, 5))
+				conn.Close()
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	var ids []uint64
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		ids = append(ids, c.ID())
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if ids = append(ids, c.ID()); len(ids) == 6 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, ":10051"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[1 1 2 2 3 3]" {
+		t.Fatalf("expected '%s', got '%v'", "[1 1 2 2 3 3]", ids)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10052")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			for _, s := range []string{"hello", "world"} {
+				conn.Write([]byte(s))
+				conn.Read(make([]byte, 5))
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	var stats ConnStats
+	events.Closed = func(c Conn, err error) (action Action) {
+		stats = c.Stats()
+		return Shutdown
+	}
+	if err := Serve(events, ":10052"); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Opened.IsZero() || stats.LastActive.Before(stats.Opened) {
+		t.Fatalf("unexpected times '%v' and '%v'", stats.Opened,
+			stats.LastActive)
+	}
+	got := fmt.Sprint(stats.BytesRead, stats.BytesWritten, stats.Reads,
+		stats.Writes)
+	if got != "10 10 2 2" {
+		t.Fatalf("expected '%s', got '%s'", "10 10 2 2", got)
+	}
+}
+
+func TestTCPInfo(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "freebsd" &&
+		runtime.GOOS != "darwin" {
+		t.Skip("TCP_INFO is not supported")
+	}
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10053")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+			conn.Write([]byte("world"))
+			conn.Read(make([]byte, 1))
+		}()
+		return
+	}
+	var info TCPInfo
+	var infoErr error
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "world" {
+			info, infoErr = c.TCPInfo()
+			return nil, Close
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10053"); err != nil {
+		t.Fatal(err)
+	}
+	if infoErr != nil {
+		t.Fatal(infoErr)
+	}
+	if info.RTT <= 0 || info.MSS == 0 || info.Cwnd == 0 {
+		t.Fatalf("unexpected info '%+v'", info)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var events Events
+	var srv Server
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial("tcp", ":10055")
+				if err != nil {
+					panic(err)
+				}
+				conn.Write([]byte("hello"))
+				conn.Read(make([]byte, 5))
+				conn.Close()
+			}
+		}()
+		return
+	}
+	var queued []int64
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		c.Write(in)
+		queued = append(queued, srv.Metrics().Queued)
+		return nil, None
+	}
+	var closed int
+	events.Closed = func(c Conn, err error) (action Action) {
+		if closed++; closed == 2 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, ":10055"); err != nil {
+		t.Fatal(err)
+	}
+	m := srv.Metrics()
+	got := fmt.Sprint(m.Accepted, m.Closed, m.Open, m.BytesRead,
+		m.BytesWritten, m.Writing, m.Queued, queued)
+	if got != "2 2 0 10 10 0 0 [5 5]" {
+		t.Fatalf("expected '%s', got '%s'", "2 2 0 10 10 0 0 [5 5]", got)
+	}
+	if m.Iterations == 0 || m.WaitTime <= 0 {
+		t.Fatalf("unexpected metrics '%+v'", m)
+	}
+}
+
+func TestSpan(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10056")
+			if err != nil {
+				panic(err)
+			}
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+			conn.Close()
+		}()
+		return
+	}
+	var spans []string
+	events.Span = func(c Conn, event string) (end func(action Action)) {
+		spans = append(spans, fmt.Sprintf("%s:%d", event, c.ID()))
+		return func(action Action) {
+			spans = append(spans, fmt.Sprintf("end:%d", action))
+		}
+	}
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		spans = append(spans, "opened")
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		spans = append(spans, "data")
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		spans = append(spans, "closed")
+		return Shutdown
+	}
+	if err := Serve(events, ":10056"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "[opened:1 opened end:0 data:1 data end:0 closed:1 closed end:3]"
+	if fmt.Sprint(spans) != expect {
+		t.Fatalf("expected '%s', got '%v'", expect, spans)
+	}
+}
+
+func TestSlow(t *testing.T) {
+	var events Events
+	var srv Server
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			conn, err := net.Dial("tcp", ":10057")
+			if err != nil {
+				panic(err)
+			}
+			conn.Write([]byte("hello"))
+			conn.Read(make([]byte, 5))
+			conn.Close()
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		time.Sleep(20 * time.Millisecond)
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	events.SlowEvent = 10 * time.Millisecond
+	var slow []string
+	events.Slow = func(c Conn, event string, d time.Duration) {
+		if d < events.SlowEvent {
+			t.Fatalf("expected at least '%v', got '%v'", events.SlowEvent, d)
+		}
+		slow = append(slow, fmt.Sprint(event, " ", c != nil))
+	}
+	if err := Serve(events, ":10057"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(slow) != "[data true loop false]" {
+		t.Fatalf("expected '%s', got '%v'", "[data true loop false]", slow)
+	}
+	if m := srv.Metrics(); m.BusyTime < 20*time.Millisecond {
+		t.Fatalf("expected at least '%v', got '%v'", 20*time.Millisecond,
+			m.BusyTime)
+	}
+}
+
+func TestLoopLabels(t *testing.T) {
+	var events Events
+	var goid string
+	events.Serving = func(s Server) (action Action) {
+		b := make([]byte, 64)
+		goid = strings.Fields(string(b[:runtime.Stack(b, false)]))[1]
+		return
+	}
+	events.DataAsync = func(c Conn, in []byte) (out []byte, action Action) {
+		return
+	}
+	events.Workers = 1
+	s, err := Start(events, "tcp://127.0.0.1:10058")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if s.LoopID() == 0 {
+		t.Fatalf("expected a loop id")
+	}
+	res := make(chan int64)
+	s.Execute(func() { res <- s.GoroutineID() })
+	if id := fmt.Sprint(<-res); id != goid {
+		t.Fatalf("expected '%s', got '%s'", goid, id)
+	}
+	var buf strings.Builder
+	for i := 0; i < 100; i++ {
+		// the worker labels itself once it runs
+		buf.Reset()
+		pprof.Lookup("goroutine").WriteTo(&buf, 1)
+		if strings.Contains(buf.String(), "evio_worker") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, label := range []string{
+		fmt.Sprintf(`"evio_loop":"%d"`, s.LoopID()),
+		`"evio_addrs":"tcp://127.0.0.1:10058"`,
+		`"evio_worker":"0"`,
+	} {
+		if !strings.Contains(buf.String(), label) {
+			t.Fatalf("expected '%s' in the goroutine profile", label)
+		}
+	}
+}
+
+func TestInput(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10059")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			for _, s := range []string{"hel", "lo\nwor", "ld\n", "bye\n"} {
+				conn.Write([]byte(s))
+				time.Sleep(10 * time.Millisecond)
+			}
+			ioutil.ReadAll(conn)
+		}()
+		return
+	}
+	var lines []string
+	events.Input = func(c Conn, in []byte) (n int, out []byte,
+		action Action) {
+		for {
+			i := strings.IndexByte(string(in[n:]), '\n')
+			if i < 0 {
+				return n, out, None
+			}
+			line := string(in[n : n+i])
+			n += i + 1
+			if line == "bye" {
+				return n, out, Close
+			}
+			lines = append(lines, line)
+			out = append(out, strings.ToUpper(line)+"\n"...)
+		}
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10059"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(lines) != "[hello world]" {
+		t.Fatalf("expected '%s', got '%v'", "[hello world]", lines)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10060")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			for _, s := range []string{"0", "5hel", "lo05wor", "ld03bye"} {
+				conn.Write([]byte(s))
+				time.Sleep(10 * time.Millisecond)
+			}
+			ioutil.ReadAll(conn)
+		}()
+		return
+	}
+	var msgs []string
+	var buffered []int
+	events.Input = func(c Conn, in []byte) (n int, out []byte,
+		action Action) {
+		buffered = append(buffered, c.Buffered())
+		for c.Buffered() >= 2 {
+			size, _ := strconv.Atoi(string(c.Peek(2)))
+			if c.Buffered() < 2+size {
+				break
+			}
+			c.Discard(2)
+			msg := string(c.Peek(size))
+			c.Discard(size)
+			if msg == "bye" {
+				return 0, nil, Close
+			}
+			msgs = append(msgs, msg)
+		}
+		return 0, nil, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10060"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(msgs, buffered) != "[hello world] [1 5 12 12]" {
+		t.Fatalf("expected '%s', got '%v'", "[hello world] [1 5 12 12]",
+			fmt.Sprint(msgs, buffered))
+	}
+}
+
+func TestCodec(t *testing.T) {
+	var events Events
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10061")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			for _, s := range []string{"hel", "lo\nwor", "ld\nbye\n"} {
+				conn.Write([]byte(s))
+				time.Sleep(10 * time.Millisecond)
+			}
+			data, _ := ioutil.ReadAll(conn)
+			res <- string(data)
+		}()
+		return
+	}
+	events.NewCodec = func() Codec { return new(codec.Delimiter) }
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		return []byte("hi"), None
+	}
+	var frames []string
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		frames = append(frames, string(in))
+		if string(in) == "bye" {
+			c.Write([]byte("BYE"))
+			return nil, Close
+		}
+		return bytes.ToUpper(in), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10061"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(frames) != "[hello world bye]" {
+		t.Fatalf("expected '%s', got '%v'", "[hello world bye]", frames)
+	}
+	if got := <-res; got != "hi\nHELLO\nWORLD\nBYE\n" {
+		t.Fatalf("expected '%s', got '%s'", "hi\nHELLO\nWORLD\nBYE\n", got)
+	}
+}
+
+func TestCopyInput(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10062")
+			if err != nil {
+				panic(err)
+			}
+			for _, s := range []string{"hello", "world"} {
+				conn.Write([]byte(s))
+				conn.Read(make([]byte, 5))
+			}
+			conn.Close()
+		}()
+		return
+	}
+	events.CopyInput = true
+	var kept [][]byte
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if r := c.Retain(in); &r[0] == &in[0] || string(r) != string(in) {
+			t.Fatalf("expected a copy of '%s'", in)
+		}
+		kept = append(kept, in)
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10062"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%s", kept) != "[hello world]" {
+		t.Fatalf("expected '%s', got '%s'", "[hello world]", kept)
+	}
+}
+
+func TestWriteNoCopy(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10063")
+			if err != nil {
+				panic(err)
+			}
+			conn.Write([]byte("hello"))
+			time.Sleep(50 * time.Millisecond)
+			io.ReadFull(conn, make([]byte, 1<<20+5))
+			conn.Close()
+		}()
+		return
+	}
+	big := make([]byte, 1<<20)
+	var dones []string
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		c.WriteNoCopy(big, func(err error) {
+			dones = append(dones, fmt.Sprint("big ", err))
+		})
+		c.WriteNoCopy([]byte("world"), func(err error) {
+			dones = append(dones, fmt.Sprint("world ", err))
+		})
+		if c.BufferedWrite() != len(big)+5 {
+			t.Fatalf("expected '%d', got '%d'", len(big)+5, c.BufferedWrite())
+		}
+		c.Close()
+		c.WriteNoCopy([]byte("closed"), func(err error) {
+			dones = append(dones, fmt.Sprint("closed ", err))
+		})
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10063"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "[closed connection is closed big <nil> world <nil>]"
+	if fmt.Sprint(dones) != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, dones)
+	}
+}
+
+func TestRing(t *testing.T) {
+	var events Events
+	var r ring
+	check := func(expect string) {
+		a, b := r.bufs()
+		got := fmt.Sprintf("%s|%s %d", a, b, len(r.buf))
+		if got != expect {
+			t.Fatalf("expected '%s', got '%s'", expect, got)
+		}
+	}
+	r.write(&events, 8, []byte("hello"))
+	check("hello| 8")
+	r.discard(4)
+	r.write(&events, 8, []byte("world"))
+	check("owor|ld 8")
+	// growing moves the data to the front
+	r.write(&events, 8, []byte("!!!!!!!!"))
+	check("oworld!!!!!!!!| 16")
+	r.discard(r.n)
+	r.release(&events, 8)
+	if r.buf != nil || r.head != 0 {
+		t.Fatalf("expected the buffer to be released")
+	}
+}
+
+func TestPoolBuffers(t *testing.T) {
+	events := Events{PoolBuffers: true}
+	for _, size := range []int{1, 512, 1000, 5000, 16 << 20, 16<<20 + 1} {
+		buf := events.alloc(size)
+		expect := 512
+		for expect < size {
+			expect *= 2
+		}
+		if size > 16<<20 {
+			expect = size
+		}
+		if len(buf) != size || cap(buf) != expect {
+			t.Fatalf("expected '%d %d', got '%d %d'", size, expect, len(buf),
+				cap(buf))
+		}
+		events.free(buf)
+	}
+	res := make(chan int, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10064")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			for _, s := range []string{"hel", "lo\n", strings.Repeat("x", 9000)} {
+				conn.Write([]byte(s))
+				time.Sleep(10 * time.Millisecond)
+			}
+			n, _ := io.ReadFull(conn, make([]byte, 9006))
+			res <- n
+		}()
+		return
+	}
+	events.Input = func(c Conn, in []byte) (n int, out []byte,
+		action Action) {
+		if i := strings.IndexByte(string(in), '\n'); i >= 0 {
+			return i + 1, in[:i+1], None
+		}
+		if len(in) == 9000 {
+			return len(in), in, Close
+		}
+		return 0, nil, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10064"); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-res; n != 9006 {
+		t.Fatalf("expected '%d', got '%d'", 9006, n)
+	}
+}
+
+func TestMaxWriteBuffer(t *testing.T) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial("tcp", ":10065")
+				if err != nil {
+					panic(err)
+				}
+				conn.Write([]byte("hello"))
+				ioutil.ReadAll(conn)
+				conn.Close()
+			}
+		}()
+		return
+	}
+	events.MaxWriteBuffer = 8
+	var full []string
+	events.WriteBufferFull = func(c Conn, n int) (action Action) {
+		full = append(full, fmt.Sprint(c.ID(), ":", n))
+		if c.ID() == 1 {
+			return None
+		}
+		return Close
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		c.Write([]byte("12345"))
+		c.Writev([][]byte{[]byte("678"), []byte("9")})
+		c.WriteNoCopy([]byte("0"), func(err error) {
+			full = append(full, fmt.Sprint(c.ID(), ":", err))
+		})
+		return nil, Close
+	}
+	var closed []error
+	events.Closed = func(c Conn, err error) (action Action) {
+		if closed = append(closed, err); len(closed) == 2 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, ":10065"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "[1:4 1:<nil> 2:4 2:connection is closed] " +
+		"[<nil> write buffer is full]"
+	if got := fmt.Sprint(full, " ", closed); got != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, got)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	var events Events
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10066")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			// the server's FIN ends the read
+			data, _ := ioutil.ReadAll(conn)
+			conn.Write([]byte("bye"))
+			res <- string(data)
+		}()
+		return
+	}
+	var got []string
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		got = append(got, string(in))
+		if string(in) == "hello" {
+			c.Write([]byte("HELLO"))
+			c.CloseWrite()
+			c.Write([]byte("dropped"))
+			return []byte("!"), None
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		got = append(got, fmt.Sprint(err))
+		return Shutdown
+	}
+	if err := Serve(events, ":10066"); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-res; data != "HELLO!" {
+		t.Fatalf("expected '%s', got '%s'", "HELLO!", data)
+	}
+	if fmt.Sprint(got) != "[hello bye EOF]" {
+		t.Fatalf("expected '%s', got '%v'", "[hello bye EOF]", got)
+	}
+}
+
+func TestCloseImmediately(t *testing.T) {
+	var events Events
+	res := make(chan string, 2)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			for _, s := range []string{"close", "reset"} {
+				conn, err := net.Dial("tcp", ":10067")
+				if err != nil {
+					panic(err)
+				}
+				conn.Write([]byte(s))
+				data, err := ioutil.ReadAll(conn)
+				res <- fmt.Sprintf("%s %v", data, err != nil)
+				conn.Close()
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		c.Write([]byte("pending"))
+		c.CloseImmediately(string(in) == "reset")
+		c.Write([]byte("dropped"))
+		return
+	}
+	var closed int
+	events.Closed = func(c Conn, err error) (action Action) {
+		if closed++; closed == 2 {
+			return Shutdown
+		}
+		return
+	}
+	if err := Serve(events, ":10067"); err != nil {
+		t.Fatal(err)
+	}
+	// a reset is an error for the client
+	if got := <-res + "," + <-res; got != " false, true" {
+		t.Fatalf("expected '%s', got '%s'", " false, true", got)
+	}
+}
+
+func TestWritten(t *testing.T) {
+	var events Events
+	const total = 8 << 20
+	res := make(chan int, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10068")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("start"))
+			time.Sleep(50 * time.Millisecond)
+			n, _ := io.Copy(ioutil.Discard, conn)
+			res <- int(n)
+		}()
+		return
+	}
+	chunk := make([]byte, 64<<10)
+	var sent, written, maxBuffered int
+	send := func(c Conn) {
+		// keep a window of two chunks
+		for sent < total && c.BufferedWrite() < 2*len(chunk) {
+			c.Write(chunk)
+			sent += len(chunk)
+		}
+		if c.BufferedWrite() > maxBuffered {
+			maxBuffered = c.BufferedWrite()
+		}
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		send(c)
+		return
+	}
+	events.Written = func(c Conn, n int) (action Action) {
+		if written += n; written == total {
+			return Close
+		}
+		send(c)
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10068"); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-res; n != total || written != total {
+		t.Fatalf("expected '%d', got '%d' and '%d'", total, n, written)
+	}
+	if maxBuffered > 3*len(chunk) {
+		t.Fatalf("expected at most '%d', got '%d'", 3*len(chunk), maxBuffered)
+	}
+}
+
+func TestStream(t *testing.T) {
+	for i, edge := range []bool{false, true} {
+		testStream(t, edge, fmt.Sprintf(":%d", 10069+i))
+	}
+}
+
+func testStream(t *testing.T, edge bool, addr string) {
+	var events Events
+	events.EdgeTriggered = edge
+	const total = 4 << 20
+	res := make(chan int, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("start"))
+			n, _ := io.ReadFull(conn, make([]byte, total))
+			res <- n
+		}()
+		return
+	}
+	chunk := make([]byte, 64<<10)
+	var sent, pulls int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		c.Stream()
+		return
+	}
+	events.Writable = func(c Conn) (out []byte, more bool) {
+		pulls++
+		if c.BufferedWrite() != 0 {
+			t.Fatalf("expected '%d', got '%d'", 0, c.BufferedWrite())
+		}
+		sent += len(chunk)
+		return chunk, sent < total
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-res; n != total || pulls != total/len(chunk) {
+		t.Fatalf("expected '%d %d', got '%d %d'", total, total/len(chunk), n,
+			pulls)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "evio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<17)
+	f.Write(data)
+	f.Close()
+	res := make(chan []byte, 1)
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10071")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			b, _ := ioutil.ReadAll(conn)
+			res <- b
+		}()
+		return
+	}
+	var errs []error
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		w := NewWriter(c)
+		fmt.Fprintf(w, "%s %d\n", in, len(data))
+		f, err := os.Open(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		n, err := io.Copy(w, f)
+		if n != int64(len(data)) || err != nil {
+			t.Fatalf("expected '%d <nil>', got '%d %v'", len(data), n, err)
+		}
+		fmt.Fprintf(w, "\n")
+		// the file is read from its offset
+		f.Seek(-16, io.SeekEnd)
+		io.CopyN(w, f, 10)
+		io.Copy(w, strings.NewReader("\nreader"))
+		c.Close()
+		_, err = w.Write([]byte("closed"))
+		errs = append(errs, err)
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10071"); err != nil {
+		t.Fatal(err)
+	}
+	expect := fmt.Sprintf("hello %d\n%s\n0123456789\nreader", len(data), data)
+	if got := <-res; string(got) != expect {
+		t.Fatalf("expected '%d' bytes, got '%d'", len(expect), len(got))
+	}
+	if fmt.Sprint(errs) != "[connection is closed]" {
+		t.Fatalf("expected '[connection is closed]', got '%v'", errs)
+	}
+}
+
+func TestHijack(t *testing.T) {
+	res := make(chan string, 1)
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10072")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("CONNECT\r\nhello"))
+			b := make([]byte, 14)
+			io.ReadFull(conn, b)
+			conn.Write([]byte(" world"))
+			rest, _ := ioutil.ReadAll(conn)
+			res <- string(b) + string(rest)
+		}()
+		return
+	}
+	var wg sync.WaitGroup
+	events.Input = func(c Conn, in []byte) (n int, out []byte,
+		action Action) {
+		if !bytes.Contains(in, []byte("\r\n")) {
+			return 0, nil, None
+		}
+		c.Discard(bytes.Index(in, []byte("\r\n")) + 2)
+		nc, buffered, err := c.Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Hijack(); err != ErrConnClosed {
+			t.Fatalf("expected '%v', got '%v'", ErrConnClosed, err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer nc.Close()
+			nc.Write(append([]byte("hijacked "), buffered...))
+			b := make([]byte, 6)
+			io.ReadFull(nc, b)
+			nc.Write(b)
+		}()
+		// dropped
+		return 0, []byte("out"), None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		t.Fatal("expected no Closed event")
+		return
+	}
+	events.Tick = func(now time.Time) (delay time.Duration, action Action) {
+		if len(res) > 0 {
+			return 0, Shutdown
+		}
+		return 10 * time.Millisecond, None
+	}
+	if err := Serve(events, ":10072"); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	expect := "hijacked hello world"
+	if got := <-res; got != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, got)
+	}
+}
+
+func TestClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	opened := make(chan bool, 1)
+	res := make(chan string, 1)
+	var events Events
+	events.Clock = clock
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", ":10073")
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			<-opened
+			clock.Advance(time.Second - 1)
+			clock.Advance(1)
+			b := make([]byte, 5)
+			io.ReadFull(conn, b)
+			// idle since the write
+			clock.Advance(time.Minute)
+			rest, _ := ioutil.ReadAll(conn)
+			res <- string(b) + string(rest)
+		}()
+		return
+	}
+	var ticks []string
+	events.Tick = func(now time.Time) (delay time.Duration, action Action) {
+		ticks = append(ticks, now.Sub(start).String())
+		return 10 * time.Second, None
+	}
+	events.Opened = func(c Conn) (out []byte, action Action) {
+		c.SetIdleTimeout(time.Minute)
+		c.AfterFunc(time.Second, func() {
+			c.Write([]byte("timer"))
+		})
+		opened <- true
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	if err := Serve(events, ":10073"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-res; got != "timer" {
+		t.Fatalf("expected '%s', got '%s'", "timer", got)
+	}
+	if fmt.Sprint(ticks) != "[0s 1m1s]" {
+		t.Fatalf("expected '%s', got '%s'", "[0s 1m1s]", ticks)
+	}
+}
+
+func TestFault(t *testing.T) {
+	for i, edge := range []bool{false, true} {
+		testFault(t, edge, fmt.Sprintf(":%d", 10074+i))
+	}
+}
+
+func testFault(t *testing.T, edge bool, addr string) {
+	var events Events
+	events.EdgeTriggered = edge
+	res := make(chan string, 1)
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				panic(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("hello"))
+			b := make([]byte, 10)
+			io.ReadFull(conn, b)
+			conn.Write([]byte("reset"))
+			res <- string(b)
+		}()
+		return
+	}
+	faults := map[string][]interface{}{
+		"read":  {2, nil, syscall.EAGAIN, syscall.ECONNRESET},
+		"write": {3, syscall.EAGAIN},
+	}
+	events.Fault = func(c Conn, op string, n int) (max int, err error) {
+		if len(faults[op]) == 0 {
+			return 0, nil
+		}
+		f := faults[op][0]
+		faults[op] = faults[op][1:]
+		if err, ok := f.(error); ok {
+			return 0, err
+		}
+		if f == nil {
+			return 0, nil
+		}
+		return f.(int), nil
+	}
+	var in []string
+	var read int
+	events.Data = func(c Conn, data []byte) (out []byte, action Action) {
+		in = append(in, string(data))
+		if read += len(data); read == 5 {
+			out = []byte("0123456789")
+		}
+		return
+	}
+	var cerr error
+	events.Closed = func(c Conn, err error) (action Action) {
+		cerr = err
+		return Shutdown
+	}
+	if err := Serve(events, addr); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-res; got != "0123456789" {
+		t.Fatalf("expected '%s', got '%s'", "0123456789", got)
+	}
+	expect := "[he llo]"
+	if fmt.Sprint(in) != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, in)
+	}
+	if !errors.Is(cerr, syscall.ECONNRESET) {
+		t.Fatalf("expected '%v', got '%v'", syscall.ECONNRESET, cerr)
+	}
+	if len(faults["read"]) != 0 || len(faults["write"]) != 0 {
+		t.Fatalf("expected all faults injected, got '%v' left", faults)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package eviotest serves the events of an evio server over socketpairs, so
+// that handlers can be unit tested without binding ports. The connections
+// are real sockets rather than in-memory fakes, because a fake loop would
+// not fire all of the events the same as a server:
+//
+//	s, err := eviotest.NewServer(events)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer s.Stop()
+//	nc, err := s.Dial()
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	nc.Write([]byte("PING\r\n"))
+//
+// The events fire the same as for the stream connections of a listener,
+// and the addresses of the connections are unnamed unix addresses. Set
+// Events.Clock to an evio.ManualClock to fire the timers without sleeping.
+// The results are read from the client the same as from a network
+// connection, so waiting for an event means reading from the client or
+// from a channel that the event signals.
+package eviotest
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	evio "github.com/tidwall/evio-lite"
+)
+
+// Server is an evio server without listeners, whose connections are added
+// with Dial.
+type Server struct {
+	evio.Server
+}
+
+// NewServer starts a server for the events. Stop it once the test is done.
+func NewServer(events evio.Events) (*Server, error) {
+	s, err := evio.Start(events)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{*s}, nil
+}
+
+// Dial connects a client to the server through a socketpair, and returns
+// the client end once the Opened event of the server end has returned.
+func (s *Server) Dial() (net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	var aerr error
+	if !s.Do(func() { _, aerr = s.Attach(fds[1]) }) {
+		aerr = evio.ErrShutdown
+	}
+	if aerr != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, aerr
+	}
+	f := os.NewFile(uintptr(fds[0]), "eviotest")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// Do calls fn on the loop goroutine and returns once it has returned, so
+// that the state of the handlers can be checked without a data race.
+// Returns false if the server stopped before calling fn.
+func (s *Server) Do(fn func()) bool {
+	done := make(chan struct{})
+	if !s.Execute(func() {
+		defer close(done)
+		fn()
+	}) {
+		return false
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-stopped:
+		// fn may have been the last job of the loop
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+}
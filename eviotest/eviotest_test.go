@@ -0,0 +1,135 @@
+package eviotest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	evio "github.com/tidwall/evio-lite"
+	"github.com/tidwall/evio-lite/codec"
+)
+
+func recv(t *testing.T, nc net.Conn, expect string) {
+	b := make([]byte, len(expect))
+	if _, err := io.ReadFull(nc, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, b)
+	}
+}
+
+func TestConn(t *testing.T) {
+	var events evio.Events
+	var log []string
+	closed := make(chan bool, 2)
+	clock := evio.NewManualClock(time.Now())
+	events.Clock = clock
+	events.Opened = func(c evio.Conn) (out []byte, action evio.Action) {
+		c.AfterFunc(time.Second, func() { c.Write([]byte("tick\n")) })
+		return []byte("hello\n"), evio.None
+	}
+	events.Data = func(c evio.Conn, in []byte) (out []byte,
+		action evio.Action) {
+		if string(in) == "quit\n" {
+			return []byte("bye\n"), evio.Close
+		}
+		return in, evio.None
+	}
+	events.Closed = func(c evio.Conn, err error) (action evio.Action) {
+		log = append(log, fmt.Sprint("closed ", err))
+		closed <- true
+		return evio.None
+	}
+	s, err := NewServer(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	nc, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	recv(t, nc, "hello\n")
+	clock.Advance(time.Second - 1)
+	// the tick would come before the echo
+	nc.Write([]byte("ping\n"))
+	recv(t, nc, "ping\n")
+	clock.Advance(1)
+	recv(t, nc, "tick\n")
+	nc.Write([]byte("quit\n"))
+	recv(t, nc, "bye\n")
+	if b, _ := ioutil.ReadAll(nc); len(b) != 0 {
+		t.Fatalf("expected '', got '%s'", b)
+	}
+	nc, err = s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv(t, nc, "hello\n")
+	nc.Close()
+	<-closed
+	<-closed
+	var got string
+	s.Do(func() { got = fmt.Sprint(log) })
+	expect := fmt.Sprint([]string{"closed <nil>", "closed EOF"})
+	if got != expect {
+		t.Fatalf("expected '%s', got '%s'", expect, got)
+	}
+	s.Stop()
+	if _, err := s.Dial(); err != evio.ErrShutdown {
+		t.Fatalf("expected '%v', got '%v'", evio.ErrShutdown, err)
+	}
+}
+
+func TestInput(t *testing.T) {
+	var events evio.Events
+	events.NewCodec = func() evio.Codec {
+		return &codec.Delimiter{Delim: []byte("\n")}
+	}
+	events.Data = func(c evio.Conn, in []byte) (out []byte,
+		action evio.Action) {
+		if string(in) == "CONNECT" {
+			c.SetCodec(nil)
+			return []byte("OK"), evio.None
+		}
+		return append([]byte("echo "), in...), evio.None
+	}
+	events.Input = func(c evio.Conn, in []byte) (n int, out []byte,
+		action evio.Action) {
+		if len(in) < 4 {
+			return 0, nil, evio.None
+		}
+		c.Discard(4)
+		nc, buffered, err := c.Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			nc.Write(buffered)
+			nc.Close()
+		}()
+		return 0, nil, evio.None
+	}
+	s, err := NewServer(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	nc, err := s.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.Write([]byte("hi\nCONNECT\n"))
+	recv(t, nc, "echo hi\nOK")
+	nc.Write([]byte("abcdef"))
+	b, _ := ioutil.ReadAll(nc)
+	if string(b) != "ef" {
+		t.Fatalf("expected '%s', got '%s'", "ef", b)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import "time"
+
+// EventHandler is an alternative to Events for handling server events with
+// methods instead of funcs. Embed BuiltinEventHandler to only implement the
+// events that are needed.
+type EventHandler interface {
+	// OnBoot fires when the server can accept connections.
+	OnBoot(server Server) (action Action)
+	// OnOpen fires when a new connection has opened.
+	OnOpen(c Conn) (out []byte, action Action)
+	// OnClose fires when a connection has closed, with the reason it closed.
+	OnClose(c Conn, err error) (action Action)
+	// OnData fires when a connection sends the server data.
+	OnData(c Conn, in []byte) (out []byte, action Action)
+	// OnTick fires immediately after the server starts and will fire again
+	// following the duration specified by the delay return value.
+	OnTick(now time.Time) (delay time.Duration, action Action)
+}
+
+// BuiltinEventHandler is an EventHandler that does nothing.
+type BuiltinEventHandler struct{}
+
+// OnBoot does nothing.
+func (BuiltinEventHandler) OnBoot(server Server) (action Action) {
+	return None
+}
+
+// OnOpen does nothing.
+func (BuiltinEventHandler) OnOpen(c Conn) (out []byte, action Action) {
+	return nil, None
+}
+
+// OnClose does nothing.
+func (BuiltinEventHandler) OnClose(c Conn, err error) (action Action) {
+	return None
+}
+
+// OnData does nothing.
+func (BuiltinEventHandler) OnData(c Conn, in []byte) (out []byte,
+	action Action) {
+	return nil, None
+}
+
+// OnTick does nothing, and asks to be called again in one second.
+func (BuiltinEventHandler) OnTick(now time.Time) (delay time.Duration,
+	action Action) {
+	return time.Second, None
+}
+
+// HandlerEvents returns Events that call the methods of h. The other
+// Events fields may be set before passing the result to Serve, and Tick
+// may be set to nil when h doesn't need ticks.
+func HandlerEvents(h EventHandler) Events {
+	return Events{
+		Serving: h.OnBoot,
+		Opened:  h.OnOpen,
+		Closed:  h.OnClose,
+		Data:    h.OnData,
+		Tick:    h.OnTick,
+	}
+}
+
+// ServeHandler is like Serve, but with an EventHandler.
+func ServeHandler(h EventHandler, addr ...string) error {
+	return Serve(HandlerEvents(h), addr...)
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package metrics exports the counters of an evio server to expvar and to
+// Prometheus:
+//
+//	expvar.Publish("evio", metrics.Map(s))
+//	http.Handle("/metrics", metrics.Handler(s))
+//
+// The server is the one passed to the Serving event, or returned by
+// evio.Start. The counters are read each time they are exported.
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+
+	evio "github.com/tidwall/evio-lite"
+)
+
+// metric is an exported counter of evio.Metrics.
+type metric struct {
+	name  string // Prometheus name, the expvar name drops the prefix
+	typ   string // Prometheus type
+	help  string
+	value func(m evio.Metrics) float64
+}
+
+var metrics = []metric{
+	{"evio_accepted_connections_total", "counter", "Connections opened.",
+		func(m evio.Metrics) float64 { return float64(m.Accepted) }},
+	{"evio_closed_connections_total", "counter", "Connections closed.",
+		func(m evio.Metrics) float64 { return float64(m.Closed) }},
+	{"evio_open_connections", "gauge", "Connections open now.",
+		func(m evio.Metrics) float64 { return float64(m.Open) }},
+	{"evio_read_bytes_total", "counter", "Bytes read.",
+		func(m evio.Metrics) float64 { return float64(m.BytesRead) }},
+	{"evio_written_bytes_total", "counter", "Bytes written.",
+		func(m evio.Metrics) float64 { return float64(m.BytesWritten) }},
+	{"evio_loop_iterations_total", "counter", "Wakeups of the event loop.",
+		func(m evio.Metrics) float64 { return float64(m.Iterations) }},
+	{"evio_poll_wait_seconds_total", "counter",
+		"Time the event loop spent waiting for events.",
+		func(m evio.Metrics) float64 { return m.WaitTime.Seconds() }},
+	{"evio_loop_busy_seconds_total", "counter",
+		"Time the event loop spent handling events.",
+		func(m evio.Metrics) float64 { return m.BusyTime.Seconds() }},
+	{"evio_writing_connections", "gauge",
+		"Connections waiting to write their output.",
+		func(m evio.Metrics) float64 { return float64(m.Writing) }},
+	{"evio_queued_bytes", "gauge",
+		"Bytes of output waiting to be written.",
+		func(m evio.Metrics) float64 { return float64(m.Queued) }},
+}
+
+// Map returns an expvar map of the server counters, such as
+// "accepted_connections_total", for expvar.Publish.
+func Map(s evio.Server) *expvar.Map {
+	m := new(expvar.Map).Init()
+	for _, mt := range metrics {
+		mt := mt
+		m.Set(mt.name[len("evio_"):], expvar.Func(func() interface{} {
+			return mt.value(s.Metrics())
+		}))
+	}
+	return m
+}
+
+// Handler returns an HTTP handler that writes the server counters in the
+// Prometheus text format.
+func Handler(s evio.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(Append(nil, s.Metrics()))
+	})
+}
+
+// Append appends the counters to dst in the Prometheus text format.
+func Append(dst []byte, m evio.Metrics) []byte {
+	for _, mt := range metrics {
+		dst = append(dst, "# HELP "+mt.name+" "+mt.help+"\n"...)
+		dst = append(dst, "# TYPE "+mt.name+" "+mt.typ+"\n"...)
+		dst = append(dst, mt.name+" "...)
+		dst = strconv.AppendFloat(dst, mt.value(m), 'g', -1, 64)
+		dst = append(dst, '\n')
+	}
+	return dst
+}
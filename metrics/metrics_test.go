@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"expvar"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	evio "github.com/tidwall/evio-lite"
+)
+
+func TestAppend(t *testing.T) {
+	b := Append([]byte("x\n"), evio.Metrics{Accepted: 3,
+		WaitTime: 1500 * time.Millisecond})
+	for _, line := range []string{
+		"x",
+		"# TYPE evio_accepted_connections_total counter",
+		"evio_accepted_connections_total 3",
+		"evio_poll_wait_seconds_total 1.5",
+		"evio_open_connections 0",
+		"# TYPE evio_queued_bytes gauge",
+	} {
+		if !strings.Contains("\n"+string(b), "\n"+line+"\n") {
+			t.Fatalf("expected '%s' in '%s'", line, b)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	var events evio.Events
+	events.Data = func(c evio.Conn, in []byte) (out []byte,
+		action evio.Action) {
+		return in, evio.None
+	}
+	s, err := evio.Start(events, ":10054")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	conn, err := net.Dial("tcp", ":10054")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	conn.Read(make([]byte, 5))
+	m := Map(*s)
+	if v := m.Get("read_bytes_total").(expvar.Func).Value(); v != 5.0 {
+		t.Fatalf("expected '%v', got '%v'", 5.0, v)
+	}
+	w := httptest.NewRecorder()
+	Handler(*s).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "\nevio_open_connections 1\n") {
+		t.Fatalf("unexpected body '%s'", w.Body.String())
+	}
+}
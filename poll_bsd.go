@@ -7,68 +7,350 @@
 package evio
 
 import (
+	"os"
+	"runtime"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 type poll struct {
 	fd      int
+	pipe    [2]int // pipe for waking the poll
+	edge    bool   // add events with EV_CLEAR
+	armed   bool   // the EVFILT_TIMER is added
 	changes []syscall.Kevent_t
 	events  []syscall.Kevent_t
 	evfds   []int
 }
 
-func newPoll() *poll {
+func newPoll(edge bool) (*poll, error) {
 	fd, err := syscall.Kqueue()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	syscall.CloseOnExec(fd)
 	p := new(poll)
 	p.fd = fd
+	p.edge = edge
 	p.events = make([]syscall.Kevent_t, 64)
 	p.evfds = make([]int, 0, len(p.evfds))
 	p.changes = make([]syscall.Kevent_t, 0, len(p.evfds))
-	return p
+	if err := syscall.Pipe(p.pipe[:]); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	for _, fd := range p.pipe {
+		syscall.CloseOnExec(fd)
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+	p.addRead(p.pipe[0])
+	return p, nil
 }
 
-func (p *poll) addRead(fd int) {
-	p.changes = append(p.changes, syscall.Kevent_t{Ident: uint64(fd),
-		Flags: syscall.EV_ADD, Filter: syscall.EVFILT_READ})
+func (p *poll) close() {
+	syscall.Close(p.pipe[0])
+	syscall.Close(p.pipe[1])
+	syscall.Close(p.fd)
 }
 
-func (p *poll) modReadWrite(fd int) {
-	p.changes = append(p.changes, syscall.Kevent_t{Ident: uint64(fd),
-		Flags: syscall.EV_ADD, Filter: syscall.EVFILT_WRITE})
+// trigger wakes the poll. It's safe to call from any goroutine.
+func (p *poll) trigger() {
+	syscall.Write(p.pipe[1], []byte{0})
+}
+
+// Changes are queued and applied by the next wait. A change that fails is
+// returned by kevent as an EV_ERROR event, which wait skips, so the poll
+// modifiers never return an error.
+
+func (p *poll) addRead(fd int) error {
+	ev := syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_ADD,
+		Filter: syscall.EVFILT_READ}
+	if p.edge {
+		ev.Flags |= syscall.EV_CLEAR
+	}
+	p.changes = append(p.changes, ev)
+	return nil
 }
 
-func (p *poll) modRead(fd int) {
+func (p *poll) modReadWrite(fd int) error {
+	ev := syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_ADD,
+		Filter: syscall.EVFILT_WRITE}
+	if p.edge {
+		ev.Flags |= syscall.EV_CLEAR
+	}
+	p.changes = append(p.changes, ev)
+	return nil
+}
+
+func (p *poll) modRead(fd int) error {
 	p.changes = append(p.changes, syscall.Kevent_t{Ident: uint64(fd),
 		Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_WRITE})
+	return nil
 }
 
-// A negative timout is forever.
-func (p *poll) wait(timeout time.Duration) []int {
+// modPaused stops read events for fd, leaving write events when write is
+// true.
+func (p *poll) modPaused(fd int, write bool) error {
+	p.changes = append(p.changes, syscall.Kevent_t{Ident: uint64(fd),
+		Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_READ})
+	if write {
+		return p.modReadWrite(fd)
+	}
+	return p.modRead(fd)
+}
+
+// modResumed restarts read events for fd, adding write events when write is
+// true.
+func (p *poll) modResumed(fd int, write bool) error {
+	p.addRead(fd)
+	if write {
+		return p.modReadWrite(fd)
+	}
+	return p.modRead(fd)
+}
+
+func (p *poll) del(fd int) error {
+	p.changes = append(p.changes,
+		syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_DELETE,
+			Filter: syscall.EVFILT_READ},
+		syscall.Kevent_t{Ident: uint64(fd), Flags: syscall.EV_DELETE,
+			Filter: syscall.EVFILT_WRITE},
+	)
+	return nil
+}
+
+// timerUnit returns the finest unit of EVFILT_TIMER data and the fflags that
+// select it. Darwin and FreeBSD take nanoseconds, the others only take
+// milliseconds.
+func timerUnit() (time.Duration, uint32) {
+	switch runtime.GOOS {
+	case "darwin":
+		return time.Nanosecond, 0x4 // NOTE_NSECONDS
+	case "freebsd":
+		return time.Nanosecond, 0x8 // NOTE_NSECONDS
+	}
+	return time.Millisecond, 0
+}
+
+// setTimer queues a one-shot EVFILT_TIMER that fires after d, or deletes
+// the timer when d is zero. The timer's ident is the kqueue fd, which
+// can't be the ident of any other event.
+func (p *poll) setTimer(d time.Duration) {
+	ev := syscall.Kevent_t{Ident: uint64(p.fd), Flags: syscall.EV_DELETE,
+		Filter: syscall.EVFILT_TIMER}
+	if d > 0 {
+		unit, fflags := timerUnit()
+		ev.Flags = syscall.EV_ADD | syscall.EV_ONESHOT
+		ev.Fflags = fflags
+		// round up, a timer must not fire early
+		ev.Data = int64((d + unit - 1) / unit)
+	}
+	p.changes = append(p.changes, ev)
+	p.armed = d > 0
+}
+
+// A negative timout is forever. A positive timeout is kept by an
+// EVFILT_TIMER.
+func (p *poll) wait(timeout time.Duration) ([]int, error) {
+	if timeout > 0 || p.armed {
+		p.setTimer(timeout)
+	}
 	var n int
 	var err error
-	if timeout >= 0 {
+	if timeout == 0 {
 		var ts syscall.Timespec
-		ts.Nsec = int64(timeout)
 		n, err = syscall.Kevent(p.fd, p.changes, p.events, &ts)
 	} else {
 		n, err = syscall.Kevent(p.fd, p.changes, p.events, nil)
 	}
 	if err != nil && err != syscall.EINTR {
-		panic(err)
+		return nil, os.NewSyscallError("kevent", err)
 	}
 	p.changes = p.changes[:0]
 	p.evfds = p.evfds[:0]
 	for i := 0; i < n; i++ {
-		p.evfds = append(p.evfds, int(p.events[i].Ident))
+		if p.events[i].Flags&syscall.EV_ERROR != 0 {
+			// failed change, such as deleting a missing filter
+			continue
+		}
+		if p.events[i].Filter == syscall.EVFILT_TIMER {
+			p.armed = false
+			continue
+		}
+		fd := int(p.events[i].Ident)
+		if fd == p.pipe[0] {
+			var data [64]byte
+			for {
+				n, _ := syscall.Read(p.pipe[0], data[:])
+				if n < len(data) {
+					break
+				}
+			}
+			continue
+		}
+		p.evfds = append(p.evfds, fd)
 	}
-	return p.evfds
+	return p.evfds, nil
 }
 
-func setKeepAlive(fd, secs int) error {
-	// just rely on system tcp keep alives
-	return nil
+func setKeepAlive(fd int, idle, intvl time.Duration, cnt int) error {
+	// the options are numbered differently on each system, and are mostly
+	// missing from the syscall package
+	switch runtime.GOOS {
+	case "darwin":
+		// TCP_KEEPALIVE is the idle time
+		return setKeepAliveOpts(fd, idle, intvl, cnt, 0x10, 0x101, 0x102)
+	case "freebsd", "dragonfly":
+		return setKeepAliveOpts(fd, idle, intvl, cnt, 0x100, 0x200, 0x400)
+	case "netbsd":
+		return setKeepAliveOpts(fd, idle, intvl, cnt, 0x3, 0x5, 0x6)
+	}
+	// openbsd only has the system-wide timings
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE,
+		1)
+}
+
+const hasUserTimeout = false
+
+func setUserTimeout(fd int, d time.Duration) error {
+	// TCP_USER_TIMEOUT is linux only
+	return syscall.ENOPROTOOPT
+}
+
+func setQuickAck(fd int, quickAck bool) error {
+	// TCP_QUICKACK is linux only
+	return syscall.ENOPROTOOPT
+}
+
+func setDeferAccept(fd int, d time.Duration) error {
+	switch runtime.GOOS {
+	case "freebsd", "netbsd":
+		// SO_ACCEPTFILTER takes a struct accept_filter_arg, which is the
+		// filter name padded to 16 bytes and an argument of 240 bytes
+		var arg [256]byte
+		copy(arg[:], "dataready")
+		return syscall.SetsockoptString(fd, syscall.SOL_SOCKET, 0x1000,
+			string(arg[:]))
+	}
+	return syscall.ENOPROTOOPT
+}
+
+const hasBusyPoll = false
+
+func setBusyPoll(fd int, d time.Duration) error {
+	// SO_BUSY_POLL is linux only
+	return syscall.ENOPROTOOPT
+}
+
+func setPriority(fd, prio int) error {
+	// SO_PRIORITY is linux only
+	return syscall.ENOPROTOOPT
+}
+
+func setFreebind(fd int, v6 bool) error {
+	// IP_BINDANY allows both
+	return setTransparent(fd, v6)
+}
+
+func setTransparent(fd int, v6 bool) error {
+	if runtime.GOOS != "freebsd" {
+		return syscall.ENOPROTOOPT
+	}
+	if v6 {
+		// IPV6_BINDANY
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, 0x40, 1)
+	}
+	// IP_BINDANY
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, 0x18, 1)
+}
+
+func originalDst(fd int) (syscall.Sockaddr, error) {
+	// pf and ipfw keep the original destination as the local address
+	return nil, syscall.ENOPROTOOPT
+}
+
+func getTCPInfo(fd int) (TCPInfo, error) {
+	// the structs aren't in the syscall package, so the fields are read
+	// at their offsets
+	var b [256]byte
+	u32 := func(off int) uint32 {
+		return *(*uint32)(unsafe.Pointer(&b[off]))
+	}
+	var opt uintptr
+	switch runtime.GOOS {
+	case "freebsd":
+		opt = 0x20 // TCP_INFO
+	case "darwin":
+		opt = 0x106 // TCP_CONNECTION_INFO
+	default:
+		return TCPInfo{}, syscall.ENOPROTOOPT
+	}
+	size := uint32(len(b))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
+		syscall.IPPROTO_TCP, opt, uintptr(unsafe.Pointer(&b[0])),
+		uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return TCPInfo{}, errno
+	}
+	if runtime.GOOS == "darwin" {
+		// struct tcp_connection_info, times in milliseconds
+		info := TCPInfo{
+			RTT:    time.Duration(u32(44)) * time.Millisecond,
+			RTTVar: time.Duration(u32(48)) * time.Millisecond,
+			RTO:    time.Duration(u32(12)) * time.Millisecond,
+			MSS:    u32(16),
+			Cwnd:   u32(24),
+		}
+		if info.MSS > 0 {
+			// only the retransmitted bytes are counted
+			rexmit := *(*uint64)(unsafe.Pointer(&b[72]))
+			info.Retransmits = uint32(rexmit / uint64(info.MSS))
+		}
+		return info, nil
+	}
+	// struct tcp_info, times in microseconds
+	return TCPInfo{
+		RTT:         time.Duration(u32(68)) * time.Microsecond,
+		RTTVar:      time.Duration(u32(72)) * time.Microsecond,
+		RTO:         time.Duration(u32(8)) * time.Microsecond,
+		MSS:         u32(16),
+		Cwnd:        u32(80),
+		Retransmits: u32(120),
+	}, nil
+}
+
+func bindToDevice(fd int, ifname string) error {
+	// SO_BINDTODEVICE is linux only
+	return syscall.ENOPROTOOPT
+}
+
+func setReusePort(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEPORT,
+		1)
+}
+
+func newPipe() ([2]int, error) {
+	// splice(2) is linux only, so Pipe copies the data in the loop
+	return [2]int{}, syscall.ENOSYS
+}
+
+func splice(rfd, wfd, n int) (int, error) {
+	return 0, syscall.ENOSYS
+}
+
+func canSendFile() bool {
+	// openbsd and netbsd don't have sendfile(2)
+	switch runtime.GOOS {
+	case "darwin", "freebsd", "dragonfly":
+		return true
+	}
+	return false
+}
+
+func sendfile(dst, src int, off *int64, n int) (int, error) {
+	return syscall.Sendfile(dst, src, off, n)
 }
@@ -7,87 +7,331 @@
 package evio
 
 import (
+	"fmt"
+	"os"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 type poll struct {
 	fd     int
+	wfd    int    // eventfd for waking the poll
+	tfd    int    // timerfd for timeouts finer than a millisecond
+	armed  bool   // tfd is set
+	flags  uint32 // added to every event, such as EPOLLET
 	events []syscall.EpollEvent
 	evfds  []int
 }
 
-func newPoll() *poll {
-	fd, err := syscall.EpollCreate1(0)
+func newPoll(edge bool) (*poll, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	p := new(poll)
 	p.fd = fd
+	if edge {
+		p.flags = syscall.EPOLLET & 0xffffffff
+	}
 	p.events = make([]syscall.EpollEvent, 64)
 	p.evfds = make([]int, 0, len(p.evfds))
-	return p
+	r0, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0,
+		syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+	p.wfd = int(r0)
+	// CLOCK_MONOTONIC, TFD_NONBLOCK|TFD_CLOEXEC
+	r0, _, errno = syscall.Syscall(syscall.SYS_TIMERFD_CREATE, 1,
+		syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		syscall.Close(p.wfd)
+		syscall.Close(fd)
+		return nil, errno
+	}
+	p.tfd = int(r0)
+	if err := p.addRead(p.wfd); err != nil {
+		p.close()
+		return nil, err
+	}
+	// the timerfd is level-triggered, even in edge mode, and wait reads it
+	// every time it fires
+	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, p.tfd,
+		&syscall.EpollEvent{Fd: int32(p.tfd), Events: syscall.EPOLLIN},
+	); err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *poll) close() {
+	syscall.Close(p.tfd)
+	syscall.Close(p.wfd)
+	syscall.Close(p.fd)
+}
+
+// itimerspec is the struct for timerfd_settime, which is missing from the
+// syscall package.
+type itimerspec struct {
+	interval syscall.Timespec
+	value    syscall.Timespec
 }
 
-func (p *poll) addRead(fd int) {
-	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
+// setTimer arms the timerfd to fire once after d, or disarms it when d is
+// zero.
+func (p *poll) setTimer(d time.Duration) error {
+	var spec itimerspec
+	spec.value = syscall.NsecToTimespec(int64(d))
+	_, _, errno := syscall.Syscall6(syscall.SYS_TIMERFD_SETTIME,
+		uintptr(p.tfd), 0, uintptr(unsafe.Pointer(&spec)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	p.armed = d > 0
+	return nil
+}
+
+// trigger wakes the poll. It's safe to call from any goroutine.
+func (p *poll) trigger() {
+	syscall.Write(p.wfd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+}
+
+func (p *poll) addRead(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
-			Events: syscall.EPOLLIN,
+			Events: syscall.EPOLLIN | p.flags,
 		},
-	); err != nil {
-		panic(err)
-	}
+	)
 }
 
-func (p *poll) modReadWrite(fd int) {
-	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+func (p *poll) modReadWrite(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
-			Events: syscall.EPOLLIN | syscall.EPOLLOUT,
+			Events: syscall.EPOLLIN | syscall.EPOLLOUT | p.flags,
 		},
-	); err != nil {
-		panic(err)
-	}
+	)
 }
 
-func (p *poll) modRead(fd int) {
-	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+func (p *poll) modRead(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
-			Events: syscall.EPOLLIN,
+			Events: syscall.EPOLLIN | p.flags,
 		},
-	); err != nil {
-		panic(err)
+	)
+}
+
+// modPaused stops read events for fd, leaving write events when write is
+// true.
+func (p *poll) modPaused(fd int, write bool) error {
+	events := p.flags
+	if write {
+		events |= syscall.EPOLLOUT
 	}
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+		&syscall.EpollEvent{Fd: int32(fd), Events: events})
+}
+
+// modResumed restarts read events for fd, adding write events when write is
+// true.
+func (p *poll) modResumed(fd int, write bool) error {
+	if write {
+		return p.modReadWrite(fd)
+	}
+	return p.modRead(fd)
+}
+
+func (p *poll) del(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd,
+		nil)
 }
 
-// A negative timout is forever.
-func (p *poll) wait(timeout time.Duration) []int {
-	var n int
-	var err error
-	if timeout >= 0 {
-		n, err = syscall.EpollWait(p.fd, p.events,
-			int(timeout/time.Millisecond))
-	} else {
-		n, err = syscall.EpollWait(p.fd, p.events, -1)
+// A negative timout is forever. A positive timeout is kept by the timerfd,
+// because epoll_wait only counts whole milliseconds.
+func (p *poll) wait(timeout time.Duration) ([]int, error) {
+	if timeout > 0 {
+		if err := p.setTimer(timeout); err != nil {
+			return nil, os.NewSyscallError("timerfd_settime", err)
+		}
+	} else if p.armed {
+		if err := p.setTimer(0); err != nil {
+			return nil, os.NewSyscallError("timerfd_settime", err)
+		}
 	}
+	msec := -1
+	if timeout == 0 {
+		msec = 0
+	}
+	n, err := syscall.EpollWait(p.fd, p.events, msec)
 	if err != nil && err != syscall.EINTR {
-		panic(err)
+		return nil, os.NewSyscallError("epoll_wait", err)
 	}
 	p.evfds = p.evfds[:0]
 	for i := 0; i < n; i++ {
-		p.evfds = append(p.evfds, int(p.events[i].Fd))
+		fd := int(p.events[i].Fd)
+		if fd == p.wfd || fd == p.tfd {
+			var data [8]byte
+			syscall.Read(fd, data[:])
+			if fd == p.tfd {
+				p.armed = false
+			}
+			continue
+		}
+		p.evfds = append(p.evfds, fd)
+	}
+	return p.evfds, nil
+}
+
+func setKeepAlive(fd int, idle, intvl time.Duration, cnt int) error {
+	return setKeepAliveOpts(fd, idle, intvl, cnt, syscall.TCP_KEEPIDLE,
+		syscall.TCP_KEEPINTVL, syscall.TCP_KEEPCNT)
+}
+
+// hasUserTimeout is true where TCP_USER_TIMEOUT is supported.
+const hasUserTimeout = true
+
+func setUserTimeout(fd int, d time.Duration) error {
+	// TCP_USER_TIMEOUT is missing from the syscall package
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, 0x12,
+		int(d/time.Millisecond))
+}
+
+func setQuickAck(fd int, quickAck bool) error {
+	var v int
+	if quickAck {
+		v = 1
+	}
+	// TCP_QUICKACK is missing from the syscall package
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, 0xc, v)
+}
+
+func setDeferAccept(fd int, d time.Duration) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP,
+		syscall.TCP_DEFER_ACCEPT, int((d+time.Second-1)/time.Second))
+}
+
+// hasBusyPoll is true where SO_BUSY_POLL is supported.
+const hasBusyPoll = true
+
+func setBusyPoll(fd int, d time.Duration) error {
+	// SO_BUSY_POLL is missing from the syscall package
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, 0x2e,
+		int(d/time.Microsecond))
+}
+
+func setPriority(fd, prio int) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PRIORITY,
+		prio)
+}
+
+func setFreebind(fd int, v6 bool) error {
+	// IP_FREEBIND applies to IPv6 sockets as well
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_FREEBIND,
+		1)
+}
+
+func setTransparent(fd int, v6 bool) error {
+	if v6 {
+		// IPV6_TRANSPARENT is missing from the syscall package
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, 0x4b, 1)
 	}
-	return p.evfds
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP,
+		syscall.IP_TRANSPARENT, 1)
 }
 
-func setKeepAlive(fd, secs int) error {
-	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET,
-		syscall.SO_KEEPALIVE, 1); err != nil {
-		return err
+// originalDst returns the destination of a connection before netfilter
+// redirected it, using SO_ORIGINAL_DST. It fails for connections that were
+// not redirected with NAT.
+func originalDst(fd int) (syscall.Sockaddr, error) {
+	level := syscall.SOL_IP
+	if sa, err := syscall.Getsockname(fd); err != nil {
+		return nil, err
+	} else if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		level = syscall.SOL_IPV6
 	}
-	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP,
-		syscall.TCP_KEEPINTVL, secs); err != nil {
-		return err
+	// the same option for IPv4 and IPv6 (IP6T_SO_ORIGINAL_DST)
+	const soOriginalDst = 0x50
+	// the buffer of IPv6MTUInfo starts with a sockaddr_in6, which is big
+	// enough for either, and unlike a raw getsockopt it builds on 386
+	mi, err := syscall.GetsockoptIPv6MTUInfo(fd, level, soOriginalDst)
+	if err != nil {
+		return nil, err
 	}
-	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE,
-		secs)
+	rsa := &mi.Addr
+	pb := (*[2]byte)(unsafe.Pointer(&rsa.Port))
+	port := int(pb[0])<<8 | int(pb[1])
+	if rsa.Family == syscall.AF_INET {
+		rsa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		return &syscall.SockaddrInet4{Port: port, Addr: rsa4.Addr}, nil
+	}
+	return &syscall.SockaddrInet6{Port: port, ZoneId: rsa.Scope_id,
+		Addr: rsa.Addr}, nil
+}
+
+// tcpInfo is the start of struct tcp_info. The kernel fills as much of it
+// as it knows, so the fields that an old kernel lacks stay zero.
+type tcpInfo struct {
+	syscall.TCPInfo
+	pacingRate uint64
+}
+
+func getTCPInfo(fd int) (TCPInfo, error) {
+	var ti tcpInfo
+	if err := getsockoptTCPInfo(fd, &ti); err != nil {
+		return TCPInfo{}, err
+	}
+	info := TCPInfo{
+		RTT:         time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar:      time.Duration(ti.Rttvar) * time.Microsecond,
+		RTO:         time.Duration(ti.Rto) * time.Microsecond,
+		MSS:         ti.Snd_mss,
+		Cwnd:        ti.Snd_cwnd * ti.Snd_mss, // in segments
+		Retransmits: ti.Total_retrans,
+	}
+	if ti.pacingRate != ^uint64(0) {
+		// all ones is no pacing
+		info.PacingRate = ti.pacingRate
+	}
+	return info, nil
+}
+
+func bindToDevice(fd int, ifname string) error {
+	if len(ifname) >= syscall.IFNAMSIZ {
+		return fmt.Errorf("interface name %q is longer than %d bytes",
+			ifname, syscall.IFNAMSIZ-1)
+	}
+	return syscall.BindToDevice(fd, ifname)
+}
+
+func setReusePort(fd int) error {
+	// SO_REUSEPORT is missing from the syscall package on linux
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, 0xf, 1)
+}
+
+// newPipe returns a nonblocking pipe for splicing between sockets.
+func newPipe() ([2]int, error) {
+	var p [2]int
+	err := syscall.Pipe2(p[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	return p, err
+}
+
+// splice moves up to n bytes from rfd to wfd without copying them to user
+// space. One of the fds must be a pipe.
+func splice(rfd, wfd, n int) (int, error) {
+	// SPLICE_F_MOVE|SPLICE_F_NONBLOCK, which are missing from the syscall
+	// package
+	m, err := syscall.Splice(rfd, nil, wfd, nil, n, 0x1|0x2)
+	return int(m), err
+}
+
+func canSendFile() bool {
+	return true
+}
+
+// sendfile writes up to n bytes of the file src, from the offset, to the
+// socket dst without copying them to user space.
+func sendfile(dst, src int, off *int64, n int) (int, error) {
+	return syscall.Sendfile(dst, src, off, n)
 }
@@ -0,0 +1,84 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+// ring is a growable ring buffer for the output of a connection. Written
+// data is discarded from the front, so the buffer is reused without
+// moving the rest of the data.
+type ring struct {
+	buf  []byte // allocated with Events.alloc
+	head int    // index of the first byte
+	n    int    // number of bytes
+}
+
+// write appends data, growing the buffer when it's full. A new buffer is at
+// least size bytes.
+func (r *ring) write(events *Events, size int, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if r.n+len(data) > len(r.buf) {
+		r.grow(events, size, r.n+len(data))
+	}
+	tail := (r.head + r.n) % len(r.buf)
+	m := copy(r.buf[tail:], data)
+	copy(r.buf, data[m:])
+	r.n += len(data)
+}
+
+// grow moves the data to the front of a new buffer with room for need
+// bytes, doubling the size of the old one.
+func (r *ring) grow(events *Events, size, need int) {
+	if size < len(r.buf)*2 {
+		size = len(r.buf) * 2
+	}
+	if size < need {
+		size = need
+	}
+	buf := events.alloc(size)
+	buf = buf[:cap(buf)]
+	a, b := r.bufs()
+	copy(buf[copy(buf, a):], b)
+	events.free(r.buf)
+	r.buf = buf
+	r.head = 0
+}
+
+// bufs returns the data, which is in two parts when it wraps around the
+// end of the buffer.
+func (r *ring) bufs() (a, b []byte) {
+	if r.n == 0 {
+		return nil, nil
+	}
+	end := r.head + r.n
+	if end <= len(r.buf) {
+		return r.buf[r.head:end], nil
+	}
+	return r.buf[r.head:], r.buf[:end-len(r.buf)]
+}
+
+// discard removes n bytes from the front.
+func (r *ring) discard(n int) {
+	r.n -= n
+	if r.n == 0 {
+		// start over at the front, so small writes don't wrap
+		r.head = 0
+	} else {
+		r.head = (r.head + n) % len(r.buf)
+	}
+}
+
+// release frees the buffer if it's empty and larger than max bytes.
+func (r *ring) release(events *Events, max int) {
+	if r.n == 0 && len(r.buf) > max {
+		r.free(events)
+	}
+}
+
+// free frees the buffer and its data.
+func (r *ring) free(events *Events) {
+	events.free(r.buf)
+	*r = ring{}
+}
@@ -0,0 +1,25 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux,!386
+
+package evio
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getsockoptTCPInfo reads TCP_INFO into ti, which is longer than the
+// syscall.TCPInfo of syscall.GetsockoptTCPInfo.
+func getsockoptTCPInfo(fd int, ti *tcpInfo) error {
+	size := uint32(unsafe.Sizeof(*ti))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
+		syscall.IPPROTO_TCP, syscall.TCP_INFO, uintptr(unsafe.Pointer(ti)),
+		uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux,386
+
+package evio
+
+import "syscall"
+
+// getsockoptTCPInfo fails on linux/386, which reaches getsockopt only
+// through socketcall, and the syscall package has no wrapper for a struct
+// as large as tcp_info.
+func getsockoptTCPInfo(fd int, ti *tcpInfo) error {
+	return syscall.ENOPROTOOPT
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"container/heap"
+	"time"
+)
+
+// timer is a function that the loop calls at a specific time.
+type timer struct {
+	when  time.Time       // when to fire
+	fn    func(time.Time) // fired on the loop goroutine
+	index int             // index in the heap, -1 when not scheduled
+}
+
+// timers is a min-heap of timers ordered by when they fire.
+type timers []*timer
+
+func (ts timers) Len() int           { return len(ts) }
+func (ts timers) Less(i, j int) bool { return ts[i].when.Before(ts[j].when) }
+func (ts timers) Swap(i, j int) {
+	ts[i], ts[j] = ts[j], ts[i]
+	ts[i].index = i
+	ts[j].index = j
+}
+func (ts *timers) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*ts)
+	*ts = append(*ts, t)
+}
+func (ts *timers) Pop() interface{} {
+	old := *ts
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*ts = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+// schedule sets the timer to fire at when, replacing any earlier schedule.
+func (ts *timers) schedule(t *timer, when time.Time) {
+	t.when = when
+	if t.index >= 0 {
+		heap.Fix(ts, t.index)
+	} else {
+		heap.Push(ts, t)
+	}
+}
+
+// stop unschedules the timer.
+func (ts *timers) stop(t *timer) {
+	if t.index >= 0 {
+		heap.Remove(ts, t.index)
+	}
+}
+
+// timeout returns how long until the next timer fires, or -1 if there are
+// no timers.
+func (ts timers) timeout(now time.Time) time.Duration {
+	if len(ts) == 0 {
+		return -1
+	}
+	if d := ts[0].when.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// fire calls every timer that is due.
+func (ts *timers) fire(now time.Time) {
+	for len(*ts) > 0 && !(*ts)[0].when.After(now) {
+		t := heap.Pop(ts).(*timer)
+		t.fn(now)
+	}
+}
+
+// Timer calls a function on the loop goroutine after a duration. It's
+// created by Server.AfterFunc or Conn.AfterFunc, and its methods must also
+// be called on the loop goroutine, such as from an event.
+type Timer struct {
+	t    timer
+	fn   func()
+	loop *loop
+	c    *conn // owner, stops the timer on close
+}
+
+func newTimer(l *loop, c *conn, d time.Duration, fn func()) *Timer {
+	t := &Timer{fn: fn, loop: l, c: c}
+	t.t.index = -1
+	t.t.fn = t.fire
+	t.Reset(d)
+	return t
+}
+
+func (t *Timer) fire(now time.Time) {
+	if t.c != nil {
+		delete(t.c.timers, t)
+		if t.loop.events.Panic != nil {
+			defer t.loop.rescue(t.c)
+		}
+	}
+	t.fn()
+}
+
+// Stop stops the timer. Returns false if the timer has already fired or
+// been stopped.
+func (t *Timer) Stop() bool {
+	if t.t.index < 0 {
+		return false
+	}
+	t.loop.timers.stop(&t.t)
+	if t.c != nil {
+		delete(t.c.timers, t)
+	}
+	return true
+}
+
+// Reset changes the timer to fire after d. Returns true if the timer was
+// active. A timer of a closed connection can't be reset.
+func (t *Timer) Reset(d time.Duration) bool {
+	active := t.t.index >= 0
+	if t.c != nil {
+		if t.c.poll == nil {
+			return active
+		}
+		if t.c.timers == nil {
+			t.c.timers = make(map[*Timer]struct{})
+		}
+		t.c.timers[t] = struct{}{}
+	}
+	t.loop.timers.schedule(&t.t, t.loop.clockNow().Add(d))
+	return active
+}
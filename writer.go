@@ -0,0 +1,213 @@
+// Copyright 2020 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Writer adapts a connection to io.Writer and io.ReaderFrom, so that it can
+// be used with io.Copy, fmt.Fprintf and the like:
+//
+//	w := evio.NewWriter(c)
+//	fmt.Fprintf(w, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", size)
+//	io.Copy(w, f)
+//
+// Like the connection, a Writer must only be used from an event.
+type Writer struct {
+	c Conn
+}
+
+// NewWriter returns a Writer for the connection.
+func NewWriter(c Conn) *Writer {
+	return &Writer{c: c}
+}
+
+// Write queues p on the connection the same as Conn.Write, and always
+// writes all of p unless it returns an error. The error is ErrConnClosed
+// when the connection is closing, or ErrWriteBufferFull when p would grow
+// the output past MaxWriteBuffer. With a codec, each Write is a frame.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	c, ok := w.c.(*conn)
+	if !ok {
+		w.c.Write(p)
+		return len(p), nil
+	}
+	if c.poll == nil || c.action != None || c.wshut {
+		return 0, ErrConnClosed
+	}
+	if c.full(len(p)) {
+		return 0, ErrWriteBufferFull
+	}
+	c.Write(p)
+	return len(p), nil
+}
+
+// ReadFrom queues the data of r until EOF. When r is a regular *os.File, or
+// an *io.LimitedReader of one, the file is sent with sendfile(2) once the
+// output before it has been written, without being read into memory. The
+// file may be closed once ReadFrom returns, and its offset is moved past
+// the data, the same as reading it. The remainder of a sent file doesn't
+// count toward BufferedWrite or MaxWriteBuffer. Other readers are copied
+// with Write.
+func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
+	if c, ok := w.c.(*conn); ok && !c.udp && c.codec == nil {
+		if c.poll == nil || c.action != None || c.wshut {
+			return 0, ErrConnClosed
+		}
+		if n, ok, err := c.readFile(r); ok {
+			return n, err
+		}
+	}
+	// hide ReadFrom, which io.Copy would call again
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+// queuedFile is a file queued by Writer.ReadFrom.
+type queuedFile struct {
+	fd    int      // duplicate of the file's fd, closed once sent
+	off   int64    // offset of the next byte
+	n     int64    // bytes remaining
+	after [][]byte // output written after the file
+}
+
+// readFile queues r to be sent with sendfile(2), returning false if it's
+// not a regular file or the system can't send files.
+func (c *conn) readFile(r io.Reader) (n int64, ok bool, err error) {
+	lr, _ := r.(*io.LimitedReader)
+	if lr != nil {
+		r = lr.R
+	}
+	f, _ := r.(*os.File)
+	if f == nil || !canSendFile() {
+		return 0, false, nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, false, nil
+	}
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false, nil
+	}
+	n = fi.Size() - off
+	if lr != nil && lr.N < n {
+		n = lr.N
+	}
+	if n <= 0 {
+		return 0, true, nil
+	}
+	// the caller may close the file before it's sent
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return 0, true, os.NewSyscallError("dup", err)
+	}
+	syscall.CloseOnExec(fd)
+	if _, err := f.Seek(n, io.SeekCurrent); err != nil {
+		syscall.Close(fd)
+		return 0, true, err
+	}
+	if lr != nil {
+		lr.N -= n
+	}
+	c.files = append(c.files, &queuedFile{fd: fd, off: off, n: n})
+	c.countQueued()
+	if !c.write {
+		c.modReadWrite()
+	}
+	return n, true, nil
+}
+
+// maxSendFile is the most bytes of a file sent by a single sendfile call,
+// so that one connection doesn't hold up the loop.
+const maxSendFile = 1 << 20
+
+// sendFile sends the next part of the first queued file, of at most max
+// bytes when positive. It's called once the output before the file has been
+// written. When the file is done, the output written after it is queued.
+func (c *conn) sendFile(max int) (int, error) {
+	f := c.files[0]
+	size := f.n
+	if size > maxSendFile {
+		size = maxSendFile
+	}
+	if max > 0 && size > int64(max) {
+		size = int64(max)
+	}
+	// some systems don't move the offset
+	off := f.off
+	n, err := sendfile(c.fd, f.fd, &off, int(size))
+	if n < 0 {
+		n = 0
+	}
+	if n > 0 && err == syscall.EAGAIN {
+		// the next call finds the socket full
+		err = nil
+	}
+	if n == 0 && err == nil {
+		// the file was truncated after it was queued
+		err = io.ErrUnexpectedEOF
+	}
+	f.off += int64(n)
+	f.n -= int64(n)
+	if f.n == 0 {
+		syscall.Close(f.fd)
+		c.vec = f.after
+		c.files[0] = nil
+		c.files = c.files[1:]
+		if len(c.files) == 0 {
+			c.files = nil
+		}
+	}
+	return n, err
+}
+
+// writeSize returns the most bytes that the next write of the output may
+// write.
+func (c *conn) writeSize() int {
+	if c.out.n == 0 && len(c.vec) == 0 {
+		if f := c.files[0]; f.n < maxSendFile {
+			return int(f.n)
+		}
+		return maxSendFile
+	}
+	n := c.out.n
+	for _, buf := range c.vec {
+		n += len(buf)
+	}
+	return n
+}
+
+// queue queues buf to be written after the rest of the output, without
+// copying it.
+func (c *conn) queue(buf []byte) {
+	if n := len(c.files); n > 0 {
+		c.files[n-1].after = append(c.files[n-1].after, buf)
+	} else {
+		c.vec = append(c.vec, buf)
+	}
+	c.countQueued()
+}
+
+// queued returns the number of bytes of output that are waiting to be
+// written, including the remainder of the queued files.
+func (c *conn) queued() int64 {
+	n := int64(c.BufferedWrite())
+	for _, f := range c.files {
+		n += f.n
+	}
+	return n
+}
+
+// closeFiles closes the queued files, discarding the output written after
+// them.
+func (c *conn) closeFiles() {
+	for _, f := range c.files {
+		syscall.Close(f.fd)
+	}
+	c.files = nil
+}